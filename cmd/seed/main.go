@@ -0,0 +1,59 @@
+// Command seed prepares a fresh database. For now it promotes the first
+// administrator, who can then manage everyone else from the site:
+//
+//	go run ./cmd/seed -admin you@example.com
+package main
+
+import (
+	"context"
+	"flag"
+	"fmj/config"
+	"fmj/internal/auth"
+	"fmj/internal/models"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+)
+
+func main() {
+	adminEmail := flag.String("admin", "", "email of the registered user to promote to admin")
+	force := flag.Bool("force", false, "promote even if an admin already exists")
+	flag.Parse()
+
+	if *adminEmail == "" {
+		flag.Usage()
+		log.Fatal("seed: -admin is required")
+	}
+
+	cfg := config.NewConfig()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.MongoURI))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+
+	repo := auth.NewRepository(client.Database(cfg.DatabaseName), ctx)
+
+	admins, err := repo.CountUsersWithRole(ctx, models.RoleAdmin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if admins > 0 && !*force {
+		log.Fatalf("seed: %d admin(s) already exist, pass -force to add another", admins)
+	}
+
+	user, err := repo.FindUserByEmail(*adminEmail)
+	if err != nil {
+		log.Fatalf("seed: no user registered with %s: %v", *adminEmail, err)
+	}
+	if err := repo.AddRole(ctx, user.ID, models.RoleAdmin); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("seed: %s is now an admin", user.Email)
+}
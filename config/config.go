@@ -1,38 +1,183 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
 	MongoURI           string
 	DatabaseName       string
 	SessionSecret      string
+	TrustedProxies     []string // reverse proxies whose X-Forwarded-For is believed; none when empty
 	SMTPHost           string
 	SMTPPort           int
 	SMTPUsername       string
 	SMTPPassword       string
 	FromEmail          string
+	EmailTransport     string // "smtp", "file" or "http"; smtp when SMTPHost is set, file otherwise
+	EmailDir           string // maildir the file transport writes to
+	EmailAPIURL        string // where the http transport posts emails
+	EmailAPIKey        string
+	EmailWebhookSecret string // signs bounce and complaint webhooks
+	SMTPPoolSize       int    // SMTP connections kept open between emails
 	BaseURL            string
 	GoogleClientID     string
 	GoogleClientSecret string
 	GoogleCallbackURL  string
+	OIDCProviders      []OIDCProvider
+	PaymentGateway     string // gateway for new checkouts: "paystack", "flutterwave" or, in gin's debug mode, "fake"
+
+	PaystackSecretKey     string
+	PaystackBaseURL       string
+	FlutterwaveSecretKey  string
+	FlutterwaveSecretHash string // the "secret hash" set on the Flutterwave dashboard for webhooks
+	FlutterwaveBaseURL    string
+
+	FXProvider    string // exchange rate source: "static" (the default) or "http"
+	FXRatesURL    string
+	FXStaticRates string // e.g. "NGN=1550,GHS=15.2", per US dollar
+
+	PlatformFeeBPS int // platform fee on each donation, in basis points
+	PayoutHoldDays int // days a donation stays pending before it can be paid out
+}
+
+// OIDCProvider configures one OpenID Connect identity provider. Endpoints and
+// signing keys are discovered from IssuerURL.
+type OIDCProvider struct {
+	Name         string // used in URLs, e.g. /auth/{name}/login
+	DisplayName  string
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	CallbackURL  string
 }
 
 // NewConfig todo: Create .env file for these
 func NewConfig() *Config {
-	return &Config{
+	cfg := &Config{
 		MongoURI:           os.Getenv("MONGO_URI"),
 		SMTPPort:           func() int { port, _ := strconv.Atoi(os.Getenv("SMTP_PORT")); return port }(),
 		SessionSecret:      os.Getenv("SESSION_SECRET"),
+		TrustedProxies:     getenvList("TRUSTED_PROXIES"),
 		SMTPHost:           os.Getenv("SMTP_HOST"),
 		SMTPUsername:       os.Getenv("SMTP_USERNAME"),
 		SMTPPassword:       os.Getenv("SMTP_PASSWORD"),
 		FromEmail:          os.Getenv("FROM_EMAIL"),
+		EmailTransport:     os.Getenv("EMAIL_TRANSPORT"),
+		EmailDir:           getenvDefault("EMAIL_DIR", "tmp/mail"),
+		EmailAPIURL:        os.Getenv("EMAIL_API_URL"),
+		EmailAPIKey:        os.Getenv("EMAIL_API_KEY"),
+		EmailWebhookSecret: os.Getenv("EMAIL_WEBHOOK_SECRET"),
+		SMTPPoolSize:       getenvInt("SMTP_POOL_SIZE", 4),
 		BaseURL:            os.Getenv("BASE_URL"),
 		GoogleClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
 		GoogleClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
 		GoogleCallbackURL:  os.Getenv("GOOGLE_CALLBACK_URL"),
+		PaymentGateway:     os.Getenv("PAYMENT_GATEWAY"),
+
+		PaystackSecretKey:     os.Getenv("PAYSTACK_SECRET_KEY"),
+		PaystackBaseURL:       getenvDefault("PAYSTACK_BASE_URL", "https://api.paystack.co"),
+		FlutterwaveSecretKey:  os.Getenv("FLUTTERWAVE_SECRET_KEY"),
+		FlutterwaveSecretHash: os.Getenv("FLUTTERWAVE_SECRET_HASH"),
+		FlutterwaveBaseURL:    getenvDefault("FLUTTERWAVE_BASE_URL", "https://api.flutterwave.com"),
+
+		FXProvider:    os.Getenv("FX_PROVIDER"),
+		FXRatesURL:    getenvDefault("FX_RATES_URL", "https://open.er-api.com/v6/latest"),
+		FXStaticRates: getenvDefault("FX_STATIC_RATES", "NGN=1550,GHS=15.5,KES=129,ZAR=18.5"),
+
+		PlatformFeeBPS: getenvInt("PLATFORM_FEE_BPS", 500),
+		PayoutHoldDays: getenvInt("PAYOUT_HOLD_DAYS", 7),
+	}
+	cfg.OIDCProviders = loadOIDCProviders(cfg)
+	return cfg
+}
+
+// loadOIDCProviders builds the provider list. Google keeps its GOOGLE_*
+// variables; any other provider is listed in OIDC_PROVIDERS (comma
+// separated) and configured with OIDC_<NAME>_ISSUER_URL, _CLIENT_ID,
+// _CLIENT_SECRET and optionally _DISPLAY_NAME, _SCOPES and _CALLBACK_URL.
+func loadOIDCProviders(cfg *Config) []OIDCProvider {
+	var providers []OIDCProvider
+
+	if cfg.GoogleClientID != "" {
+		providers = append(providers, OIDCProvider{
+			Name:         "google",
+			DisplayName:  "Google",
+			IssuerURL:    "https://accounts.google.com",
+			ClientID:     cfg.GoogleClientID,
+			ClientSecret: cfg.GoogleClientSecret,
+			Scopes:       []string{"openid", "email", "profile"},
+			CallbackURL:  cfg.GoogleCallbackURL,
+		})
+	}
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "google" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+
+		scopes := strings.Fields(os.Getenv(prefix + "SCOPES"))
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "email", "profile"}
+		}
+
+		callbackURL := os.Getenv(prefix + "CALLBACK_URL")
+		if callbackURL == "" {
+			callbackURL = fmt.Sprintf("%s/auth/%s/callback", cfg.BaseURL, name)
+		}
+
+		displayName := os.Getenv(prefix + "DISPLAY_NAME")
+		if displayName == "" {
+			displayName = strings.ToUpper(name[:1]) + name[1:]
+		}
+
+		providers = append(providers, OIDCProvider{
+			Name:         name,
+			DisplayName:  displayName,
+			IssuerURL:    os.Getenv(prefix + "ISSUER_URL"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       scopes,
+			CallbackURL:  callbackURL,
+		})
+	}
+
+	return providers
+}
+
+// getenvDefault returns the environment variable key, or fallback when it
+// is unset or empty.
+func getenvDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getenvList returns the comma separated environment variable key, or nil
+// when it is unset or empty.
+func getenvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getenvInt returns the environment variable key as an int, or fallback
+// when it is unset or not a number.
+func getenvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
 	}
+	return value
 }
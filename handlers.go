@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmj/internal/utils"
 	"github.com/angelofallars/htmx-go"
-	"html/template"
 	"net/http"
 
 	"path/filepath"
@@ -16,35 +15,16 @@ import (
 
 // indexViewHandler handles a view for the index page.
 func indexViewHandler(c *gin.Context) {
-	var data map[string]interface{}
-	isAuthenticated := c.GetBool("isAuthenticated")
 	// Define paths to the user templates.
 	indexPage := filepath.Join("templates", "pages", "index.html")
 
-	data = map[string]interface{}{
-		"isAuthenticated": isAuthenticated,
-	}
-	utils.Render(c, indexPage, data)
+	utils.Render(c, indexPage, nil)
 
 }
 
 func showDashboardHandler(c *gin.Context) {
-	// Define paths to the templates
-	dashboardLayout := filepath.Join("templates", "dashboard.html")
 	dashboardPage := filepath.Join("templates", "pages", "dashboard_home.html")
-
-	// Parse templates
-	tmpl, err := template.ParseFiles(dashboardLayout, dashboardPage)
-	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
-		return
-	}
-
-	// Render the template
-	if err := tmpl.Execute(c.Writer, nil); err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
+	utils.RenderDashboard(c, dashboardPage, nil)
 }
 
 // showContentAPIHandler handles an API endpoint to show content.
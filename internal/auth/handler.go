@@ -1,42 +1,63 @@
 package auth
 
 import (
-	"context"
-	"crypto/rand"
-	"encoding/hex"
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmj/config"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	sessionstore "fmj/internal/session"
 	"fmj/internal/utils"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
-	goauth2 "golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/idtoken"
-	"google.golang.org/api/oauth2/v2"
+	"github.com/pquerna/otp"
+	"html/template"
+	"image/png"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
+// PendingTwoFactorSessionKey holds the ID of a user who passed the password
+// check but still has to enter a two-factor code. Such a session is not
+// signed in.
+const PendingTwoFactorSessionKey = "pending_2fa_user_id"
+
+const (
+	pendingTwoFactorAtKey = "pending_2fa_at"
+	totpSetupSecretKey    = "totp_setup_secret"
+
+	// pendingTwoFactorTTL is how long the user has to enter their code after
+	// the password step.
+	pendingTwoFactorTTL = 5 * time.Minute
+
+	// oauthLinkUserKey marks a provider round trip started from the
+	// dashboard to link an identity rather than sign in.
+	oauthLinkUserKey = "oauth_link_user_id"
+
+	pendingLinkProviderKey = "pending_link_provider"
+	pendingLinkSubjectKey  = "pending_link_subject"
+	pendingLinkEmailKey    = "pending_link_email"
+	pendingLinkPictureKey  = "pending_link_picture"
+	pendingLinkAtKey       = "pending_link_at"
+
+	// pendingLinkTTL is how long the user has to prove they own the
+	// existing account after signing in with a provider.
+	pendingLinkTTL = 10 * time.Minute
+)
+
 type Handler struct {
-	service      Service
-	config       *config.Config
-	oauth2Config *goauth2.Config
+	service   Service
+	config    *config.Config
+	providers *Providers
 }
 
-func NewHandler(service Service, cfg *config.Config) *Handler {
-	oauth2Config := &goauth2.Config{
-		ClientID:     cfg.GoogleClientID,
-		ClientSecret: cfg.GoogleClientSecret,
-		RedirectURL:  cfg.GoogleCallbackURL,
-		Scopes: []string{
-			"https://www.googleapis.com/auth/userinfo.email",
-			"https://www.googleapis.com/auth/userinfo.profile",
-			"openid",
-		},
-		Endpoint: google.Endpoint,
-	}
-	return &Handler{service: service, config: cfg, oauth2Config: oauth2Config}
+func NewHandler(service Service, providers *Providers, cfg *config.Config) *Handler {
+	return &Handler{service: service, config: cfg, providers: providers}
 }
 
 func (h *Handler) RegisterRoutes(r *gin.Engine) {
@@ -47,138 +68,166 @@ func (h *Handler) RegisterRoutes(r *gin.Engine) {
 		auth.GET("/register", h.ShowRegister)
 		auth.POST("/register", h.Register)
 		auth.GET("/verify", h.VerifyEmail)
+		auth.GET("/verify/resend", h.ShowResendVerification)
+		auth.POST("/verify/resend", h.ResendVerification)
+		auth.GET("/forgot", h.ShowForgotPassword)
+		auth.POST("/forgot", h.ForgotPassword)
+		auth.GET("/reset", h.ShowResetPassword)
+		auth.POST("/reset", h.ResetPassword)
 		auth.GET("/logout", h.Logout)
-		auth.GET("/google/login", h.GoogleLogin)
-		auth.GET("/google/callback", h.GoogleCallback)
+		auth.GET("/:provider/login", h.ProviderLogin)
+		auth.GET("/:provider/callback", h.ProviderCallback)
+		auth.GET("/magic", h.ShowMagicLink)
+		auth.POST("/magic", h.RequestMagicLink)
+		auth.GET("/magic/consume", h.ShowConsumeMagicLink)
+		auth.POST("/magic/consume", h.ConsumeMagicLink)
+		auth.GET("/2fa", h.ShowTwoFactor)
+		auth.POST("/2fa", h.VerifyTwoFactor)
+		auth.GET("/link", h.ShowLinkAccount)
+		auth.POST("/link", h.LinkAccount)
+		auth.POST("/link/email", h.RequestLinkConfirmation)
+		auth.GET("/link/confirm", h.ShowConfirmLink)
+		auth.POST("/link/confirm", h.ConfirmLink)
 	}
+	r.POST("/language", h.SetLanguage)
+}
+
+// RegisterDashboardRoutes registers the account security pages. r must
+// already require authentication.
+func (h *Handler) RegisterDashboardRoutes(r *gin.RouterGroup) {
+	r.GET("/dashboard/security", h.ShowSecurity)
+	r.GET("/dashboard/security/2fa/setup", h.ShowTwoFactorSetup)
+	r.POST("/dashboard/security/2fa/enable", h.EnableTwoFactor)
+	r.POST("/dashboard/security/2fa/disable", h.DisableTwoFactor)
+	r.GET("/dashboard/connections", h.ShowConnections)
+	r.POST("/dashboard/connections/:provider/unlink", h.UnlinkProvider)
 }
 
-func (h *Handler) GoogleLogin(c *gin.Context) {
-	// Generate random state
-	state := make([]byte, 16)
-	rand.Read(state)
+func (h *Handler) ProviderLogin(c *gin.Context) {
+	provider, err := h.providers.Get(c.Param("provider"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	// Generate random state and nonce
+	state, err := generateToken()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	url, err := provider.AuthCodeURL(c, state, nonce)
+	if err != nil {
+		slog.Error("OIDC login error", slog.String("provider", provider.Name), slog.String("error", err.Error()))
+		c.Redirect(http.StatusFound, "/auth/login")
+		return
+	}
 
-	// Store state in session
+	// Store state and nonce in session
 	session := sessions.Default(c)
-	session.Set("oauth_state", hex.EncodeToString(state))
+	session.Set("oauth_state", state)
+	session.Set("oauth_nonce", nonce)
+
+	// A signed-in user coming from the connections page links the identity
+	// to their account instead.
+	userID, _ := session.Get("user_id").(string)
+	if c.Query("link") != "" && userID != "" {
+		session.Set(oauthLinkUserKey, userID)
+	} else {
+		session.Delete(oauthLinkUserKey)
+	}
 	session.Save()
 
-	// Redirect to Google
-	url := h.oauth2Config.AuthCodeURL(hex.EncodeToString(state), goauth2.AccessTypeOffline, goauth2.ApprovalForce)
+	// Redirect to the provider
 	c.Redirect(http.StatusTemporaryRedirect, url)
 }
 
-func (h *Handler) GoogleCallback(c *gin.Context) {
+func (h *Handler) ProviderCallback(c *gin.Context) {
 	var data map[string]interface{}
 	toastPage := filepath.Join("templates", "partials", "toast.html")
 	indexPage := filepath.Join("templates", "pages", "index.html")
 
-	// Verify state
-	session := sessions.Default(c)
-	expectedState := session.Get("oauth_state")
-	if expectedState != c.Query("state") {
-		data = map[string]interface{}{
-			"Error": "An error occurred, try again",
-		}
-		utils.Render(c, indexPage, nil)
-		utils.Render(c, toastPage, data)
-		slog.Error("Google callback state mismatch", slog.String("state", c.Query("state")))
+	provider, err := h.providers.Get(c.Param("provider"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
-	session.Delete("oauth_state")
 
-	// Exchange code for token
-	code := c.Query("code")
-	token, err := h.oauth2Config.Exchange(c, code)
-	if err != nil {
+	// Verify state
+	session := sessions.Default(c)
+	expectedState, _ := session.Get("oauth_state").(string)
+	nonce, _ := session.Get("oauth_nonce").(string)
+	session.Delete("oauth_state")
+	session.Delete("oauth_nonce")
+	if expectedState == "" || expectedState != c.Query("state") {
 		data = map[string]interface{}{
-			"Error": "An error occurred, try again",
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.error"),
 		}
 		utils.Render(c, indexPage, nil)
 		utils.Render(c, toastPage, data)
-		slog.Error("Failed to exchange code", slog.String("error", err.Error()))
+		slog.Error("OIDC callback state mismatch", slog.String("provider", provider.Name), slog.String("state", c.Query("state")))
 		return
 	}
 
-	// copied now
-	// Check token expiration
-	if token.Expiry.Before(time.Now()) {
+	// Exchange code for a verified identity
+	identity, err := provider.Exchange(c, c.Query("code"), nonce)
+	if err != nil {
 		data = map[string]interface{}{
-			"Error": "Session expired. Please try logging in again.",
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.sign_in_failed"),
 		}
 		utils.Render(c, indexPage, nil)
 		utils.Render(c, toastPage, data)
-		slog.Error("Google callback error", slog.String("error", "Token expired"))
+		slog.Error("OIDC callback error", slog.String("provider", provider.Name), slog.String("error", err.Error()))
 		return
 	}
 
-	// Refresh token if available (optional)
-	if token.RefreshToken != "" && token.Expiry.Before(time.Now().Add(-5*time.Minute)) {
-		tokenSource := h.oauth2Config.TokenSource(context.Background(), token)
-		newToken, refreshErr := tokenSource.Token()
-		if refreshErr != nil {
-			data = map[string]interface{}{
-				"Error": "Failed to refresh token. Please try again.",
-			}
-			utils.Render(c, indexPage, nil)
-			utils.Render(c, toastPage, data)
-			slog.Error("Google callback error", slog.String("error", refreshErr.Error()))
+	linkUserID, _ := session.Get(oauthLinkUserKey).(string)
+	session.Delete(oauthLinkUserKey)
+	if user := utils.CurrentUser(c); user != nil && linkUserID == user.ID.Hex() {
+		session.Save()
+		if err := h.service.LinkIdentity(c, linkUserID, identity); err != nil {
+			slog.Error("Error linking identity", slog.String("provider", provider.Name), slog.String("user_id", linkUserID), slog.String("error", err.Error()))
+			h.renderConnections(c, user, i18n.Message(c.GetString(utils.LocaleKey), err))
 			return
 		}
-		token = newToken
+		c.Redirect(http.StatusFound, "/dashboard/connections")
+		return
 	}
-	//end copy
 
-	// Verify ID token
-	idToken, ok := token.Extra("id_token").(string)
-	if !ok {
-		data = map[string]interface{}{
-			"Error": "ID token missing in response. Please try again.",
-		}
-		utils.Render(c, indexPage, nil)
-		utils.Render(c, toastPage, data)
-		slog.Error("Google callback error", slog.String("error", "ID token missing"))
+	// Handle user login/registration
+	user, err := h.service.HandleOIDCLogin(c, identity, c.GetString(utils.LocaleKey))
+	if errors.Is(err, ErrLinkRequired) {
+		// Make the user prove they own the existing account first.
+		setPendingLink(session, identity)
+		session.Save()
+		c.Redirect(http.StatusFound, "/auth/link")
 		return
 	}
-
-	payload, err := idtoken.Validate(context.Background(), idToken, h.config.GoogleClientID)
 	if err != nil {
-		// Log additional debugging information
-		slog.Error("Failed to validate ID token",
-			slog.String("error", err.Error()),
-			slog.String("idToken", idToken),
-			slog.String("clientID", h.config.GoogleClientID),
-		)
 		data = map[string]interface{}{
-			"Error": "Failed to validate ID token. Please try again.",
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.error"),
+		}
+		if errors.Is(err, ErrUnverifiedProviderEmail) {
+			data["Error"] = i18n.Message(c.GetString(utils.LocaleKey), err)
 		}
 		utils.Render(c, indexPage, nil)
 		utils.Render(c, toastPage, data)
-		slog.Error("Google callback error", slog.String("error", err.Error()))
+		slog.Error("OIDC callback error", slog.String("provider", provider.Name), slog.String("error", err.Error()))
 		return
 	}
 
-	slog.Info("ID token successfully validated", slog.Any("payload", payload))
-
-	// Extract user info from claims
-	emailVerified := payload.Claims["email_verified"].(bool)
-	userinfo := &oauth2.Userinfo{
-		Id:            payload.Claims["sub"].(string),
-		Email:         payload.Claims["email"].(string),
-		Name:          payload.Claims["name"].(string),
-		Picture:       payload.Claims["picture"].(string),
-		VerifiedEmail: &emailVerified,
-	}
-
-	// Handle user login/registration
-	user, err := h.service.HandleGoogleLogin(c, userinfo)
-	if err != nil {
-		data = map[string]interface{}{
-			"Error": "An error occurred, try again",
-		}
-		utils.Render(c, indexPage, nil)
-		utils.Render(c, toastPage, data)
-		slog.Error("Google callback error", slog.String("error", err.Error()))
+	// Accounts with two-factor authentication still need a code.
+	sessionstore.Regenerate(session)
+	if user.TOTPEnabled {
+		startTwoFactor(session, user.ID.Hex())
+		session.Save()
+		c.Redirect(http.StatusFound, "/auth/2fa")
 		return
 	}
 
@@ -187,17 +236,19 @@ func (h *Handler) GoogleCallback(c *gin.Context) {
 	session.Save()
 
 	data = map[string]interface{}{
-		"Success": "Login in successful",
+		"Success": i18n.T(c.GetString(utils.LocaleKey), "toast.signed_in"),
 	}
 	utils.Render(c, indexPage, nil)
 	utils.Render(c, toastPage, data)
-	slog.Error("Google callback error", slog.String("error", err.Error()))
 }
 
 func (h *Handler) ShowLogin(c *gin.Context) {
 	// Define paths to the user templates.
 	loginPage := filepath.Join("templates", "auth", "login.html")
-	utils.Render(c, loginPage, nil)
+	data := map[string]interface{}{
+		"Providers": h.providers.List(),
+	}
+	utils.Render(c, loginPage, data)
 }
 
 func (h *Handler) Login(c *gin.Context) {
@@ -207,36 +258,42 @@ func (h *Handler) Login(c *gin.Context) {
 	email := c.PostForm("email")
 	password := c.PostForm("password")
 
-	user, err := h.service.Login(email, password)
+	user, err := h.service.Login(c, email, password, c.ClientIP())
 	if err != nil {
 		// Prepare error data if login fails.
 		data = map[string]interface{}{
-			"Error": err.Error(),
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
+		}
+		if errors.Is(err, ErrEmailNotVerified) {
+			data["ErrorLink"] = "/auth/verify/resend"
+			data["ErrorLinkText"] = i18n.T(c.GetString(utils.LocaleKey), "toast.resend_verification")
 		}
-		slog.Error("Error logging a user in database", slog.String("email", email), slog.String("password", password), slog.String("error", err.Error()))
+		slog.Error("Error logging a user in database", slog.String("email", email), slog.String("error", err.Error()))
 		utils.Render(c, toastPage, data)
 		return
 	}
 
 	// Login succeeded, set session.
-	session := sessions.Default(c)
-	session.Set("user_id", user.ID.Hex())
-	if err := session.Save(); err != nil {
+	next, err := signIn(sessions.Default(c), user)
+	if err != nil {
 		data = map[string]interface{}{
-			"Error": "An error occurred while starting your session.",
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.session_failed"),
 		}
 		slog.Error("An error occurred while saving the session", "error", err)
 		utils.Render(c, toastPage, data)
 		return
 	}
 
-	// Redirect to dashboard on successful login.
-	c.Header("HX-Redirect", "/dashboard")
+	// Redirect to dashboard (or the two-factor step) on successful login.
+	c.Header("HX-Redirect", next)
 }
 
 func (h *Handler) ShowRegister(c *gin.Context) {
 	registerPage := filepath.Join("templates", "auth", "register.html")
-	utils.Render(c, registerPage, nil)
+	data := map[string]interface{}{
+		"Providers": h.providers.List(),
+	}
+	utils.Render(c, registerPage, data)
 }
 
 func (h *Handler) Register(c *gin.Context) {
@@ -246,9 +303,9 @@ func (h *Handler) Register(c *gin.Context) {
 	email := c.PostForm("email")
 	password := c.PostForm("password")
 
-	if err := h.service.Register(c, fullName, email, password); err != nil {
+	if err := h.service.Register(c, fullName, email, password, c.GetString(utils.LocaleKey)); err != nil {
 		data = map[string]interface{}{
-			"Error": err.Error(),
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
 		}
 		utils.Render(c, toastPage, data)
 		slog.Error("Error registering user in database", slog.String("email", email), slog.String("full_name", fullName), slog.String("email", email), slog.String("error", err.Error()))
@@ -256,7 +313,7 @@ func (h *Handler) Register(c *gin.Context) {
 	}
 
 	data = map[string]interface{}{
-		"Success": "Registration successful! Please check your email to verify your account.",
+		"Success": i18n.T(c.GetString(utils.LocaleKey), "toast.registered"),
 	}
 	utils.Render(c, toastPage, data)
 }
@@ -270,7 +327,7 @@ func (h *Handler) VerifyEmail(c *gin.Context) {
 
 	if err := h.service.VerifyEmail(c, code); err != nil {
 		data = map[string]interface{}{
-			"Error": err.Error(),
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
 		}
 		utils.Render(c, indexPage, nil)
 		utils.Render(c, toastPage, data)
@@ -279,15 +336,607 @@ func (h *Handler) VerifyEmail(c *gin.Context) {
 	}
 
 	data = map[string]interface{}{
-		"Success": "Email verified successfully! You can now login.",
+		"Success": i18n.T(c.GetString(utils.LocaleKey), "toast.verified"),
 	}
 	utils.Render(c, indexPage, nil)
 	utils.Render(c, toastPage, data)
 }
 
+func (h *Handler) ShowMagicLink(c *gin.Context) {
+	magicPage := filepath.Join("templates", "auth", "magic.html")
+	utils.Render(c, magicPage, nil)
+}
+
+func (h *Handler) RequestMagicLink(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	email := c.PostForm("email")
+
+	if err := h.service.RequestMagicLink(c, email); err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.error"),
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error requesting magic link", slog.String("email", email), slog.String("error", err.Error()))
+		return
+	}
+
+	data = map[string]interface{}{
+		"Success": i18n.T(c.GetString(utils.LocaleKey), "toast.magic_sent"),
+	}
+	utils.Render(c, toastPage, data)
+}
+
+// ShowConsumeMagicLink asks the user to confirm before the token is used, so
+// mail scanners that prefetch links can't burn it.
+func (h *Handler) ShowConsumeMagicLink(c *gin.Context) {
+	consumePage := filepath.Join("templates", "auth", "magic_consume.html")
+	data := map[string]interface{}{
+		"Token": c.Query("token"),
+	}
+	utils.Render(c, consumePage, data)
+}
+
+func (h *Handler) ConsumeMagicLink(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	user, err := h.service.ConsumeMagicLink(c, c.PostForm("token"))
+	if err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error consuming magic link", slog.String("error", err.Error()))
+		return
+	}
+
+	next, err := signIn(sessions.Default(c), user)
+	if err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.session_failed"),
+		}
+		slog.Error("An error occurred while saving the session", "error", err)
+		utils.Render(c, toastPage, data)
+		return
+	}
+
+	c.Header("HX-Redirect", next)
+}
+
+func (h *Handler) ShowTwoFactor(c *gin.Context) {
+	twoFactorPage := filepath.Join("templates", "auth", "two_factor.html")
+
+	if pendingTwoFactorUser(sessions.Default(c)) == "" {
+		c.Redirect(http.StatusFound, "/auth/login")
+		return
+	}
+	utils.Render(c, twoFactorPage, nil)
+}
+
+func (h *Handler) VerifyTwoFactor(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	session := sessions.Default(c)
+	userID := pendingTwoFactorUser(session)
+	if userID == "" {
+		c.Header("HX-Redirect", "/auth/login")
+		return
+	}
+
+	user, err := h.service.VerifyTwoFactor(c, userID, c.PostForm("code"), c.ClientIP())
+	if err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error verifying two-factor code", slog.String("user_id", userID), slog.String("error", err.Error()))
+		return
+	}
+
+	session.Delete(PendingTwoFactorSessionKey)
+	session.Delete(pendingTwoFactorAtKey)
+	session.Set("user_id", user.ID.Hex())
+	sessionstore.Regenerate(session)
+	if err := session.Save(); err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.session_failed"),
+		}
+		slog.Error("An error occurred while saving the session", "error", err)
+		utils.Render(c, toastPage, data)
+		return
+	}
+
+	c.Header("HX-Redirect", "/dashboard")
+}
+
+func (h *Handler) ShowSecurity(c *gin.Context) {
+	securityPage := filepath.Join("templates", "pages", "dashboard_security.html")
+
+	user := utils.CurrentUser(c)
+	data := map[string]interface{}{
+		"User":              user,
+		"RecoveryCodesLeft": len(user.RecoveryCodes),
+	}
+	utils.RenderDashboard(c, securityPage, data)
+}
+
+func (h *Handler) ShowTwoFactorSetup(c *gin.Context) {
+	setupPage := filepath.Join("templates", "pages", "dashboard_two_factor_setup.html")
+
+	session := sessions.Default(c)
+	userID := utils.CurrentUser(c).ID.Hex()
+
+	key, err := h.service.GenerateTOTPKey(c, userID)
+	if err != nil {
+		slog.Error("Error generating TOTP key", slog.String("user_id", userID), slog.String("error", err.Error()))
+		c.Redirect(http.StatusFound, "/dashboard/security")
+		return
+	}
+
+	qrCode, err := qrCodeDataURL(key)
+	if err != nil {
+		slog.Error("Error rendering TOTP QR code", slog.String("user_id", userID), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// The secret only reaches the user record once a code confirms it.
+	session.Set(totpSetupSecretKey, key.Secret())
+	if err := session.Save(); err != nil {
+		slog.Error("An error occurred while saving the session", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"QRCode": qrCode,
+		"Secret": key.Secret(),
+	}
+	utils.RenderDashboard(c, setupPage, data)
+}
+
+func (h *Handler) EnableTwoFactor(c *gin.Context) {
+	setupPage := filepath.Join("templates", "pages", "dashboard_two_factor_setup.html")
+	recoveryPage := filepath.Join("templates", "pages", "dashboard_recovery_codes.html")
+
+	session := sessions.Default(c)
+	userID := utils.CurrentUser(c).ID.Hex()
+	secret, _ := session.Get(totpSetupSecretKey).(string)
+
+	codes, err := h.service.EnableTOTP(c, userID, secret, c.PostForm("code"))
+	if err != nil {
+		slog.Error("Error enabling two-factor authentication", slog.String("user_id", userID), slog.String("error", err.Error()))
+		key, keyErr := h.service.GenerateTOTPKey(c, userID)
+		if keyErr != nil {
+			c.Redirect(http.StatusFound, "/dashboard/security")
+			return
+		}
+		qrCode, qrErr := qrCodeDataURL(key)
+		if qrErr != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		session.Set(totpSetupSecretKey, key.Secret())
+		session.Save()
+		utils.RenderDashboard(c, setupPage, map[string]interface{}{
+			"QRCode": qrCode,
+			"Secret": key.Secret(),
+			"Error":  i18n.T(c.GetString(utils.LocaleKey), "auth.error.code_mismatch"),
+		})
+		return
+	}
+
+	session.Delete(totpSetupSecretKey)
+	session.Save()
+
+	data := map[string]interface{}{
+		"RecoveryCodes": codes,
+	}
+	utils.RenderDashboard(c, recoveryPage, data)
+}
+
+func (h *Handler) DisableTwoFactor(c *gin.Context) {
+	securityPage := filepath.Join("templates", "pages", "dashboard_security.html")
+
+	user := utils.CurrentUser(c)
+	userID := user.ID.Hex()
+
+	if err := h.service.DisableTOTP(c, userID, c.PostForm("code")); err != nil {
+		slog.Error("Error disabling two-factor authentication", slog.String("user_id", userID), slog.String("error", err.Error()))
+		utils.RenderDashboard(c, securityPage, map[string]interface{}{
+			"User":              user,
+			"RecoveryCodesLeft": len(user.RecoveryCodes),
+			"Error":             i18n.Message(c.GetString(utils.LocaleKey), err),
+		})
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/security")
+}
+
+// ShowLinkAccount asks someone who signed in with a provider to prove they
+// own the existing account with the same email address.
+func (h *Handler) ShowLinkAccount(c *gin.Context) {
+	linkPage := filepath.Join("templates", "auth", "link.html")
+
+	identity := h.pendingLink(sessions.Default(c))
+	if identity == nil {
+		c.Redirect(http.StatusFound, "/auth/login")
+		return
+	}
+
+	data := map[string]interface{}{
+		"ProviderName": identity.ProviderName,
+		"Email":        identity.Email,
+	}
+	utils.Render(c, linkPage, data)
+}
+
+func (h *Handler) LinkAccount(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	session := sessions.Default(c)
+	identity := h.pendingLink(session)
+	if identity == nil {
+		c.Header("HX-Redirect", "/auth/login")
+		return
+	}
+
+	user, err := h.service.LinkWithPassword(c, identity, c.PostForm("password"), c.ClientIP())
+	if err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error linking identity", slog.String("provider", identity.Provider), slog.String("email", identity.Email), slog.String("error", err.Error()))
+		return
+	}
+
+	clearPendingLink(session)
+	next, err := signIn(session, user)
+	if err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.session_failed"),
+		}
+		slog.Error("An error occurred while saving the session", "error", err)
+		utils.Render(c, toastPage, data)
+		return
+	}
+
+	c.Header("HX-Redirect", next)
+}
+
+func (h *Handler) RequestLinkConfirmation(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	session := sessions.Default(c)
+	identity := h.pendingLink(session)
+	if identity == nil {
+		c.Header("HX-Redirect", "/auth/login")
+		return
+	}
+
+	if err := h.service.RequestLinkConfirmation(c, identity); err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.error"),
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error requesting link confirmation", slog.String("provider", identity.Provider), slog.String("email", identity.Email), slog.String("error", err.Error()))
+		return
+	}
+
+	clearPendingLink(session)
+	session.Save()
+
+	data = map[string]interface{}{
+		"Success": i18n.T(c.GetString(utils.LocaleKey), "toast.link_sent"),
+	}
+	utils.Render(c, toastPage, data)
+}
+
+// ShowConfirmLink asks for a click before the token is used, like
+// ShowConsumeMagicLink.
+func (h *Handler) ShowConfirmLink(c *gin.Context) {
+	confirmPage := filepath.Join("templates", "auth", "link_confirm.html")
+	data := map[string]interface{}{
+		"Token": c.Query("token"),
+	}
+	utils.Render(c, confirmPage, data)
+}
+
+func (h *Handler) ConfirmLink(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	user, err := h.service.ConfirmLink(c, c.PostForm("token"))
+	if err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error confirming account link", slog.String("error", err.Error()))
+		return
+	}
+
+	next, err := signIn(sessions.Default(c), user)
+	if err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.session_failed"),
+		}
+		slog.Error("An error occurred while saving the session", "error", err)
+		utils.Render(c, toastPage, data)
+		return
+	}
+
+	c.Header("HX-Redirect", next)
+}
+
+func (h *Handler) ShowConnections(c *gin.Context) {
+	h.renderConnections(c, utils.CurrentUser(c), "")
+}
+
+func (h *Handler) UnlinkProvider(c *gin.Context) {
+	user := utils.CurrentUser(c)
+	userID := user.ID.Hex()
+
+	if err := h.service.UnlinkIdentity(c, userID, c.Param("provider")); err != nil {
+		slog.Error("Error unlinking identity", slog.String("provider", c.Param("provider")), slog.String("user_id", userID), slog.String("error", err.Error()))
+		h.renderConnections(c, user, i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/connections")
+}
+
+// connection is a row on the connections page.
+type connection struct {
+	Provider *Provider
+	Identity *models.LinkedIdentity
+}
+
+func (h *Handler) renderConnections(c *gin.Context, user *models.User, errMsg string) {
+	connectionsPage := filepath.Join("templates", "pages", "dashboard_connections.html")
+
+	var connections []connection
+	for _, provider := range h.providers.List() {
+		connections = append(connections, connection{
+			Provider: provider,
+			Identity: user.Identity(provider.Name),
+		})
+	}
+
+	data := map[string]interface{}{
+		"User":        user,
+		"Connections": connections,
+		"Error":       errMsg,
+	}
+	utils.RenderDashboard(c, connectionsPage, data)
+}
+
+// setPendingLink remembers an identity waiting to be linked to the account
+// that shares its email address.
+func setPendingLink(session sessions.Session, identity *Identity) {
+	session.Set(pendingLinkProviderKey, identity.Provider)
+	session.Set(pendingLinkSubjectKey, identity.Subject)
+	session.Set(pendingLinkEmailKey, identity.Email)
+	session.Set(pendingLinkPictureKey, identity.Picture)
+	session.Set(pendingLinkAtKey, time.Now().Unix())
+}
+
+func clearPendingLink(session sessions.Session) {
+	session.Delete(pendingLinkProviderKey)
+	session.Delete(pendingLinkSubjectKey)
+	session.Delete(pendingLinkEmailKey)
+	session.Delete(pendingLinkPictureKey)
+	session.Delete(pendingLinkAtKey)
+}
+
+// pendingLink returns the identity waiting to be linked, or nil if there is
+// none or the user took too long.
+func (h *Handler) pendingLink(session sessions.Session) *Identity {
+	name, _ := session.Get(pendingLinkProviderKey).(string)
+	startedAt, _ := session.Get(pendingLinkAtKey).(int64)
+	if name == "" || time.Since(time.Unix(startedAt, 0)) > pendingLinkTTL {
+		return nil
+	}
+	provider, err := h.providers.Get(name)
+	if err != nil {
+		return nil
+	}
+
+	subject, _ := session.Get(pendingLinkSubjectKey).(string)
+	email, _ := session.Get(pendingLinkEmailKey).(string)
+	picture, _ := session.Get(pendingLinkPictureKey).(string)
+	return &Identity{
+		Provider:      provider.Name,
+		ProviderName:  provider.DisplayName,
+		Subject:       subject,
+		Email:         email,
+		EmailVerified: true,
+		Picture:       picture,
+	}
+}
+
+// signIn starts a session for user, or the two-factor step when they have it
+// enabled, and returns where the browser should go next.
+func signIn(session sessions.Session, user *models.User) (string, error) {
+	sessionstore.Regenerate(session)
+	if user.TOTPEnabled {
+		// Hold off on user_id until the second factor checks out.
+		startTwoFactor(session, user.ID.Hex())
+		return "/auth/2fa", session.Save()
+	}
+	session.Set("user_id", user.ID.Hex())
+	return "/dashboard", session.Save()
+}
+
+// startTwoFactor marks the session as waiting for userID's second factor.
+func startTwoFactor(session sessions.Session, userID string) {
+	session.Delete("user_id")
+	session.Set(PendingTwoFactorSessionKey, userID)
+	session.Set(pendingTwoFactorAtKey, time.Now().Unix())
+}
+
+// pendingTwoFactorUser returns the user waiting on a second factor, or "" if
+// there is none or they took too long.
+func pendingTwoFactorUser(session sessions.Session) string {
+	userID, _ := session.Get(PendingTwoFactorSessionKey).(string)
+	startedAt, _ := session.Get(pendingTwoFactorAtKey).(int64)
+	if userID == "" || time.Since(time.Unix(startedAt, 0)) > pendingTwoFactorTTL {
+		return ""
+	}
+	return userID
+}
+
+// qrCodeDataURL renders the key's otpauth URL as an inline PNG.
+func qrCodeDataURL(key *otp.Key) (template.URL, error) {
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+func (h *Handler) ShowResendVerification(c *gin.Context) {
+	resendPage := filepath.Join("templates", "auth", "resend.html")
+	utils.Render(c, resendPage, nil)
+}
+
+func (h *Handler) ResendVerification(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	email := c.PostForm("email")
+
+	if err := h.service.ResendVerification(c, email, c.ClientIP()); err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error resending verification email", slog.String("email", email), slog.String("error", err.Error()))
+		return
+	}
+
+	data = map[string]interface{}{
+		"Success": i18n.T(c.GetString(utils.LocaleKey), "toast.verification_sent"),
+	}
+	utils.Render(c, toastPage, data)
+}
+
+func (h *Handler) ShowForgotPassword(c *gin.Context) {
+	forgotPage := filepath.Join("templates", "auth", "forgot.html")
+	utils.Render(c, forgotPage, nil)
+}
+
+func (h *Handler) ForgotPassword(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	email := c.PostForm("email")
+
+	if err := h.service.RequestPasswordReset(c, email); err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.error"),
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error requesting password reset", slog.String("email", email), slog.String("error", err.Error()))
+		return
+	}
+
+	data = map[string]interface{}{
+		"Success": i18n.T(c.GetString(utils.LocaleKey), "toast.reset_sent"),
+	}
+	utils.Render(c, toastPage, data)
+}
+
+func (h *Handler) ShowResetPassword(c *gin.Context) {
+	resetPage := filepath.Join("templates", "auth", "reset.html")
+	data := map[string]interface{}{
+		"Token": c.Query("token"),
+	}
+	utils.Render(c, resetPage, data)
+}
+
+func (h *Handler) ResetPassword(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	token := c.PostForm("token")
+	password := c.PostForm("password")
+
+	if password != c.PostForm("confirm_password") {
+		data = map[string]interface{}{
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "auth.error.passwords_mismatch"),
+		}
+		utils.Render(c, toastPage, data)
+		return
+	}
+
+	if err := h.service.ResetPassword(c, token, password); err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error resetting password", slog.String("error", err.Error()))
+		return
+	}
+
+	// Redirect to login so the user signs in with the new password.
+	c.Header("HX-Redirect", "/auth/login")
+}
+
+// languageCookieMaxAge is how long a visitor's language choice is remembered.
+const languageCookieMaxAge = 60 * 60 * 24 * 365
+
+// SetLanguage switches the site to the posted locale and goes back to the
+// page the form was on. Signed-in users also get it saved on their account,
+// so their emails follow.
+func (h *Handler) SetLanguage(c *gin.Context) {
+	locale := c.PostForm("locale")
+	if !i18n.Supported(locale) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(i18n.Cookie, locale, languageCookieMaxAge, "/", "", false, true)
+	if user := utils.CurrentUser(c); user != nil {
+		if err := h.service.SetLocale(c, user.ID.Hex(), locale); err != nil {
+			slog.Error("Error saving language", slog.String("user_id", user.ID.Hex()), slog.String("error", err.Error()))
+		}
+	}
+
+	c.Redirect(http.StatusSeeOther, sameSiteReferer(c.Request))
+}
+
+// sameSiteReferer returns the path of the page a request came from, or "/"
+// when there is none. Only the path is kept, so a forged Referer can't send
+// the browser to another site.
+func sameSiteReferer(r *http.Request) string {
+	referer, err := url.Parse(r.Referer())
+	if err != nil || referer.Host != r.Host || !strings.HasPrefix(referer.Path, "/") {
+		return "/"
+	}
+	if referer.RawQuery != "" {
+		return referer.Path + "?" + referer.RawQuery
+	}
+	return referer.Path
+}
+
 func (h *Handler) Logout(c *gin.Context) {
 	session := sessions.Default(c)
 	session.Clear()
+	// Deletes the signed-in session and leaves the browser an empty one.
+	sessionstore.Regenerate(session)
 	err := session.Save()
 	if err != nil {
 		return
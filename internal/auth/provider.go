@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmj/config"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	goauth2 "golang.org/x/oauth2"
+	"strconv"
+	"sync"
+)
+
+// ErrUnknownProvider is returned for a provider name that isn't configured.
+var ErrUnknownProvider = errors.New("unknown identity provider")
+
+// Identity is what an identity provider tells us about the person signing in.
+type Identity struct {
+	Provider      string
+	ProviderName  string // human-readable, e.g. "Google"
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+// Provider is a single OpenID Connect identity provider. Discovery runs on
+// first use so an unreachable IdP doesn't stop the server from starting.
+type Provider struct {
+	Name        string
+	DisplayName string
+
+	config   config.OIDCProvider
+	mu       sync.Mutex
+	oidc     *oidc.Provider
+	oauth2   *goauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// Providers is the registry of configured identity providers.
+type Providers struct {
+	byName map[string]*Provider
+	list   []*Provider
+}
+
+func NewProviders(cfgs []config.OIDCProvider) *Providers {
+	p := &Providers{byName: make(map[string]*Provider)}
+	for _, cfg := range cfgs {
+		provider := &Provider{
+			Name:        cfg.Name,
+			DisplayName: cfg.DisplayName,
+			config:      cfg,
+		}
+		p.byName[cfg.Name] = provider
+		p.list = append(p.list, provider)
+	}
+	return p
+}
+
+// Get returns the provider registered under name.
+func (p *Providers) Get(name string) (*Provider, error) {
+	provider, ok := p.byName[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return provider, nil
+}
+
+// List returns the providers in configuration order, for login buttons.
+func (p *Providers) List() []*Provider {
+	return p.list
+}
+
+// discover loads the provider's OIDC metadata and signing keys once.
+func (p *Provider) discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oidc != nil {
+		return nil
+	}
+
+	// The key set keeps using this context to refresh JWKS, so it must
+	// outlive the request that triggered discovery.
+	provider, err := oidc.NewProvider(context.WithoutCancel(ctx), p.config.IssuerURL)
+	if err != nil {
+		return fmt.Errorf("discovering %s: %w", p.Name, err)
+	}
+
+	p.oidc = provider
+	p.oauth2 = &goauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.CallbackURL,
+		Scopes:       p.config.Scopes,
+		Endpoint:     provider.Endpoint(),
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	return nil
+}
+
+// AuthCodeURL returns the URL to send the browser to for sign-in.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	if err := p.discover(ctx); err != nil {
+		return "", err
+	}
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce)), nil
+}
+
+// Exchange trades the callback code for tokens and returns the identity from
+// the verified ID token. Claims missing from the ID token are filled in from
+// the userinfo endpoint.
+func (p *Provider) Exchange(ctx context.Context, code, nonce string) (*Identity, error) {
+	if err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+
+	token, err := p.oauth2.Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("id token missing in response")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+
+	var claims identityClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	if claims.Email == "" && p.oidc.UserInfoEndpoint() != "" {
+		userInfo, err := p.oidc.UserInfo(ctx, p.oauth2.TokenSource(ctx, token))
+		if err != nil {
+			return nil, err
+		}
+		if err := userInfo.Claims(&claims); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Identity{
+		Provider:      p.Name,
+		ProviderName:  p.DisplayName,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+		Picture:       claims.Picture,
+	}, nil
+}
+
+type identityClaims struct {
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	Name          string       `json:"name"`
+	Picture       string       `json:"picture"`
+}
+
+// flexibleBool accepts both JSON booleans and the "true"/"false" strings some
+// providers (Apple among them) send for email_verified.
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*b = flexibleBool(v)
+	return nil
+}
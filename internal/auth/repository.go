@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmj/internal/models"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"time"
 )
 
@@ -12,8 +14,33 @@ type Repository interface {
 	CreateUser(ctx context.Context, user *models.User) error
 	FindUserByEmail(email string) (*models.User, error)
 	UpdateUser(ctx context.Context, user *models.User) error
+	SetNotificationPrefs(ctx context.Context, userID primitive.ObjectID, prefs models.NotificationPrefs) error
+	SetLocale(ctx context.Context, userID primitive.ObjectID, locale string) error
+	SetAvatarIfEmpty(ctx context.Context, userID primitive.ObjectID, avatar string) error
 	VerifyUser(ctx context.Context, code string) error
-	FindUserByGoogleID(ctx context.Context, googleID string) (*models.User, error)
+	FindUserByIdentity(ctx context.Context, provider, subject string) (*models.User, error)
+	LinkIdentity(ctx context.Context, userID primitive.ObjectID, identity models.LinkedIdentity) error
+	UnlinkIdentity(ctx context.Context, userID primitive.ObjectID, provider string) error
+	CreateLinkRequest(ctx context.Context, request *models.LinkRequest) error
+	ConsumeLinkRequest(ctx context.Context, tokenHash string) (*models.LinkRequest, error)
+	FindUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error)
+	CreatePasswordReset(ctx context.Context, reset *models.PasswordReset) error
+	ConsumePasswordReset(ctx context.Context, tokenHash string) (*models.PasswordReset, error)
+	DeletePasswordResets(ctx context.Context, userID primitive.ObjectID) error
+	CreateMagicLink(ctx context.Context, link *models.MagicLink) error
+	ConsumeMagicLink(ctx context.Context, tokenHash string) (*models.MagicLink, error)
+	FindLoginAttempt(ctx context.Context, key string) (*models.LoginAttempt, error)
+	RecordLoginFailure(ctx context.Context, key string, window time.Duration) (*models.LoginAttempt, error)
+	LockLogin(ctx context.Context, key string, until time.Time) error
+	ResetLoginAttempts(ctx context.Context, key string) error
+	EnableTOTP(ctx context.Context, userID primitive.ObjectID, secret string, recoveryCodes []string) error
+	DisableTOTP(ctx context.Context, userID primitive.ObjectID) error
+	UseRecoveryCode(ctx context.Context, userID primitive.ObjectID, codeHash string) error
+	EnsureIndexes(ctx context.Context) error
+	MigrateLegacyIdentities(ctx context.Context) error
+	MigrateDefaultRoles(ctx context.Context) error
+	AddRole(ctx context.Context, userID primitive.ObjectID, role models.Role) error
+	CountUsersWithRole(ctx context.Context, role models.Role) (int64, error)
 }
 
 type repository struct {
@@ -21,15 +48,76 @@ type repository struct {
 	ctx context.Context
 }
 
-func (r repository) FindUserByGoogleID(ctx context.Context, googleID string) (*models.User, error) {
+func (r repository) FindUserByIdentity(ctx context.Context, provider, subject string) (*models.User, error) {
 	var user models.User
-	err := r.db.Collection("users").FindOne(ctx, bson.M{"google_id": googleID}).Decode(&user)
+	err := r.db.Collection("users").FindOne(ctx, bson.M{
+		"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}},
+	}).Decode(&user)
 	if err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
+// LinkIdentity adds identity to the user unless they already have one for
+// that provider.
+func (r repository) LinkIdentity(ctx context.Context, userID primitive.ObjectID, identity models.LinkedIdentity) error {
+	identity.LinkedAt = time.Now()
+	res, err := r.db.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": userID, "identities.provider": bson.M{"$ne": identity.Provider}},
+		bson.M{
+			"$push": bson.M{"identities": identity},
+			"$set":  bson.M{"updated_at": time.Now()},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (r repository) UnlinkIdentity(ctx context.Context, userID primitive.ObjectID, provider string) error {
+	_, err := r.db.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": userID},
+		bson.M{
+			"$pull": bson.M{"identities": bson.M{"provider": provider}},
+			"$set":  bson.M{"updated_at": time.Now()},
+		},
+	)
+	return err
+}
+
+// CreateLinkRequest stores a pending link confirmation, replacing any earlier
+// one for the same user and provider.
+func (r repository) CreateLinkRequest(ctx context.Context, request *models.LinkRequest) error {
+	_, err := r.db.Collection("link_requests").DeleteMany(ctx, bson.M{
+		"user_id":           request.UserID,
+		"identity.provider": request.Identity.Provider,
+	})
+	if err != nil {
+		return err
+	}
+	request.CreatedAt = time.Now()
+	_, err = r.db.Collection("link_requests").InsertOne(ctx, request)
+	return err
+}
+
+// ConsumeLinkRequest removes and returns the request matching tokenHash so
+// a confirmation link only works once.
+func (r repository) ConsumeLinkRequest(ctx context.Context, tokenHash string) (*models.LinkRequest, error) {
+	var request models.LinkRequest
+	err := r.db.Collection("link_requests").FindOneAndDelete(ctx, bson.M{"token_hash": tokenHash}).Decode(&request)
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
 func (r repository) CreateUser(ctx context.Context, user *models.User) error {
 	user.CreatedAt = time.Now()
 	user.UpdatedAt = time.Now()
@@ -56,11 +144,268 @@ func (r repository) UpdateUser(ctx context.Context, user *models.User) error {
 	return err
 }
 
+func (r repository) SetNotificationPrefs(ctx context.Context, userID primitive.ObjectID, prefs models.NotificationPrefs) error {
+	_, err := r.db.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"notifications": prefs, "updated_at": time.Now()}},
+	)
+	return err
+}
+
+// SetLocale saves the language the user picked for the site and emails.
+func (r repository) SetLocale(ctx context.Context, userID primitive.ObjectID, locale string) error {
+	_, err := r.db.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"locale": locale, "updated_at": time.Now()}},
+	)
+	return err
+}
+
+// SetAvatarIfEmpty gives the user avatar unless they already have one. It
+// only touches the avatar, so it is safe right after other targeted updates.
+func (r repository) SetAvatarIfEmpty(ctx context.Context, userID primitive.ObjectID, avatar string) error {
+	_, err := r.db.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": userID, "avatar": bson.M{"$in": bson.A{nil, ""}}},
+		bson.M{"$set": bson.M{"avatar": avatar, "updated_at": time.Now()}},
+	)
+	return err
+}
+
+// VerifyUser marks the owner of code as verified. Stale codes are treated
+// the same as unknown ones and return mongo.ErrNoDocuments.
 func (r repository) VerifyUser(ctx context.Context, code string) error {
+	if code == "" {
+		return mongo.ErrNoDocuments
+	}
+	res, err := r.db.Collection("users").UpdateOne(
+		ctx,
+		bson.M{
+			"verification_code":       code,
+			"verification_expires_at": bson.M{"$gt": time.Now()},
+		},
+		bson.M{
+			"$set":   bson.M{"verified": true, "updated_at": time.Now()},
+			"$unset": bson.M{"verification_code": "", "verification_expires_at": ""},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (r repository) FindUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error) {
+	var user models.User
+	err := r.db.Collection("users").FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreatePasswordReset stores a new reset token for the user, replacing any
+// token issued by an earlier request.
+func (r repository) CreatePasswordReset(ctx context.Context, reset *models.PasswordReset) error {
+	if err := r.DeletePasswordResets(ctx, reset.UserID); err != nil {
+		return err
+	}
+	reset.CreatedAt = time.Now()
+	_, err := r.db.Collection("password_resets").InsertOne(ctx, reset)
+	return err
+}
+
+// ConsumePasswordReset removes and returns the reset matching tokenHash so
+// that a token can only ever be used once.
+func (r repository) ConsumePasswordReset(ctx context.Context, tokenHash string) (*models.PasswordReset, error) {
+	var reset models.PasswordReset
+	err := r.db.Collection("password_resets").FindOneAndDelete(ctx, bson.M{"token_hash": tokenHash}).Decode(&reset)
+	if err != nil {
+		return nil, err
+	}
+	return &reset, nil
+}
+
+func (r repository) DeletePasswordResets(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := r.db.Collection("password_resets").DeleteMany(ctx, bson.M{"user_id": userID})
+	return err
+}
+
+// CreateMagicLink stores a new sign-in token for the user, replacing any
+// unused link sent earlier.
+func (r repository) CreateMagicLink(ctx context.Context, link *models.MagicLink) error {
+	if _, err := r.db.Collection("magic_links").DeleteMany(ctx, bson.M{"user_id": link.UserID}); err != nil {
+		return err
+	}
+	link.CreatedAt = time.Now()
+	_, err := r.db.Collection("magic_links").InsertOne(ctx, link)
+	return err
+}
+
+// ConsumeMagicLink removes and returns the link matching tokenHash, so a
+// replayed link finds nothing.
+func (r repository) ConsumeMagicLink(ctx context.Context, tokenHash string) (*models.MagicLink, error) {
+	var link models.MagicLink
+	err := r.db.Collection("magic_links").FindOneAndDelete(ctx, bson.M{"token_hash": tokenHash}).Decode(&link)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (r repository) FindLoginAttempt(ctx context.Context, key string) (*models.LoginAttempt, error) {
+	var attempt models.LoginAttempt
+	err := r.db.Collection("login_attempts").FindOne(ctx, bson.M{"_id": key}).Decode(&attempt)
+	if err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+// RecordLoginFailure increments the failure counter for key and returns the
+// updated record. The record is forgotten once window passes without another
+// failure.
+func (r repository) RecordLoginFailure(ctx context.Context, key string, window time.Duration) (*models.LoginAttempt, error) {
+	var attempt models.LoginAttempt
+	now := time.Now()
+	err := r.db.Collection("login_attempts").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": key},
+		bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"last_failure_at": now, "expires_at": now.Add(window)},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&attempt)
+	if err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+func (r repository) LockLogin(ctx context.Context, key string, until time.Time) error {
+	_, err := r.db.Collection("login_attempts").UpdateOne(
+		ctx,
+		bson.M{"_id": key},
+		bson.M{"$set": bson.M{"locked_until": until}},
+	)
+	return err
+}
+
+func (r repository) ResetLoginAttempts(ctx context.Context, key string) error {
+	_, err := r.db.Collection("login_attempts").DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+func (r repository) EnableTOTP(ctx context.Context, userID primitive.ObjectID, secret string, recoveryCodes []string) error {
+	_, err := r.db.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{
+			"totp_secret":    secret,
+			"totp_enabled":   true,
+			"recovery_codes": recoveryCodes,
+			"updated_at":     time.Now(),
+		}},
+	)
+	return err
+}
+
+func (r repository) DisableTOTP(ctx context.Context, userID primitive.ObjectID) error {
 	_, err := r.db.Collection("users").UpdateOne(
 		ctx,
-		bson.M{"verification_code": code},
-		bson.M{"$set": bson.M{"verified": true, "verification_code": ""}},
+		bson.M{"_id": userID},
+		bson.M{
+			"$set":   bson.M{"totp_enabled": false, "updated_at": time.Now()},
+			"$unset": bson.M{"totp_secret": "", "recovery_codes": ""},
+		},
+	)
+	return err
+}
+
+// UseRecoveryCode removes codeHash from the user's recovery codes, returning
+// mongo.ErrNoDocuments if it isn't one of them.
+func (r repository) UseRecoveryCode(ctx context.Context, userID primitive.ObjectID, codeHash string) error {
+	res, err := r.db.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": userID, "recovery_codes": codeHash},
+		bson.M{"$pull": bson.M{"recovery_codes": codeHash}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// EnsureIndexes creates the indexes the auth collections rely on, including
+// TTL indexes that clear out expired tokens and stale login attempts.
+func (r repository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.db.Collection("password_resets").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Collection("magic_links").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Collection("link_requests").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Collection("login_attempts").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// MigrateLegacyIdentities moves the google_id/provider fields used before
+// identities were generalised into the identities list.
+func (r repository) MigrateLegacyIdentities(ctx context.Context) error {
+	_, err := r.db.Collection("users").UpdateMany(
+		ctx,
+		bson.M{"google_id": bson.M{"$exists": true, "$ne": ""}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"identities": bson.M{"$concatArrays": bson.A{
+					bson.M{"$ifNull": bson.A{"$identities", bson.A{}}},
+					bson.A{bson.M{
+						"provider":  "google",
+						"subject":   "$google_id",
+						"email":     "$email",
+						"linked_at": "$updated_at",
+					}},
+				}},
+			}}},
+			{{Key: "$unset", Value: bson.A{"google_id", "provider"}}},
+		},
 	)
 	return err
 }
@@ -68,3 +413,36 @@ func (r repository) VerifyUser(ctx context.Context, code string) error {
 func NewRepository(db *mongo.Database, ctx context.Context) Repository {
 	return &repository{db, ctx}
 }
+
+// MigrateDefaultRoles gives accounts created before roles existed the
+// supporter role.
+func (r repository) MigrateDefaultRoles(ctx context.Context) error {
+	_, err := r.db.Collection("users").UpdateMany(
+		ctx,
+		bson.M{"roles": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"roles": bson.A{models.RoleSupporter}}},
+	)
+	return err
+}
+
+func (r repository) AddRole(ctx context.Context, userID primitive.ObjectID, role models.Role) error {
+	res, err := r.db.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": userID},
+		bson.M{
+			"$addToSet": bson.M{"roles": role},
+			"$set":      bson.M{"updated_at": time.Now()},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (r repository) CountUsersWithRole(ctx context.Context, role models.Role) (int64, error) {
+	return r.db.Collection("users").CountDocuments(ctx, bson.M{"roles": role})
+}
@@ -3,21 +3,116 @@ package auth
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
 	"encoding/hex"
 	"errors"
 	"fmj/internal/email"
+	"fmj/internal/i18n"
 	"fmj/internal/models"
-	"fmt"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
-	"google.golang.org/api/oauth2/v2"
-	"log"
+	"log/slog"
+	"strings"
+	"time"
 )
 
+// passwordResetTTL is how long an emailed password reset link stays valid.
+const passwordResetTTL = time.Hour
+
+// magicLinkTTL is how long an emailed sign-in link stays valid.
+const magicLinkTTL = 15 * time.Minute
+
+// linkRequestTTL is how long an emailed account link confirmation stays
+// valid.
+const linkRequestTTL = 30 * time.Minute
+
+// verificationCodeTTL is how long an emailed verification link stays valid.
+const verificationCodeTTL = 24 * time.Hour
+
+// verificationResendCooldown is the minimum time between two verification
+// emails sent to the same account.
+const verificationResendCooldown = 2 * time.Minute
+
+// ErrEmailNotVerified is returned by Login for accounts that haven't
+// confirmed their email address yet.
+var ErrEmailNotVerified = i18n.NewError("auth.error.email_not_verified")
+
+// ErrTooManyAttempts is returned by Login while an account or client address
+// is locked out. Its message is deliberately generic.
+var ErrTooManyAttempts = i18n.NewError("auth.error.too_many_attempts")
+
+// ErrLinkRequired is returned by HandleOIDCLogin when the provider's email
+// address belongs to an account the identity isn't linked to yet.
+var ErrLinkRequired = i18n.NewError("auth.error.link_required")
+
+// ErrUnverifiedProviderEmail is returned by HandleOIDCLogin when the provider
+// doesn't vouch for the email address it sent.
+var ErrUnverifiedProviderEmail = i18n.NewError("auth.error.unverified_provider_email")
+
+// ErrIdentityInUse is returned when linking an identity that already signs
+// in to a different account.
+var ErrIdentityInUse = i18n.NewError("auth.error.identity_in_use")
+
+const (
+	// accountLockThreshold and ipLockThreshold are the failures allowed
+	// before the account or client address is locked out.
+	accountLockThreshold = 5
+	ipLockThreshold      = 20
+
+	// resendIPThreshold is how many verification emails one client address
+	// may ask for before it is locked out the same way.
+	resendIPThreshold = 10
+
+	// Each failure past the threshold doubles the lockout, starting at
+	// baseLockout and capped at maxLockout.
+	baseLockout = time.Minute
+	maxLockout  = time.Hour
+
+	// loginAttemptWindow is how long failures are remembered.
+	loginAttemptWindow = 24 * time.Hour
+)
+
+// ErrInvalidTwoFactorCode is returned when neither an authenticator code nor
+// an unused recovery code matches.
+var ErrInvalidTwoFactorCode = i18n.NewError("auth.error.invalid_code")
+
+const (
+	// totpIssuer is the label authenticator apps show next to the account.
+	totpIssuer = "FundMyJollof"
+
+	// recoveryCodeCount is how many one-time recovery codes a user gets
+	// when enabling two-factor authentication.
+	recoveryCodeCount = 10
+)
+
+// minPasswordLength matches the "8+ characters required" hint on the forms.
+const minPasswordLength = 8
+
 type Service interface {
-	Register(ctx context.Context, fullName, email, password string) error
-	Login(email, password string) (*models.User, error)
+	Register(ctx context.Context, fullName, email, password, locale string) error
+	Login(ctx context.Context, email, password, ip string) (*models.User, error)
 	VerifyEmail(ctx context.Context, code string) error
-	HandleGoogleLogin(ctx context.Context, googleUser *oauth2.Userinfo) (*models.User, error)
+	HandleOIDCLogin(ctx context.Context, identity *Identity, locale string) (*models.User, error)
+	LinkWithPassword(ctx context.Context, identity *Identity, password, ip string) (*models.User, error)
+	RequestLinkConfirmation(ctx context.Context, identity *Identity) error
+	ConfirmLink(ctx context.Context, token string) (*models.User, error)
+	LinkIdentity(ctx context.Context, userID string, identity *Identity) error
+	UnlinkIdentity(ctx context.Context, userID, provider string) error
+	RequestPasswordReset(ctx context.Context, email string) error
+	ResetPassword(ctx context.Context, token, password string) error
+	ResendVerification(ctx context.Context, email, ip string) error
+	RequestMagicLink(ctx context.Context, email string) error
+	ConsumeMagicLink(ctx context.Context, token string) (*models.User, error)
+	GetUser(ctx context.Context, userID string) (*models.User, error)
+	SetLocale(ctx context.Context, userID, locale string) error
+	GenerateTOTPKey(ctx context.Context, userID string) (*otp.Key, error)
+	EnableTOTP(ctx context.Context, userID, secret, code string) ([]string, error)
+	DisableTOTP(ctx context.Context, userID, code string) error
+	VerifyTwoFactor(ctx context.Context, userID, code, ip string) (*models.User, error)
 }
 
 type service struct {
@@ -25,64 +120,198 @@ type service struct {
 	email email.Service
 }
 
-type GoogleUser struct {
-	ID       string
-	Email    string
-	Name     string
-	Picture  string
-	Verified bool
-}
-
-func (s *service) HandleGoogleLogin(ctx context.Context, googleUser *oauth2.Userinfo) (*models.User, error) {
-	// Check if user exists by Google ID
-	existingUser, err := s.repo.FindUserByGoogleID(ctx, googleUser.Id)
+// HandleOIDCLogin returns the user for an identity asserted by an OIDC
+// provider, creating an account if the email address is new. When an
+// account already uses the address it returns ErrLinkRequired instead of
+// linking, so the owner has to prove control of that account first. New
+// accounts get locale, the language they were browsing in.
+func (s *service) HandleOIDCLogin(ctx context.Context, identity *Identity, locale string) (*models.User, error) {
+	// Check if user exists by provider identity
+	existingUser, err := s.repo.FindUserByIdentity(ctx, identity.Provider, identity.Subject)
 	if err == nil {
 		return existingUser, nil
 	}
 
-	// Check if user exists by email
-	existingUser, err = s.repo.FindUserByEmail(googleUser.Email)
-	if err == nil {
-		// Link Google account to existing user
-		existingUser.GoogleID = googleUser.Id
-		existingUser.Avatar = googleUser.Picture
-		existingUser.Provider = "google"
-		if err := s.repo.UpdateUser(ctx, existingUser); err != nil {
-			return nil, err
-		}
-		return existingUser, nil
+	// Without a verified address we can't tie the identity to any account.
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, ErrUnverifiedProviderEmail
+	}
+
+	if _, err := s.repo.FindUserByEmail(identity.Email); err == nil {
+		return nil, ErrLinkRequired
 	}
 
 	// Create new user
 	user := &models.User{
-		FullName: googleUser.Name,
-		Email:    googleUser.Email,
-		GoogleID: googleUser.Id,
-		Avatar:   googleUser.Picture,
-		Provider: "google",
-		Verified: true, // Google accounts are pre-verified
+		FullName:   identity.Name,
+		Email:      identity.Email,
+		Avatar:     identity.Picture,
+		Identities: []models.LinkedIdentity{linkedIdentity(identity)},
+		Verified:   true,
+		Roles:      []models.Role{models.RoleSupporter},
+		Locale:     locale,
 	}
+	user.Identities[0].LinkedAt = time.Now()
 
 	if err := s.repo.CreateUser(ctx, user); err != nil {
 		return nil, err
 	}
 
-	// Send welcome email
-	go func() {
-		err := s.email.SendWelcomeEmail(user.Email, user.FullName)
-		if err != nil {
-			log.Fatal("email send welcome email error:", err)
-		}
-	}()
+	// Send welcome email. It only goes in the outbox, and the account
+	// exists either way.
+	if err := s.email.SendWelcomeEmail(user.Email, user.FullName); err != nil {
+		slog.Error("Error queueing welcome email", slog.String("email", user.Email), slog.String("error", err.Error()))
+	}
+
+	return user, nil
+}
 
+// LinkWithPassword links identity to the account sharing its email address
+// once the account's password checks out. Failures count towards the usual
+// login lockout.
+func (s *service) LinkWithPassword(ctx context.Context, identity *Identity, password, ip string) (*models.User, error) {
+	user, err := s.Login(ctx, identity.Email, password, ip)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.linkIdentity(ctx, user, identity); err != nil {
+		return nil, err
+	}
 	return user, nil
 }
 
-func (s *service) Register(ctx context.Context, fullName, email, password string) error {
+// RequestLinkConfirmation emails the owner of the account sharing identity's
+// email address a one-time link that confirms the link.
+func (s *service) RequestLinkConfirmation(ctx context.Context, identity *Identity) error {
+	user, err := s.repo.FindUserByEmail(identity.Email)
+	if err != nil {
+		return nil
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	request := &models.LinkRequest{
+		UserID:    user.ID,
+		Identity:  linkedIdentity(identity),
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(linkRequestTTL),
+	}
+	if err := s.repo.CreateLinkRequest(ctx, request); err != nil {
+		return err
+	}
+
+	return s.email.SendLinkConfirmationEmail(user.Email, user.FullName, identity.ProviderName, token)
+}
+
+func (s *service) ConfirmLink(ctx context.Context, token string) (*models.User, error) {
+	request, err := s.repo.ConsumeLinkRequest(ctx, hashToken(token))
+	if err != nil {
+		return nil, i18n.NewError("auth.error.invalid_link_confirmation")
+	}
+	if time.Now().After(request.ExpiresAt) {
+		return nil, i18n.NewError("auth.error.invalid_link_confirmation")
+	}
+
+	user, err := s.repo.FindUserByID(ctx, request.UserID)
+	if err != nil {
+		return nil, i18n.NewError("auth.error.invalid_link_confirmation")
+	}
+
+	identity := &Identity{
+		Provider: request.Identity.Provider,
+		Subject:  request.Identity.Subject,
+		Email:    request.Identity.Email,
+	}
+	if err := s.linkIdentity(ctx, user, identity); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// LinkIdentity links identity to a signed-in user from the dashboard. The
+// provider's email address doesn't have to match the account's.
+func (s *service) LinkIdentity(ctx context.Context, userID string, identity *Identity) error {
+	user, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return s.linkIdentity(ctx, user, identity)
+}
+
+// UnlinkIdentity removes a provider from the user's account, as long as they
+// keep another way to sign in.
+func (s *service) UnlinkIdentity(ctx context.Context, userID, provider string) error {
+	user, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Identity(provider) == nil {
+		return i18n.NewError("auth.error.not_linked")
+	}
+	if user.Password == "" && len(user.Identities) == 1 {
+		return i18n.NewError("auth.error.last_sign_in_method")
+	}
+	return s.repo.UnlinkIdentity(ctx, user.ID, provider)
+}
+
+// SetLocale saves the language the user picked. locale must be one of
+// i18n.Languages.
+func (s *service) SetLocale(ctx context.Context, userID, locale string) error {
+	if !i18n.Supported(locale) {
+		return i18n.NewError("auth.error.unsupported_language")
+	}
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return err
+	}
+	return s.repo.SetLocale(ctx, id, locale)
+}
+
+// linkIdentity attaches identity to user unless it already belongs to
+// another account or the user has a different account from the same provider.
+func (s *service) linkIdentity(ctx context.Context, user *models.User, identity *Identity) error {
+	owner, err := s.repo.FindUserByIdentity(ctx, identity.Provider, identity.Subject)
+	if err == nil {
+		if owner.ID == user.ID {
+			return nil
+		}
+		return ErrIdentityInUse
+	}
+
+	if err := s.repo.LinkIdentity(ctx, user.ID, linkedIdentity(identity)); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return i18n.NewError("auth.error.provider_already_linked")
+		}
+		return err
+	}
+
+	if user.Avatar == "" && identity.Picture != "" {
+		if err := s.repo.SetAvatarIfEmpty(ctx, user.ID, identity.Picture); err != nil {
+			return err
+		}
+		user.Avatar = identity.Picture
+	}
+	return nil
+}
+
+// linkedIdentity converts a provider assertion into what gets stored on the
+// user.
+func linkedIdentity(identity *Identity) models.LinkedIdentity {
+	return models.LinkedIdentity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	}
+}
+
+func (s *service) Register(ctx context.Context, fullName, email, password, locale string) error {
 	// Check if user exists
 	existing, _ := s.repo.FindUserByEmail(email)
 	if existing != nil {
-		return errors.New("email already registered")
+		return i18n.NewError("auth.error.email_registered")
 	}
 
 	// Hash password
@@ -92,55 +321,409 @@ func (s *service) Register(ctx context.Context, fullName, email, password string
 	}
 
 	// Generate verification code
-	verificationCode := make([]byte, 32)
-	if _, err := rand.Read(verificationCode); err != nil {
+	code, err := generateToken()
+	if err != nil {
 		return err
 	}
-	code := hex.EncodeToString(verificationCode)
 
 	// Create user
 	user := &models.User{
-		FullName:         fullName,
-		Email:            email,
-		Password:         string(hashedPassword),
-		Verified:         false,
-		VerificationCode: code,
+		FullName:              fullName,
+		Email:                 email,
+		Password:              string(hashedPassword),
+		Verified:              false,
+		VerificationCode:      code,
+		VerificationExpiresAt: time.Now().Add(verificationCodeTTL),
+		VerificationSentAt:    time.Now(),
+		Roles:                 []models.Role{models.RoleSupporter},
+		Locale:                locale,
 	}
 
-	fmt.Printf("creating new user: %s\n", user.FullName)
+	slog.Debug("Creating new user", slog.String("email", user.Email))
 	if err := s.repo.CreateUser(ctx, user); err != nil {
 		return err
 	}
 
-	// Send verification email
-	fmt.Printf("sending verification email: %s\n", user.Email)
-	return s.email.SendVerificationEmail(email, fullName, code)
+	// Send verification email. The user is already created, so don't fail
+	// the sign-up over it; they can ask for the email again.
+	slog.Debug("Sending verification email", slog.String("email", user.Email))
+	if err := s.email.SendVerificationEmail(email, fullName, code); err != nil {
+		slog.Error("Error queueing verification email", slog.String("email", email), slog.String("error", err.Error()))
+	}
+	return nil
 }
 
-func (s *service) Login(email, password string) (*models.User, error) {
+func (s *service) Login(ctx context.Context, email, password, ip string) (*models.User, error) {
+	accountKey := "email:" + email
+	ipKey := "ip:" + ip
+
+	if s.isLocked(ctx, accountKey) || s.isLocked(ctx, ipKey) {
+		return nil, ErrTooManyAttempts
+	}
+
 	user, err := s.repo.FindUserByEmail(email)
 	if err != nil {
-		return nil, errors.New("invalid credentials")
+		s.recordLoginFailure(ctx, accountKey, accountLockThreshold, nil)
+		s.recordLoginFailure(ctx, ipKey, ipLockThreshold, nil)
+		return nil, i18n.NewError("auth.error.invalid_credentials")
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		s.recordLoginFailure(ctx, accountKey, accountLockThreshold, user)
+		s.recordLoginFailure(ctx, ipKey, ipLockThreshold, nil)
+		return nil, i18n.NewError("auth.error.invalid_credentials")
 	}
 
 	if !user.Verified {
-		return nil, errors.New("email not verified")
+		return nil, ErrEmailNotVerified
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		return nil, errors.New("invalid credentials")
+	if err := s.repo.ResetLoginAttempts(ctx, accountKey); err != nil {
+		slog.Error("Error resetting login attempts", slog.String("key", accountKey), slog.String("error", err.Error()))
 	}
 
 	return user, nil
 }
 
+// isLocked reports whether key is currently locked out.
+func (s *service) isLocked(ctx context.Context, key string) bool {
+	attempt, err := s.repo.FindLoginAttempt(ctx, key)
+	if err != nil {
+		return false
+	}
+	return attempt.LockedUntil.After(time.Now())
+}
+
+// recordLoginFailure counts a failed attempt against key and locks it out
+// once threshold is reached. When owner is set, they are emailed the first
+// time their account gets locked.
+func (s *service) recordLoginFailure(ctx context.Context, key string, threshold int, owner *models.User) {
+	attempt, err := s.repo.RecordLoginFailure(ctx, key, loginAttemptWindow)
+	if err != nil {
+		slog.Error("Error recording login failure", slog.String("key", key), slog.String("error", err.Error()))
+		return
+	}
+
+	lockout := lockoutDuration(attempt.Failures, threshold)
+	if lockout == 0 {
+		return
+	}
+	if err := s.repo.LockLogin(ctx, key, time.Now().Add(lockout)); err != nil {
+		slog.Error("Error locking login", slog.String("key", key), slog.String("error", err.Error()))
+		return
+	}
+
+	if owner != nil && attempt.Failures == threshold {
+		if err := s.email.SendAccountLockedEmail(owner.Email, owner.FullName); err != nil {
+			slog.Error("Error sending account locked email", slog.String("email", owner.Email), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// lockoutDuration returns how long to lock a key that has failed the given
+// number of times, or zero while it is still under threshold.
+func lockoutDuration(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	// Anything past ten doublings is well over the cap anyway.
+	if failures-threshold > 10 {
+		return maxLockout
+	}
+	lockout := baseLockout << (failures - threshold)
+	if lockout > maxLockout {
+		return maxLockout
+	}
+	return lockout
+}
+
 func (s *service) VerifyEmail(ctx context.Context, code string) error {
 	if err := s.repo.VerifyUser(ctx, code); err != nil {
-		return errors.New("invalid verification code")
+		return i18n.NewError("auth.error.invalid_verification")
 	}
 	return nil
 }
 
+// ResendVerification rotates the verification code for an unverified account
+// and emails it again. Unknown, already verified and recently emailed
+// addresses are ignored alike so the endpoint doesn't reveal which emails
+// are registered, and each client address may only ask so often.
+func (s *service) ResendVerification(ctx context.Context, email, ip string) error {
+	// Every request counts against the client address, so the form can't be
+	// used to flood inboxes or probe for addresses.
+	ipKey := "resend:" + ip
+	if s.isLocked(ctx, ipKey) {
+		return ErrTooManyAttempts
+	}
+	s.recordLoginFailure(ctx, ipKey, resendIPThreshold, nil)
+
+	user, err := s.repo.FindUserByEmail(email)
+	if err != nil || user.Verified || time.Since(user.VerificationSentAt) < verificationResendCooldown {
+		return nil
+	}
+
+	code, err := generateToken()
+	if err != nil {
+		return err
+	}
+	user.VerificationCode = code
+	user.VerificationExpiresAt = time.Now().Add(verificationCodeTTL)
+	user.VerificationSentAt = time.Now()
+	if err := s.repo.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+
+	return s.email.SendVerificationEmail(user.Email, user.FullName, code)
+}
+
+// RequestPasswordReset emails a reset link to the owner of email. It succeeds
+// silently when no such account exists so the form can't be used to probe
+// for registered addresses.
+func (s *service) RequestPasswordReset(ctx context.Context, email string) error {
+	user, err := s.repo.FindUserByEmail(email)
+	if err != nil {
+		return nil
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	reset := &models.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	}
+	if err := s.repo.CreatePasswordReset(ctx, reset); err != nil {
+		return err
+	}
+
+	return s.email.SendPasswordResetEmail(user.Email, user.FullName, token)
+}
+
+func (s *service) ResetPassword(ctx context.Context, token, password string) error {
+	if len(password) < minPasswordLength {
+		return i18n.NewError("auth.error.password_too_short", "count", minPasswordLength)
+	}
+
+	reset, err := s.repo.ConsumePasswordReset(ctx, hashToken(token))
+	if err != nil {
+		return i18n.NewError("auth.error.invalid_reset")
+	}
+	if time.Now().After(reset.ExpiresAt) {
+		return i18n.NewError("auth.error.invalid_reset")
+	}
+
+	user, err := s.repo.FindUserByID(ctx, reset.UserID)
+	if err != nil {
+		return i18n.NewError("auth.error.invalid_reset")
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.Password = string(hashedPassword)
+
+	// The user proved they own the address by following the link.
+	user.Verified = true
+	if err := s.repo.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+
+	return s.repo.DeletePasswordResets(ctx, user.ID)
+}
+
+// RequestMagicLink emails a one-time sign-in link to the owner of email,
+// whichever provider they signed up with. Unknown addresses are ignored.
+func (s *service) RequestMagicLink(ctx context.Context, email string) error {
+	user, err := s.repo.FindUserByEmail(email)
+	if err != nil {
+		return nil
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	link := &models.MagicLink{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(magicLinkTTL),
+	}
+	if err := s.repo.CreateMagicLink(ctx, link); err != nil {
+		return err
+	}
+
+	return s.email.SendMagicLinkEmail(user.Email, user.FullName, token)
+}
+
+func (s *service) ConsumeMagicLink(ctx context.Context, token string) (*models.User, error) {
+	link, err := s.repo.ConsumeMagicLink(ctx, hashToken(token))
+	if err != nil {
+		return nil, i18n.NewError("auth.error.invalid_magic")
+	}
+	if time.Now().After(link.ExpiresAt) {
+		return nil, i18n.NewError("auth.error.invalid_magic")
+	}
+
+	user, err := s.repo.FindUserByID(ctx, link.UserID)
+	if err != nil {
+		return nil, i18n.NewError("auth.error.invalid_magic")
+	}
+
+	// Following the link proves the user owns the address.
+	if !user.Verified {
+		user.Verified = true
+		if err := s.repo.UpdateUser(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+func (s *service) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.FindUserByID(ctx, id)
+}
+
+// GenerateTOTPKey creates a new authenticator secret for the user. Nothing
+// is stored until EnableTOTP confirms the user can produce codes from it.
+func (s *service) GenerateTOTPKey(ctx context.Context, userID string) (*otp.Key, error) {
+	user, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Password == "" {
+		return nil, i18n.NewError("auth.error.two_factor_password_only")
+	}
+	if user.TOTPEnabled {
+		return nil, i18n.NewError("auth.error.two_factor_enabled")
+	}
+
+	return totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: user.Email,
+	})
+}
+
+// EnableTOTP turns on two-factor authentication once code checks out against
+// secret, and returns the plaintext recovery codes to show the user once.
+func (s *service) EnableTOTP(ctx context.Context, userID, secret, code string) ([]string, error) {
+	user, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" || !totp.Validate(strings.TrimSpace(code), secret) {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		hashes[i] = hashToken(normalizeRecoveryCode(code))
+	}
+
+	if err := s.repo.EnableTOTP(ctx, user.ID, secret, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (s *service) DisableTOTP(ctx context.Context, userID, code string) error {
+	user, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return i18n.NewError("auth.error.two_factor_disabled")
+	}
+	if !s.checkSecondFactor(ctx, user, code) {
+		return ErrInvalidTwoFactorCode
+	}
+	return s.repo.DisableTOTP(ctx, user.ID)
+}
+
+// VerifyTwoFactor completes a login that passed the password check. Failed
+// codes count towards the same lockout as failed passwords.
+func (s *service) VerifyTwoFactor(ctx context.Context, userID, code, ip string) (*models.User, error) {
+	user, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	accountKey := "email:" + user.Email
+	ipKey := "ip:" + ip
+	if s.isLocked(ctx, accountKey) || s.isLocked(ctx, ipKey) {
+		return nil, ErrTooManyAttempts
+	}
+
+	if !s.checkSecondFactor(ctx, user, code) {
+		s.recordLoginFailure(ctx, accountKey, accountLockThreshold, user)
+		s.recordLoginFailure(ctx, ipKey, ipLockThreshold, nil)
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	if err := s.repo.ResetLoginAttempts(ctx, accountKey); err != nil {
+		slog.Error("Error resetting login attempts", slog.String("key", accountKey), slog.String("error", err.Error()))
+	}
+	return user, nil
+}
+
+// checkSecondFactor accepts either a current authenticator code or one of the
+// user's unused recovery codes, which is burned on use.
+func (s *service) checkSecondFactor(ctx context.Context, user *models.User, code string) bool {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false
+	}
+	if totp.Validate(code, user.TOTPSecret) {
+		return true
+	}
+	return s.repo.UseRecoveryCode(ctx, user.ID, hashToken(normalizeRecoveryCode(code))) == nil
+}
+
+// generateRecoveryCode returns a random code formatted as "xxxx-xxxx".
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return code[:4] + "-" + code[4:], nil
+}
+
+// normalizeRecoveryCode lets users type recovery codes without the dash or in
+// upper case.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// generateToken returns a random hex token suitable for emailed links.
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the value stored in the database for an emailed token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func NewService(repo Repository, emailSvc email.Service) Service {
 	return &service{
 		repo:  repo,
@@ -0,0 +1,363 @@
+package campaigns
+
+import (
+	"errors"
+	"fmj/internal/creators"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmj/internal/payments"
+	"fmj/internal/utils"
+	"github.com/angelofallars/htmx-go"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type Handler struct {
+	service  Service
+	creators creators.Service
+}
+
+func NewHandler(service Service, creatorService creators.Service) *Handler {
+	return &Handler{service: service, creators: creatorService}
+}
+
+// RegisterRoutes registers the public campaign pages.
+func (h *Handler) RegisterRoutes(r *gin.Engine) {
+	r.GET("/:slug/campaigns/:id", h.ShowCampaign)
+	r.GET("/:slug/campaigns/:id/progress", h.ShowProgress)
+	r.POST("/:slug/campaigns/:id/support", h.StartCheckout)
+}
+
+// RegisterDashboardRoutes registers the creator's campaign editor. r must
+// already require authentication.
+func (h *Handler) RegisterDashboardRoutes(r *gin.RouterGroup) {
+	r.GET("/dashboard/campaigns", h.ShowCampaigns)
+	r.POST("/dashboard/campaigns", h.SaveCampaign)
+	r.GET("/dashboard/campaigns/:id", h.ShowEditor)
+	r.POST("/dashboard/campaigns/:id", h.SaveCampaign)
+	r.POST("/dashboard/campaigns/:id/close", h.CloseCampaign)
+	r.POST("/dashboard/campaigns/:id/updates", h.PostUpdate)
+}
+
+func (h *Handler) ShowCampaign(c *gin.Context) {
+	campaignPage := filepath.Join("templates", "pages", "campaign.html")
+
+	creator, campaign, ok := h.publicCampaign(c)
+	if !ok {
+		return
+	}
+
+	progress, err := h.service.Progress(c, campaign)
+	if err != nil {
+		slog.Error("Error loading campaign progress", slog.String("campaign_id", campaign.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	updates, err := h.service.ListUpdates(c, campaign.ID)
+	if err != nil {
+		slog.Error("Error loading campaign updates", slog.String("campaign_id", campaign.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Creator":  creator,
+		"Campaign": campaign,
+		"Progress": progress,
+		"Updates":  updates,
+	}
+	utils.Render(c, campaignPage, data)
+}
+
+// ShowProgress renders just the progress bar, which the campaign page polls.
+// Once the campaign has closed it tells htmx to stop polling.
+func (h *Handler) ShowProgress(c *gin.Context) {
+	campaignPage := filepath.Join("templates", "pages", "campaign.html")
+
+	creator, campaign, ok := h.publicCampaign(c)
+	if !ok {
+		return
+	}
+
+	progress, err := h.service.Progress(c, campaign)
+	if err != nil {
+		slog.Error("Error loading campaign progress", slog.String("campaign_id", campaign.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !progress.Open {
+		c.Status(htmx.StatusStopPolling)
+	}
+	data := map[string]interface{}{
+		"Creator":  creator,
+		"Campaign": campaign,
+		"Progress": progress,
+	}
+	utils.RenderPartial(c, campaignPage, "progress", data)
+}
+
+func (h *Handler) StartCheckout(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	creator, err := h.creators.GetBySlug(c, c.Param("slug"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	campaignID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	units, _ := strconv.Atoi(c.PostForm("units"))
+	checkout := payments.Checkout{
+		Units:     units,
+		Name:      c.PostForm("name"),
+		Message:   c.PostForm("message"),
+		Anonymous: c.PostForm("anonymous") != "",
+		Email:     c.PostForm("email"),
+		Locale:    c.GetString(utils.LocaleKey),
+	}
+
+	url, err := h.service.StartCheckout(c, creator, campaignID, utils.CurrentUser(c), checkout)
+	if err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error starting campaign checkout", slog.String("campaign_id", campaignID.Hex()), slog.String("error", err.Error()))
+		return
+	}
+
+	c.Header("HX-Redirect", url)
+}
+
+// publicCampaign loads the creator and campaign in the URL, or responds
+// with 404 and reports false.
+func (h *Handler) publicCampaign(c *gin.Context) (*models.Creator, *models.Campaign, bool) {
+	creator, err := h.creators.GetBySlug(c, c.Param("slug"))
+	if errors.Is(err, creators.ErrCreatorNotFound) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, nil, false
+	}
+	if err != nil {
+		slog.Error("Error loading creator", slog.String("slug", c.Param("slug")), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	campaign, ok := h.campaign(c, creator)
+	return creator, campaign, ok
+}
+
+// campaign loads the creator's campaign in the URL, or responds with 404
+// and reports false.
+func (h *Handler) campaign(c *gin.Context, creator *models.Creator) (*models.Campaign, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+	campaign, err := h.service.GetCampaign(c, creator, id)
+	if errors.Is(err, ErrCampaignNotFound) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		slog.Error("Error loading campaign", slog.String("campaign_id", id.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	return campaign, true
+}
+
+// campaignRow is a campaign on the dashboard with its progress.
+type campaignRow struct {
+	*models.Campaign
+	Progress *Progress
+}
+
+func (h *Handler) ShowCampaigns(c *gin.Context) {
+	campaignsPage := filepath.Join("templates", "pages", "dashboard_campaigns.html")
+
+	creator, ok := creators.Current(c, h.creators, campaignsPage)
+	if !ok {
+		return
+	}
+	h.renderCampaigns(c, creator, CampaignForm{}, "")
+}
+
+func (h *Handler) ShowEditor(c *gin.Context) {
+	campaignPage := filepath.Join("templates", "pages", "dashboard_campaign.html")
+
+	creator, ok := creators.Current(c, h.creators, campaignPage)
+	if !ok {
+		return
+	}
+	campaign, ok := h.campaign(c, creator)
+	if !ok {
+		return
+	}
+	h.renderEditor(c, creator, campaign, campaignForm(campaign), "")
+}
+
+func (h *Handler) SaveCampaign(c *gin.Context) {
+	campaignsPage := filepath.Join("templates", "pages", "dashboard_campaigns.html")
+
+	creator, ok := creators.Current(c, h.creators, campaignsPage)
+	if !ok {
+		return
+	}
+
+	var campaign *models.Campaign
+	var campaignID primitive.ObjectID
+	if c.Param("id") != "" {
+		if campaign, ok = h.campaign(c, creator); !ok {
+			return
+		}
+		campaignID = campaign.ID
+	}
+
+	form := CampaignForm{
+		Title:       c.PostForm("title"),
+		Description: c.PostForm("description"),
+		Cover:       c.PostForm("cover"),
+		Target:      c.PostForm("target"),
+		Deadline:    c.PostForm("deadline"),
+	}
+	saved, err := h.service.SaveCampaign(c, creator, campaignID, form)
+	if err != nil {
+		slog.Error("Error saving campaign", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		if campaign != nil {
+			h.renderEditor(c, creator, campaign, form, i18n.Message(c.GetString(utils.LocaleKey), err))
+		} else {
+			h.renderCampaigns(c, creator, form, i18n.Message(c.GetString(utils.LocaleKey), err))
+		}
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/campaigns/"+saved.ID.Hex()+"?saved=1")
+}
+
+func (h *Handler) CloseCampaign(c *gin.Context) {
+	campaignPage := filepath.Join("templates", "pages", "dashboard_campaign.html")
+
+	creator, ok := creators.Current(c, h.creators, campaignPage)
+	if !ok {
+		return
+	}
+	campaign, ok := h.campaign(c, creator)
+	if !ok {
+		return
+	}
+
+	if err := h.service.CloseCampaign(c, creator, campaign.ID); err != nil {
+		slog.Error("Error closing campaign", slog.String("campaign_id", campaign.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/campaigns/"+campaign.ID.Hex())
+}
+
+func (h *Handler) PostUpdate(c *gin.Context) {
+	campaignPage := filepath.Join("templates", "pages", "dashboard_campaign.html")
+
+	creator, ok := creators.Current(c, h.creators, campaignPage)
+	if !ok {
+		return
+	}
+	campaign, ok := h.campaign(c, creator)
+	if !ok {
+		return
+	}
+
+	if err := h.service.PostUpdate(c, creator, campaign.ID, c.PostForm("body")); err != nil {
+		slog.Error("Error posting campaign update", slog.String("campaign_id", campaign.ID.Hex()), slog.String("error", err.Error()))
+		h.renderEditor(c, creator, campaign, campaignForm(campaign), i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/campaigns/"+campaign.ID.Hex()+"?posted=1")
+}
+
+// renderCampaigns lists the creator's campaigns with the new campaign form
+// filled with draft.
+func (h *Handler) renderCampaigns(c *gin.Context, creator *models.Creator, draft CampaignForm, errMsg string) {
+	campaignsPage := filepath.Join("templates", "pages", "dashboard_campaigns.html")
+
+	campaigns, err := h.service.ListAllCampaigns(c, creator.ID)
+	if err != nil {
+		slog.Error("Error loading campaigns", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	rows := make([]campaignRow, 0, len(campaigns))
+	for _, campaign := range campaigns {
+		progress, err := h.service.Progress(c, campaign)
+		if err != nil {
+			slog.Error("Error loading campaign progress", slog.String("campaign_id", campaign.ID.Hex()), slog.String("error", err.Error()))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		rows = append(rows, campaignRow{Campaign: campaign, Progress: progress})
+	}
+
+	data := map[string]interface{}{
+		"Creator":   creator,
+		"Campaigns": rows,
+		"Form":      draft,
+		"Error":     errMsg,
+	}
+	utils.RenderDashboard(c, campaignsPage, data)
+}
+
+// renderEditor shows one campaign's editor and updates feed.
+func (h *Handler) renderEditor(c *gin.Context, creator *models.Creator, campaign *models.Campaign, form CampaignForm, errMsg string) {
+	campaignPage := filepath.Join("templates", "pages", "dashboard_campaign.html")
+
+	progress, err := h.service.Progress(c, campaign)
+	if err != nil {
+		slog.Error("Error loading campaign progress", slog.String("campaign_id", campaign.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	updates, err := h.service.ListUpdates(c, campaign.ID)
+	if err != nil {
+		slog.Error("Error loading campaign updates", slog.String("campaign_id", campaign.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Creator":  creator,
+		"Campaign": campaign,
+		"Progress": progress,
+		"Updates":  updates,
+		"Form":     form,
+		"Saved":    c.Query("saved") != "",
+		"Posted":   c.Query("posted") != "",
+		"Error":    errMsg,
+	}
+	utils.RenderDashboard(c, campaignPage, data)
+}
+
+// campaignForm fills the editor with a campaign's stored values.
+func campaignForm(campaign *models.Campaign) CampaignForm {
+	return CampaignForm{
+		Title:       campaign.Title,
+		Description: campaign.Description,
+		Cover:       campaign.Cover,
+		Target:      strings.TrimSuffix(campaign.Target.Major(), ".00"),
+		Deadline:    campaign.LastDay().Format(deadlineLayout),
+	}
+}
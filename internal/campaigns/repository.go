@@ -0,0 +1,140 @@
+package campaigns
+
+import (
+	"context"
+	"fmj/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Repository interface {
+	CreateCampaign(ctx context.Context, campaign *models.Campaign) error
+	UpdateCampaign(ctx context.Context, campaign *models.Campaign) error
+	FindCampaignByID(ctx context.Context, id primitive.ObjectID) (*models.Campaign, error)
+	FindCampaignsByCreator(ctx context.Context, creatorID primitive.ObjectID, openOnly bool) ([]*models.Campaign, error)
+	CreateUpdate(ctx context.Context, update *models.CampaignUpdate) error
+	FindUpdates(ctx context.Context, campaignID primitive.ObjectID) ([]*models.CampaignUpdate, error)
+	CloseExpired(ctx context.Context, now time.Time) (int64, error)
+	EnsureIndexes(ctx context.Context) error
+}
+
+type repository struct {
+	db *mongo.Database
+}
+
+func (r repository) CreateCampaign(ctx context.Context, campaign *models.Campaign) error {
+	campaign.CreatedAt = time.Now()
+	campaign.UpdatedAt = time.Now()
+
+	result, err := r.db.Collection("campaigns").InsertOne(ctx, campaign)
+	if err != nil {
+		return err
+	}
+	campaign.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (r repository) UpdateCampaign(ctx context.Context, campaign *models.Campaign) error {
+	campaign.UpdatedAt = time.Now()
+	_, err := r.db.Collection("campaigns").ReplaceOne(
+		ctx,
+		bson.M{"_id": campaign.ID},
+		campaign,
+	)
+	return err
+}
+
+func (r repository) FindCampaignByID(ctx context.Context, id primitive.ObjectID) (*models.Campaign, error) {
+	var campaign models.Campaign
+	err := r.db.Collection("campaigns").FindOne(ctx, bson.M{"_id": id}).Decode(&campaign)
+	if err != nil {
+		return nil, err
+	}
+	return &campaign, nil
+}
+
+// FindCampaignsByCreator returns a creator's campaigns, the ones ending
+// soonest first.
+func (r repository) FindCampaignsByCreator(ctx context.Context, creatorID primitive.ObjectID, openOnly bool) ([]*models.Campaign, error) {
+	filter := bson.M{"creator_id": creatorID}
+	if openOnly {
+		filter["status"] = models.CampaignOpen
+		filter["deadline"] = bson.M{"$gt": time.Now()}
+	}
+	cursor, err := r.db.Collection("campaigns").Find(
+		ctx,
+		filter,
+		options.Find().SetSort(bson.D{{Key: "status", Value: -1}, {Key: "deadline", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var campaigns []*models.Campaign
+	if err := cursor.All(ctx, &campaigns); err != nil {
+		return nil, err
+	}
+	return campaigns, nil
+}
+
+func (r repository) CreateUpdate(ctx context.Context, update *models.CampaignUpdate) error {
+	update.CreatedAt = time.Now()
+
+	result, err := r.db.Collection("campaign_updates").InsertOne(ctx, update)
+	if err != nil {
+		return err
+	}
+	update.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindUpdates returns a campaign's updates, newest first.
+func (r repository) FindUpdates(ctx context.Context, campaignID primitive.ObjectID) ([]*models.CampaignUpdate, error) {
+	cursor, err := r.db.Collection("campaign_updates").Find(
+		ctx,
+		bson.M{"campaign_id": campaignID},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var updates []*models.CampaignUpdate
+	if err := cursor.All(ctx, &updates); err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+// CloseExpired closes the open campaigns whose deadline has passed.
+func (r repository) CloseExpired(ctx context.Context, now time.Time) (int64, error) {
+	res, err := r.db.Collection("campaigns").UpdateMany(
+		ctx,
+		bson.M{"status": models.CampaignOpen, "deadline": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"status": models.CampaignClosed, "closed_at": now, "updated_at": now}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (r repository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.db.Collection("campaigns").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "creator_id", Value: 1}, {Key: "deadline", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "deadline", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Collection("campaign_updates").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "campaign_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
+	return err
+}
+
+func NewRepository(db *mongo.Database) Repository {
+	return &repository{db}
+}
@@ -0,0 +1,37 @@
+package campaigns
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Scheduler closes campaigns in the background once their deadline passes.
+type Scheduler struct {
+	service  Service
+	interval time.Duration
+}
+
+func NewScheduler(service Service, interval time.Duration) *Scheduler {
+	return &Scheduler{service: service, interval: interval}
+}
+
+// Start runs the scheduler every interval until ctx is done.
+func (s *Scheduler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.service.CloseExpired(ctx, time.Now()); err != nil {
+				slog.Error("Error closing campaigns", slog.String("error", err.Error()))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,258 @@
+package campaigns
+
+import (
+	"context"
+	"errors"
+	"fmj/internal/creators"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmj/internal/money"
+	"fmj/internal/payments"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// ErrCampaignNotFound is returned when no campaign matches, or it belongs
+// to another creator.
+var ErrCampaignNotFound = i18n.NewError("campaigns.error.not_found")
+
+const (
+	maxOpenCampaigns     = 5
+	maxTitleLength       = 100
+	maxDescriptionLength = 5000
+	maxUpdateLength      = 2000
+	maxCampaignLength    = 365 * 24 * time.Hour
+
+	// deadlineLayout is how deadlines are entered, as a date input sends them.
+	deadlineLayout = "2006-01-02"
+)
+
+// CampaignForm is what a creator fills in for a campaign.
+type CampaignForm struct {
+	Title       string
+	Description string
+	Cover       string
+	Target      string // in major units of the creator's payout currency
+	Deadline    string // e.g. 2024-12-31, the last day donations are taken
+}
+
+// Progress is how far a campaign is towards its target.
+type Progress struct {
+	Raised     money.Money
+	Target     money.Money
+	Supporters int
+	Percent    int // may go past 100
+	Open       bool
+}
+
+// BarWidth is Percent capped at 100, for drawing the progress bar.
+func (p Progress) BarWidth() int {
+	return min(p.Percent, 100)
+}
+
+type Service interface {
+	ListCampaigns(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Campaign, error)
+	ListAllCampaigns(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Campaign, error)
+	GetCampaign(ctx context.Context, creator *models.Creator, id primitive.ObjectID) (*models.Campaign, error)
+	SaveCampaign(ctx context.Context, creator *models.Creator, campaignID primitive.ObjectID, form CampaignForm) (*models.Campaign, error)
+	CloseCampaign(ctx context.Context, creator *models.Creator, campaignID primitive.ObjectID) error
+	PostUpdate(ctx context.Context, creator *models.Creator, campaignID primitive.ObjectID, body string) error
+	ListUpdates(ctx context.Context, campaignID primitive.ObjectID) ([]*models.CampaignUpdate, error)
+	Progress(ctx context.Context, campaign *models.Campaign) (*Progress, error)
+	StartCheckout(ctx context.Context, creator *models.Creator, campaignID primitive.ObjectID, supporter *models.User, checkout payments.Checkout) (string, error)
+	CloseExpired(ctx context.Context, now time.Time) error
+}
+
+type service struct {
+	repo     Repository
+	payments payments.Service
+}
+
+// ListCampaigns returns the campaigns of a creator still taking donations.
+func (s *service) ListCampaigns(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Campaign, error) {
+	return s.repo.FindCampaignsByCreator(ctx, creatorID, true)
+}
+
+// ListAllCampaigns returns every campaign of a creator, closed ones included.
+func (s *service) ListAllCampaigns(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Campaign, error) {
+	return s.repo.FindCampaignsByCreator(ctx, creatorID, false)
+}
+
+// GetCampaign returns the creator's campaign with id.
+func (s *service) GetCampaign(ctx context.Context, creator *models.Creator, id primitive.ObjectID) (*models.Campaign, error) {
+	campaign, err := s.repo.FindCampaignByID(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && campaign.CreatorID != creator.ID) {
+		return nil, ErrCampaignNotFound
+	}
+	return campaign, err
+}
+
+// SaveCampaign creates a campaign, or updates it when campaignID is set.
+// The target can't change once the campaign has started.
+func (s *service) SaveCampaign(ctx context.Context, creator *models.Creator, campaignID primitive.ObjectID, form CampaignForm) (*models.Campaign, error) {
+	campaign := &models.Campaign{CreatorID: creator.ID, Status: models.CampaignOpen}
+	if !campaignID.IsZero() {
+		var err error
+		if campaign, err = s.GetCampaign(ctx, creator, campaignID); err != nil {
+			return nil, err
+		}
+		if campaign.Status == models.CampaignClosed {
+			return nil, i18n.NewError("campaigns.error.closed_edit")
+		}
+	} else {
+		if creator.UnitPrice.Minor <= 0 {
+			return nil, i18n.NewError("campaigns.error.no_price")
+		}
+		open, err := s.repo.FindCampaignsByCreator(ctx, creator.ID, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(open) >= maxOpenCampaigns {
+			return nil, i18n.NewError("campaigns.error.too_many_open", "count", maxOpenCampaigns)
+		}
+	}
+
+	title := strings.TrimSpace(form.Title)
+	if title == "" {
+		return nil, i18n.NewError("campaigns.error.title")
+	}
+	if len([]rune(title)) > maxTitleLength {
+		return nil, i18n.NewError("campaigns.error.title_too_long", "count", maxTitleLength)
+	}
+
+	description := strings.TrimSpace(form.Description)
+	if len([]rune(description)) > maxDescriptionLength {
+		return nil, i18n.NewError("campaigns.error.description_too_long", "count", maxDescriptionLength)
+	}
+
+	cover, err := creators.CleanURL(form.Cover)
+	if err != nil {
+		return nil, i18n.NewError("campaigns.error.cover")
+	}
+
+	if campaign.ID.IsZero() {
+		target, err := money.Parse(form.Target, creator.UnitPrice.Currency)
+		if err != nil || target.Minor <= 0 {
+			return nil, i18n.NewError("campaigns.error.target")
+		}
+		campaign.Target = target
+	}
+
+	day, err := time.Parse(deadlineLayout, strings.TrimSpace(form.Deadline))
+	if err != nil {
+		return nil, i18n.NewError("campaigns.error.deadline")
+	}
+	// Donations are taken until the end of the chosen day.
+	deadline := day.AddDate(0, 0, 1)
+	now := time.Now()
+	if !deadline.After(now) {
+		return nil, i18n.NewError("campaigns.error.deadline_past")
+	}
+	if deadline.Sub(now) > maxCampaignLength {
+		return nil, i18n.NewError("campaigns.error.too_long")
+	}
+
+	campaign.Title = title
+	campaign.Description = description
+	campaign.Cover = cover
+	campaign.Deadline = deadline
+
+	if campaign.ID.IsZero() {
+		err = s.repo.CreateCampaign(ctx, campaign)
+	} else {
+		err = s.repo.UpdateCampaign(ctx, campaign)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return campaign, nil
+}
+
+// CloseCampaign stops a campaign from taking donations before its deadline.
+func (s *service) CloseCampaign(ctx context.Context, creator *models.Creator, campaignID primitive.ObjectID) error {
+	campaign, err := s.GetCampaign(ctx, creator, campaignID)
+	if err != nil {
+		return err
+	}
+	if campaign.Status == models.CampaignClosed {
+		return nil
+	}
+	campaign.Status = models.CampaignClosed
+	campaign.ClosedAt = time.Now()
+	return s.repo.UpdateCampaign(ctx, campaign)
+}
+
+// PostUpdate adds a post to a campaign's updates feed.
+func (s *service) PostUpdate(ctx context.Context, creator *models.Creator, campaignID primitive.ObjectID, body string) error {
+	campaign, err := s.GetCampaign(ctx, creator, campaignID)
+	if err != nil {
+		return err
+	}
+
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return i18n.NewError("campaigns.error.empty_update")
+	}
+	if len([]rune(body)) > maxUpdateLength {
+		return i18n.NewError("campaigns.error.update_too_long", "count", maxUpdateLength)
+	}
+	return s.repo.CreateUpdate(ctx, &models.CampaignUpdate{CampaignID: campaign.ID, Body: body})
+}
+
+// ListUpdates returns a campaign's updates feed, newest first.
+func (s *service) ListUpdates(ctx context.Context, campaignID primitive.ObjectID) ([]*models.CampaignUpdate, error) {
+	return s.repo.FindUpdates(ctx, campaignID)
+}
+
+// Progress totals the donations made to a campaign in its target currency.
+func (s *service) Progress(ctx context.Context, campaign *models.Campaign) (*Progress, error) {
+	raised, supporters, err := s.payments.CampaignRaised(ctx, campaign.ID, campaign.Target.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &Progress{
+		Raised:     raised,
+		Target:     campaign.Target,
+		Supporters: supporters,
+		Open:       campaign.IsOpen(time.Now()),
+	}
+	if campaign.Target.Minor > 0 {
+		progress.Percent = int(raised.Minor * 100 / campaign.Target.Minor)
+	}
+	return progress, nil
+}
+
+// StartCheckout starts a donation towards one of the creator's campaigns
+// and returns the gateway page where the supporter pays.
+func (s *service) StartCheckout(ctx context.Context, creator *models.Creator, campaignID primitive.ObjectID, supporter *models.User, checkout payments.Checkout) (string, error) {
+	campaign, err := s.GetCampaign(ctx, creator, campaignID)
+	if err != nil {
+		return "", err
+	}
+	if !campaign.IsOpen(time.Now()) {
+		return "", i18n.NewError("campaigns.error.closed")
+	}
+
+	checkout.CampaignID = &campaign.ID
+	return s.payments.StartCheckout(ctx, creator, supporter, checkout)
+}
+
+// CloseExpired closes every open campaign whose deadline has passed.
+func (s *service) CloseExpired(ctx context.Context, now time.Time) error {
+	closed, err := s.repo.CloseExpired(ctx, now)
+	if err != nil {
+		return err
+	}
+	if closed > 0 {
+		slog.Info("Closed campaigns", slog.Int64("count", closed))
+	}
+	return nil
+}
+
+func NewService(repo Repository, paymentService payments.Service) Service {
+	return &service{repo: repo, payments: paymentService}
+}
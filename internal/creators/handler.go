@@ -0,0 +1,203 @@
+package creators
+
+import (
+	"context"
+	"errors"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmj/internal/money"
+	"fmj/internal/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// TierLister lists the membership tiers shown on a creator's page.
+// memberships.Service satisfies it.
+type TierLister interface {
+	ListTiers(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Tier, error)
+}
+
+// CampaignLister lists the open campaigns shown on a creator's page.
+// campaigns.Service satisfies it.
+type CampaignLister interface {
+	ListCampaigns(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Campaign, error)
+}
+
+type Handler struct {
+	service   Service
+	tiers     TierLister
+	campaigns CampaignLister
+}
+
+func NewHandler(service Service, tiers TierLister, campaigns CampaignLister) *Handler {
+	return &Handler{service: service, tiers: tiers, campaigns: campaigns}
+}
+
+// ReserveRoutes reserves the first path segment of every route, e.g.
+// "payments" for /payments/fake/checkout. Call it once at startup, after
+// every other route is registered and before creator pages are.
+func ReserveRoutes(routes gin.RoutesInfo) {
+	for _, route := range routes {
+		segment, _, _ := strings.Cut(strings.TrimPrefix(route.Path, "/"), "/")
+		if segment != "" && !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+			reservedSlugs[segment] = true
+		}
+	}
+}
+
+// RegisterRoutes registers the public creator pages. /:slug matches any
+// top-level path, so more specific routes take precedence over it.
+func (h *Handler) RegisterRoutes(r *gin.Engine) {
+	r.GET("/:slug", h.ShowCreator)
+}
+
+// RegisterDashboardRoutes registers the page editor. r must already require
+// authentication.
+func (h *Handler) RegisterDashboardRoutes(r *gin.RouterGroup) {
+	r.GET("/dashboard/page", h.ShowEditor)
+	r.POST("/dashboard/page", h.SaveProfile)
+}
+
+func (h *Handler) ShowCreator(c *gin.Context) {
+	creatorPage := filepath.Join("templates", "pages", "creator.html")
+
+	creator, err := h.service.GetBySlug(c, c.Param("slug"))
+	if errors.Is(err, ErrCreatorNotFound) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Error loading creator", slog.String("slug", c.Param("slug")), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	tiers, err := h.tiers.ListTiers(c, creator.ID)
+	if err != nil {
+		slog.Error("Error loading tiers", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	campaigns, err := h.campaigns.ListCampaigns(c, creator.ID)
+	if err != nil {
+		slog.Error("Error loading campaigns", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Creator":   creator,
+		"Platforms": Platforms,
+		"Tiers":     tiers,
+		"Campaigns": campaigns,
+	}
+	utils.Render(c, creatorPage, data)
+}
+
+func (h *Handler) ShowEditor(c *gin.Context) {
+	user := utils.CurrentUser(c)
+
+	creator, err := h.service.GetByUser(c, user.ID)
+	if errors.Is(err, ErrCreatorNotFound) {
+		// Start from what we already know about the user.
+		creator = &models.Creator{DisplayName: user.FullName, Avatar: user.Avatar, UnitPrice: money.New(0, money.Codes[0])}
+	} else if err != nil {
+		slog.Error("Error loading creator", slog.String("user_id", user.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	h.renderEditor(c, creator, "")
+}
+
+func (h *Handler) SaveProfile(c *gin.Context) {
+	user := utils.CurrentUser(c)
+
+	profile := Profile{
+		Slug:        c.PostForm("slug"),
+		DisplayName: c.PostForm("display_name"),
+		Bio:         c.PostForm("bio"),
+		Avatar:      c.PostForm("avatar"),
+		Cover:       c.PostForm("cover"),
+		Category:    c.PostForm("category"),
+		Links:       make(map[string]string),
+		UnitPrice:   c.PostForm("unit_price"),
+		Currency:    c.PostForm("currency"),
+	}
+	for _, platform := range Platforms {
+		profile.Links[platform.Key] = c.PostForm("link_" + platform.Key)
+	}
+
+	if _, err := h.service.SaveProfile(c, user, profile); err != nil {
+		slog.Error("Error saving creator page", slog.String("user_id", user.ID.Hex()), slog.String("error", err.Error()))
+
+		// Show the form again with what the user typed.
+		creator := &models.Creator{
+			Slug:        profile.Slug,
+			DisplayName: profile.DisplayName,
+			Bio:         profile.Bio,
+			Avatar:      profile.Avatar,
+			Cover:       profile.Cover,
+			Category:    profile.Category,
+		}
+		creator.UnitPrice, _ = money.Parse(profile.UnitPrice, profile.Currency)
+		creator.UnitPrice.Currency = profile.Currency
+		for _, platform := range Platforms {
+			if link := profile.Links[platform.Key]; link != "" {
+				creator.Links = append(creator.Links, models.SocialLink{Platform: platform.Key, URL: link})
+			}
+		}
+		h.renderEditor(c, creator, i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/page?saved=1")
+}
+
+func (h *Handler) renderEditor(c *gin.Context, creator *models.Creator, errMsg string) {
+	editorPage := filepath.Join("templates", "pages", "dashboard_creator.html")
+
+	data := map[string]interface{}{
+		"Creator":    creator,
+		"Categories": Categories,
+		"Currencies": money.Codes,
+		"Platforms":  Platforms,
+		"UnitPrice":  priceInput(creator.UnitPrice),
+		"Saved":      c.Query("saved") != "",
+		"Error":      errMsg,
+	}
+	utils.RenderDashboard(c, editorPage, data)
+}
+
+// priceInput renders a price for the price input, e.g. "1500" or "2.50",
+// or "" when unset.
+func priceInput(price money.Money) string {
+	if price.IsZero() {
+		return ""
+	}
+	return strings.TrimSuffix(price.Major(), ".00")
+}
+
+// Current returns the signed-in user's creator page, loaded through service.
+// Without one it renders page asking them to set it up first, and reports
+// false.
+func Current(c *gin.Context, service Service, page string) (*models.Creator, bool) {
+	user := utils.CurrentUser(c)
+
+	creator, err := service.GetByUser(c, user.ID)
+	if errors.Is(err, ErrCreatorNotFound) {
+		utils.RenderDashboard(c, page, nil)
+		return nil, false
+	}
+	if err != nil {
+		slog.Error("Error loading creator", slog.String("user_id", user.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	return creator, true
+}
@@ -0,0 +1,104 @@
+package creators
+
+import (
+	"context"
+	"fmj/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Repository interface {
+	CreateCreator(ctx context.Context, creator *models.Creator) error
+	UpdateCreator(ctx context.Context, creator *models.Creator) error
+	FindCreatorBySlug(ctx context.Context, slug string) (*models.Creator, error)
+	FindCreatorByID(ctx context.Context, id primitive.ObjectID) (*models.Creator, error)
+	FindCreatorByUser(ctx context.Context, userID primitive.ObjectID) (*models.Creator, error)
+	EnsureIndexes(ctx context.Context) error
+	MigrateMoneyFields(ctx context.Context) error
+}
+
+type repository struct {
+	db *mongo.Database
+}
+
+func (r repository) CreateCreator(ctx context.Context, creator *models.Creator) error {
+	creator.CreatedAt = time.Now()
+	creator.UpdatedAt = time.Now()
+
+	result, err := r.db.Collection("creators").InsertOne(ctx, creator)
+	if err != nil {
+		return err
+	}
+	creator.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (r repository) UpdateCreator(ctx context.Context, creator *models.Creator) error {
+	creator.UpdatedAt = time.Now()
+	_, err := r.db.Collection("creators").ReplaceOne(
+		ctx,
+		bson.M{"_id": creator.ID},
+		creator,
+	)
+	return err
+}
+
+func (r repository) FindCreatorBySlug(ctx context.Context, slug string) (*models.Creator, error) {
+	var creator models.Creator
+	err := r.db.Collection("creators").FindOne(ctx, bson.M{"slug": slug}).Decode(&creator)
+	if err != nil {
+		return nil, err
+	}
+	return &creator, nil
+}
+
+func (r repository) FindCreatorByID(ctx context.Context, id primitive.ObjectID) (*models.Creator, error) {
+	var creator models.Creator
+	err := r.db.Collection("creators").FindOne(ctx, bson.M{"_id": id}).Decode(&creator)
+	if err != nil {
+		return nil, err
+	}
+	return &creator, nil
+}
+
+func (r repository) FindCreatorByUser(ctx context.Context, userID primitive.ObjectID) (*models.Creator, error) {
+	var creator models.Creator
+	err := r.db.Collection("creators").FindOne(ctx, bson.M{"user_id": userID}).Decode(&creator)
+	if err != nil {
+		return nil, err
+	}
+	return &creator, nil
+}
+
+// EnsureIndexes creates the indexes that keep slugs unique and each user to
+// a single page.
+func (r repository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.db.Collection("creators").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "slug", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	return err
+}
+
+// MigrateMoneyFields moves pages saved with a bare minor-unit price and a
+// separate currency to the money document shape.
+func (r repository) MigrateMoneyFields(ctx context.Context) error {
+	_, err := r.db.Collection("creators").UpdateMany(
+		ctx,
+		bson.M{"unit_price": bson.M{"$type": "number"}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"unit_price": bson.M{"minor": bson.M{"$toLong": "$unit_price"}, "currency": "$currency"},
+			}}},
+			{{Key: "$unset", Value: "currency"}},
+		},
+	)
+	return err
+}
+
+func NewRepository(db *mongo.Database) Repository {
+	return &repository{db}
+}
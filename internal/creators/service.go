@@ -0,0 +1,254 @@
+package creators
+
+import (
+	"context"
+	"errors"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmj/internal/money"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ErrCreatorNotFound is returned when no creator page matches.
+var ErrCreatorNotFound = i18n.NewError("creators.error.not_found")
+
+// ErrSlugTaken is returned when another page already uses the slug.
+var ErrSlugTaken = i18n.NewError("creators.error.slug_taken")
+
+const (
+	maxDisplayNameLength = 60
+	maxBioLength         = 1000
+
+	// maxUnitPrice caps the price of one jollof, in minor units.
+	maxUnitPrice = 1_000_000_000
+)
+
+// slugPattern allows 3 to 30 lowercase letters, digits and inner hyphens.
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,28}[a-z0-9]$`)
+
+// reservedSlugs can't be used as page addresses because they are, or may
+// become, top-level routes. ReserveRoutes adds whatever the router actually
+// registers, so the list can't fall behind it.
+var reservedSlugs = map[string]bool{
+	"about": true, "admin": true, "api": true, "auth": true, "blog": true,
+	"dashboard": true, "dev": true, "email": true, "explore": true,
+	"help": true, "language": true, "login": true, "logout": true,
+	"payments": true, "pricing": true, "register": true, "settings": true,
+	"static": true, "support": true, "terms": true, "privacy": true,
+	"webhooks": true,
+}
+
+// Categories are the choices offered for a creator's category.
+var Categories = []string{
+	"Art & Design",
+	"Music",
+	"Writing",
+	"Podcasts",
+	"Video & Film",
+	"Education",
+	"Food",
+	"Fashion",
+	"Community",
+	"Other",
+}
+
+// Platform is a social network a creator can link to.
+type Platform struct {
+	Key  string
+	Name string
+}
+
+// Platforms are the social links offered on the creator form.
+var Platforms = []Platform{
+	{Key: "website", Name: "Website"},
+	{Key: "instagram", Name: "Instagram"},
+	{Key: "x", Name: "X"},
+	{Key: "youtube", Name: "YouTube"},
+	{Key: "tiktok", Name: "TikTok"},
+	{Key: "facebook", Name: "Facebook"},
+}
+
+// Profile is what a user fills in on the creator form.
+type Profile struct {
+	Slug        string
+	DisplayName string
+	Bio         string
+	Avatar      string
+	Cover       string
+	Category    string
+	Links       map[string]string // platform key to URL
+	UnitPrice   string            // in major units, e.g. "1500" or "2.50"
+	Currency    string            // the creator's payout currency
+}
+
+// RoleGranter gives users roles. auth.Repository satisfies it.
+type RoleGranter interface {
+	AddRole(ctx context.Context, userID primitive.ObjectID, role models.Role) error
+}
+
+type Service interface {
+	GetBySlug(ctx context.Context, slug string) (*models.Creator, error)
+	GetByID(ctx context.Context, id primitive.ObjectID) (*models.Creator, error)
+	GetByUser(ctx context.Context, userID primitive.ObjectID) (*models.Creator, error)
+	SaveProfile(ctx context.Context, user *models.User, profile Profile) (*models.Creator, error)
+}
+
+type service struct {
+	repo  Repository
+	roles RoleGranter
+}
+
+func (s *service) GetBySlug(ctx context.Context, slug string) (*models.Creator, error) {
+	creator, err := s.repo.FindCreatorBySlug(ctx, strings.ToLower(slug))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrCreatorNotFound
+	}
+	return creator, err
+}
+
+func (s *service) GetByID(ctx context.Context, id primitive.ObjectID) (*models.Creator, error) {
+	creator, err := s.repo.FindCreatorByID(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrCreatorNotFound
+	}
+	return creator, err
+}
+
+func (s *service) GetByUser(ctx context.Context, userID primitive.ObjectID) (*models.Creator, error) {
+	creator, err := s.repo.FindCreatorByUser(ctx, userID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrCreatorNotFound
+	}
+	return creator, err
+}
+
+// SaveProfile creates the user's creator page, or updates it if they already
+// have one. Creating a page makes the user a creator.
+func (s *service) SaveProfile(ctx context.Context, user *models.User, profile Profile) (*models.Creator, error) {
+	creator, err := s.GetByUser(ctx, user.ID)
+	if errors.Is(err, ErrCreatorNotFound) {
+		creator = &models.Creator{UserID: user.ID}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := applyProfile(creator, profile); err != nil {
+		return nil, err
+	}
+
+	if creator.ID.IsZero() {
+		err = s.repo.CreateCreator(ctx, creator)
+	} else {
+		err = s.repo.UpdateCreator(ctx, creator)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrSlugTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !user.HasRole(models.RoleCreator) {
+		if err := s.roles.AddRole(ctx, user.ID, models.RoleCreator); err != nil {
+			return nil, err
+		}
+	}
+	return creator, nil
+}
+
+// applyProfile validates profile and copies it onto creator.
+func applyProfile(creator *models.Creator, profile Profile) error {
+	slug := strings.ToLower(strings.TrimSpace(profile.Slug))
+	if !slugPattern.MatchString(slug) {
+		return i18n.NewError("creators.error.slug")
+	}
+	if reservedSlugs[slug] {
+		return ErrSlugTaken
+	}
+
+	displayName := strings.TrimSpace(profile.DisplayName)
+	if displayName == "" {
+		return i18n.NewError("creators.error.display_name")
+	}
+	if len([]rune(displayName)) > maxDisplayNameLength {
+		return i18n.NewError("creators.error.display_name_too_long", "count", maxDisplayNameLength)
+	}
+
+	bio := strings.TrimSpace(profile.Bio)
+	if len([]rune(bio)) > maxBioLength {
+		return i18n.NewError("creators.error.bio_too_long", "count", maxBioLength)
+	}
+
+	if !validCategory(profile.Category) {
+		return i18n.NewError("creators.error.category")
+	}
+
+	avatar, err := CleanURL(profile.Avatar)
+	if err != nil {
+		return i18n.NewError("creators.error.avatar")
+	}
+	cover, err := CleanURL(profile.Cover)
+	if err != nil {
+		return i18n.NewError("creators.error.cover")
+	}
+
+	if _, ok := money.Lookup(profile.Currency); !ok {
+		return i18n.NewError("creators.error.currency")
+	}
+	unitPrice, err := money.Parse(profile.UnitPrice, profile.Currency)
+	if err != nil || unitPrice.Minor <= 0 || unitPrice.Minor > maxUnitPrice {
+		return i18n.NewError("creators.error.unit_price")
+	}
+
+	var links []models.SocialLink
+	for _, platform := range Platforms {
+		link, err := CleanURL(profile.Links[platform.Key])
+		if err != nil {
+			return i18n.NewError("creators.error.platform_link", "platform", platform.Name)
+		}
+		if link != "" {
+			links = append(links, models.SocialLink{Platform: platform.Key, URL: link})
+		}
+	}
+
+	creator.Slug = slug
+	creator.DisplayName = displayName
+	creator.Bio = bio
+	creator.Avatar = avatar
+	creator.Cover = cover
+	creator.Category = profile.Category
+	creator.Links = links
+	creator.UnitPrice = unitPrice
+	return nil
+}
+
+func validCategory(category string) bool {
+	for _, c := range Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanURL trims raw and checks it is an absolute http(s) URL. Empty input
+// is allowed and returned as is.
+func CleanURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", i18n.NewError("creators.error.link")
+	}
+	return u.String(), nil
+}
+
+func NewService(repo Repository, roles RoleGranter) Service {
+	return &service{repo: repo, roles: roles}
+}
@@ -0,0 +1,174 @@
+package email
+
+import (
+	"errors"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmj/internal/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+)
+
+type Handler struct {
+	outbox       Outbox
+	suppressions Suppressions
+}
+
+func NewHandler(outbox Outbox, suppressions Suppressions) *Handler {
+	return &Handler{outbox: outbox, suppressions: suppressions}
+}
+
+// RegisterRoutes registers unsubscribe links and the bounce and complaint
+// webhook.
+func (h *Handler) RegisterRoutes(r *gin.Engine) {
+	r.GET("/email/unsubscribe", h.ShowUnsubscribe)
+	r.POST("/email/unsubscribe", h.Unsubscribe)
+	r.POST("/email/webhook", h.Webhook)
+}
+
+// RegisterDashboardRoutes registers the notification settings. r must
+// already require authentication.
+func (h *Handler) RegisterDashboardRoutes(r *gin.RouterGroup) {
+	r.GET("/dashboard/notifications", h.ShowNotifications)
+	r.POST("/dashboard/notifications", h.SaveNotifications)
+}
+
+// RegisterAdminRoutes registers the failed email list. r must already
+// require the admin role.
+func (h *Handler) RegisterAdminRoutes(r *gin.RouterGroup) {
+	r.GET("/admin/emails", h.ShowDeadLetters)
+	r.POST("/admin/emails/:id/retry", h.Retry)
+}
+
+// ShowUnsubscribe asks before unsubscribing, so link scanners that follow
+// every URL in an email don't unsubscribe people.
+func (h *Handler) ShowUnsubscribe(c *gin.Context) {
+	unsubscribePage := filepath.Join("templates", "pages", "unsubscribe.html")
+
+	data := map[string]interface{}{
+		"Token": c.Query("token"),
+	}
+	utils.Render(c, unsubscribePage, data)
+}
+
+// Unsubscribe handles both the confirmation form and RFC 8058 one-click
+// POSTs from mail clients, which carry the same token.
+func (h *Handler) Unsubscribe(c *gin.Context) {
+	unsubscribePage := filepath.Join("templates", "pages", "unsubscribe.html")
+
+	address, category, err := h.suppressions.Unsubscribe(c, c.Query("token"))
+	if errors.Is(err, ErrInvalidUnsubscribe) {
+		c.Status(http.StatusBadRequest)
+		utils.Render(c, unsubscribePage, map[string]interface{}{"Error": i18n.Message(c.GetString(utils.LocaleKey), err)})
+		return
+	}
+	if err != nil {
+		slog.Error("Error unsubscribing", slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Email":        address,
+		"Category":     string(category),
+		"Unsubscribed": true,
+	}
+	utils.Render(c, unsubscribePage, data)
+}
+
+func (h *Handler) Webhook(c *gin.Context) {
+	err := h.suppressions.HandleWebhook(c, c.Request)
+	switch {
+	case errors.Is(err, ErrInvalidSignature):
+		slog.Warn("Rejected email webhook with a bad signature", slog.String("ip", c.ClientIP()))
+		c.AbortWithStatus(http.StatusUnauthorized)
+	case err != nil:
+		slog.Error("Error handling email webhook", slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+	default:
+		c.Status(http.StatusOK)
+	}
+}
+
+func (h *Handler) ShowNotifications(c *gin.Context) {
+	h.renderNotifications(c, c.Query("saved") != "", "")
+}
+
+func (h *Handler) SaveNotifications(c *gin.Context) {
+	user := utils.CurrentUser(c)
+
+	prefs := models.NotificationPrefs{
+		NoReceipts: c.PostForm("receipts") == "",
+		NoUpdates:  c.PostForm("updates") == "",
+	}
+	if err := h.suppressions.SetPrefs(c, user, prefs); err != nil {
+		slog.Error("Error saving notification settings", slog.String("user_id", user.ID.Hex()), slog.String("error", err.Error()))
+		h.renderNotifications(c, false, i18n.T(c.GetString(utils.LocaleKey), "notifications.error"))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/notifications?saved=1")
+}
+
+func (h *Handler) renderNotifications(c *gin.Context, saved bool, errMsg string) {
+	notificationsPage := filepath.Join("templates", "pages", "dashboard_notifications.html")
+
+	data := map[string]interface{}{
+		"Prefs": utils.CurrentUser(c).Notifications,
+		"Saved": saved,
+		"Error": errMsg,
+	}
+	utils.RenderDashboard(c, notificationsPage, data)
+}
+
+func (h *Handler) ShowDeadLetters(c *gin.Context) {
+	h.renderDeadLetters(c, "")
+}
+
+func (h *Handler) Retry(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := h.outbox.Retry(c, id); err != nil {
+		if errors.Is(err, ErrDeadLetterNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		slog.Error("Error retrying email", slog.String("email_id", id.Hex()), slog.String("error", err.Error()))
+		h.renderDeadLetters(c, i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/admin/emails?retried=1")
+}
+
+func (h *Handler) renderDeadLetters(c *gin.Context, errMsg string) {
+	emailsPage := filepath.Join("templates", "pages", "admin_emails.html")
+
+	deadLetters, err := h.outbox.DeadLetters(c)
+	if err != nil {
+		slog.Error("Error loading failed emails", slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	queued, err := h.outbox.CountQueued(c)
+	if err != nil {
+		slog.Error("Error counting queued emails", slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"DeadLetters": deadLetters,
+		"Queued":      queued,
+		"Retried":     c.Query("retried") != "",
+		"Error":       errMsg,
+	}
+	utils.RenderDashboard(c, emailsPage, data)
+}
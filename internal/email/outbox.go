@@ -0,0 +1,125 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log/slog"
+	"time"
+)
+
+// ErrDeadLetterNotFound is returned for a dead letter that doesn't exist, or
+// was already retried.
+var ErrDeadLetterNotFound = i18n.NewError("email.error.dead_letter_not_found")
+
+const (
+	// maxAttempts is how many times an email is tried before it is moved
+	// to the dead letters.
+	maxAttempts = 8
+	// firstRetry is the wait after the first failure. It doubles with each
+	// failure after that, up to maxRetry.
+	firstRetry = 30 * time.Second
+	maxRetry   = 2 * time.Hour
+	// claimLease is how long a worker holds an email while sending it.
+	claimLease = 5 * time.Minute
+)
+
+// Outbox queues rendered emails in Mongo and sends them from the
+// background, so a mail server being down never fails the request that
+// wanted the email.
+type Outbox interface {
+	Enqueue(ctx context.Context, to string, msg *Message) error
+	// SendNext sends the next due email, if there is one, and reports
+	// whether there was.
+	SendNext(ctx context.Context, now time.Time) (bool, error)
+	CountQueued(ctx context.Context) (int64, error)
+	DeadLetters(ctx context.Context) ([]*models.Email, error)
+	Retry(ctx context.Context, id primitive.ObjectID) error
+}
+
+type outbox struct {
+	repo      Repository
+	transport Transport
+}
+
+func (o *outbox) Enqueue(ctx context.Context, to string, msg *Message) error {
+	return o.repo.Enqueue(ctx, &models.Email{
+		To:          to,
+		Template:    msg.Name,
+		Subject:     msg.Subject,
+		HTML:        msg.HTML,
+		Text:        msg.Text,
+		Category:    msg.Category,
+		Unsubscribe: msg.Unsubscribe,
+		Secret:      msg.Secret,
+	})
+}
+
+func (o *outbox) SendNext(ctx context.Context, now time.Time) (bool, error) {
+	email, err := o.repo.Claim(ctx, now, claimLease)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	sendErr := o.transport.Send(ctx, email)
+	if sendErr == nil {
+		return true, o.repo.Delete(ctx, email.ID)
+	}
+
+	email.Attempts++
+	email.LastError = sendErr.Error()
+	if email.Attempts >= maxAttempts {
+		slog.Error("Giving up on email",
+			slog.String("id", email.ID.Hex()),
+			slog.String("template", email.Template),
+			slog.String("error", email.LastError),
+		)
+		return true, o.repo.Bury(ctx, email)
+	}
+
+	email.NextAttemptAt = now.Add(retryDelay(email.Attempts))
+	slog.Warn("Email failed, will retry",
+		slog.String("id", email.ID.Hex()),
+		slog.Int("attempts", email.Attempts),
+		slog.Time("next_attempt_at", email.NextAttemptAt),
+		slog.String("error", email.LastError),
+	)
+	return true, o.repo.Reschedule(ctx, email)
+}
+
+// retryDelay is how long to wait after an email's attempts-th failure.
+func retryDelay(attempts int) time.Duration {
+	delay := firstRetry
+	for i := 1; i < attempts && delay < maxRetry; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetry)
+}
+
+func (o *outbox) CountQueued(ctx context.Context) (int64, error) {
+	return o.repo.CountQueued(ctx)
+}
+
+func (o *outbox) DeadLetters(ctx context.Context) ([]*models.Email, error) {
+	return o.repo.FindDeadLetters(ctx, 100)
+}
+
+// Retry puts a dead letter back in the outbox with a fresh set of attempts.
+func (o *outbox) Retry(ctx context.Context, id primitive.ObjectID) error {
+	err := o.repo.Resurrect(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrDeadLetterNotFound
+	}
+	return err
+}
+
+// NewOutbox returns an Outbox that sends through transport.
+func NewOutbox(repo Repository, transport Transport) Outbox {
+	return &outbox{repo: repo, transport: transport}
+}
@@ -0,0 +1,126 @@
+package email
+
+import (
+	"fmj/config"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// previews are the emails the preview pages can show, each sent with
+// sample data.
+var previews = []struct {
+	Name string
+	send func(s Service) error
+}{
+	{"verification", func(s Service) error { return s.SendVerificationEmail("ada@example.com", "Ada", "sample-code") }},
+	{"welcome", func(s Service) error { return s.SendWelcomeEmail("ada@example.com", "Ada") }},
+	{"password_reset", func(s Service) error { return s.SendPasswordResetEmail("ada@example.com", "Ada", "sample-token") }},
+	{"account_locked", func(s Service) error { return s.SendAccountLockedEmail("ada@example.com", "Ada") }},
+	{"magic_link", func(s Service) error { return s.SendMagicLinkEmail("ada@example.com", "Ada", "sample-token") }},
+	{"link_confirmation", func(s Service) error {
+		return s.SendLinkConfirmationEmail("ada@example.com", "Ada", "Google", "sample-token")
+	}},
+	{"refund", func(s Service) error {
+		return s.SendRefundEmail("ada@example.com", "", "Ada", "Chidi's Kitchen", "₦5,000.00")
+	}},
+	{"refund_notice", func(s Service) error {
+		return s.SendRefundNoticeEmail("chidi@example.com", "Chidi", "₦5,000.00", "fmj_sample")
+	}},
+	{"receipt", func(s Service) error {
+		return s.SendDonationReceiptEmail("ada@example.com", "", "Ada", "Chidi's Kitchen", "₦5,000.00", "fmj_sample")
+	}},
+	{"dispute_open", func(s Service) error {
+		return s.SendDisputeEmail("chidi@example.com", "Chidi", "₦5,000.00", "fmj_sample", "open")
+	}},
+	{"dispute_won", func(s Service) error {
+		return s.SendDisputeEmail("chidi@example.com", "Chidi", "₦5,000.00", "fmj_sample", "won")
+	}},
+	{"dispute_lost", func(s Service) error {
+		return s.SendDisputeEmail("chidi@example.com", "Chidi", "₦5,000.00", "fmj_sample", "lost")
+	}},
+}
+
+// previewLocale is a UserFinder whose every recipient reads the previewed
+// language.
+type previewLocale string
+
+func (l previewLocale) FindUserByEmail(email string) (*models.User, error) {
+	return &models.User{Email: email, Locale: string(l)}, nil
+}
+
+// PreviewHandler shows every email rendered with sample data, for working
+// on the templates. Nothing is sent. Only register it in development.
+type PreviewHandler struct {
+	config *config.Config
+}
+
+func NewPreviewHandler(config *config.Config) *PreviewHandler {
+	return &PreviewHandler{config: config}
+}
+
+func (h *PreviewHandler) RegisterRoutes(router *gin.Engine) {
+	router.GET("/dev/emails", h.index)
+	router.GET("/dev/emails/:name", h.preview)
+}
+
+func (h *PreviewHandler) index(c *gin.Context) {
+	page := "<!DOCTYPE html><title>Email previews</title><h1>Email previews</h1><ul>"
+	for _, p := range previews {
+		page += `<li><a href="/dev/emails/` + p.Name + `">` + p.Name + `</a> (<a href="/dev/emails/` + p.Name + `?format=text">text</a>)`
+		for _, language := range i18n.Languages[1:] {
+			page += ` <a href="/dev/emails/` + p.Name + `?locale=` + language.Code + `">` + language.Code + `</a>`
+		}
+		page += `</li>`
+	}
+	page += "</ul>"
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+}
+
+// preview renders one email, in the language given by ?locale=.
+// /dev/emails/logo.png serves the logo the previews point at, in place of
+// the inline attachment.
+func (h *PreviewHandler) preview(c *gin.Context) {
+	name := c.Param("name")
+	if name == logoCID {
+		logo, err := files.ReadFile("templates/logo.png")
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.Data(http.StatusOK, "image/png", logo)
+		return
+	}
+
+	for _, p := range previews {
+		if p.Name != name {
+			continue
+		}
+
+		var msg *Message
+		s := &service{
+			config: h.config,
+			users:  previewLocale(c.Query("locale")),
+			logo:   "/dev/emails/" + logoCID,
+			deliver: func(_ string, m *Message) error {
+				msg = m
+				return nil
+			},
+		}
+		if err := p.send(s); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if c.Query("format") == "text" {
+			c.String(http.StatusOK, "Subject: %s\n\n%s", msg.Subject, msg.Text)
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(msg.HTML))
+		return
+	}
+
+	c.AbortWithStatus(http.StatusNotFound)
+}
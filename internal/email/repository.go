@@ -0,0 +1,231 @@
+package email
+
+import (
+	"context"
+	"fmj/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Repository interface {
+	Enqueue(ctx context.Context, email *models.Email) error
+	Claim(ctx context.Context, now time.Time, lease time.Duration) (*models.Email, error)
+	Reschedule(ctx context.Context, email *models.Email) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	CountQueued(ctx context.Context) (int64, error)
+	Bury(ctx context.Context, email *models.Email) error
+	FindDeadLetters(ctx context.Context, limit int64) ([]*models.Email, error)
+	Resurrect(ctx context.Context, id primitive.ObjectID) error
+	AddSuppression(ctx context.Context, suppression *models.Suppression) error
+	FindSuppressions(ctx context.Context, email string) ([]*models.Suppression, error)
+	DeleteSuppression(ctx context.Context, email string, category models.EmailCategory) error
+	EnsureIndexes(ctx context.Context) error
+}
+
+type repository struct {
+	db *mongo.Database
+}
+
+func (r repository) Enqueue(ctx context.Context, email *models.Email) error {
+	email.CreatedAt = time.Now()
+	email.UpdatedAt = time.Now()
+	if email.NextAttemptAt.IsZero() {
+		email.NextAttemptAt = email.CreatedAt
+	}
+
+	result, err := r.db.Collection("email_outbox").InsertOne(ctx, email)
+	if err != nil {
+		return err
+	}
+	email.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// Claim takes the next due email and holds it for lease by pushing its
+// next attempt back, so other workers skip it. If the worker dies the lease
+// runs out and it is picked up again. Returns mongo.ErrNoDocuments when
+// nothing is due.
+func (r repository) Claim(ctx context.Context, now time.Time, lease time.Duration) (*models.Email, error) {
+	var email models.Email
+	err := r.db.Collection("email_outbox").FindOneAndUpdate(
+		ctx,
+		bson.M{"next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease), "updated_at": now}},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&email)
+	if err != nil {
+		return nil, err
+	}
+	return &email, nil
+}
+
+// Reschedule saves a failed attempt and when to try again.
+func (r repository) Reschedule(ctx context.Context, email *models.Email) error {
+	email.UpdatedAt = time.Now()
+
+	_, err := r.db.Collection("email_outbox").UpdateOne(
+		ctx,
+		bson.M{"_id": email.ID},
+		bson.M{"$set": bson.M{
+			"attempts":        email.Attempts,
+			"last_error":      email.LastError,
+			"next_attempt_at": email.NextAttemptAt,
+			"updated_at":      email.UpdatedAt,
+		}},
+	)
+	return err
+}
+
+func (r repository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	_, err := r.db.Collection("email_outbox").DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (r repository) CountQueued(ctx context.Context) (int64, error) {
+	return r.db.Collection("email_outbox").CountDocuments(ctx, bson.M{})
+}
+
+// Bury moves an email from the outbox to the dead letters. It is written to
+// the dead letters first, so a crash in between leaves a copy in both rather
+// than in neither. Secret emails lose their bodies on the way, so their
+// links aren't left lying around; the person can ask for a new one.
+func (r repository) Bury(ctx context.Context, email *models.Email) error {
+	email.FailedAt = time.Now()
+	email.UpdatedAt = email.FailedAt
+	if email.Secret {
+		email.HTML = ""
+		email.Text = ""
+	}
+
+	_, err := r.db.Collection("email_dead_letters").ReplaceOne(
+		ctx,
+		bson.M{"_id": email.ID},
+		email,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+	return r.Delete(ctx, email.ID)
+}
+
+// FindDeadLetters returns the most recently failed emails first.
+func (r repository) FindDeadLetters(ctx context.Context, limit int64) ([]*models.Email, error) {
+	cursor, err := r.db.Collection("email_dead_letters").Find(
+		ctx,
+		bson.M{},
+		options.Find().SetSort(bson.D{{Key: "failed_at", Value: -1}}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var emails []*models.Email
+	if err := cursor.All(ctx, &emails); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// Resurrect moves a dead letter back into the outbox with its attempts
+// reset, due straight away. Secret emails have no body left to send and
+// return mongo.ErrNoDocuments.
+func (r repository) Resurrect(ctx context.Context, id primitive.ObjectID) error {
+	var email models.Email
+	err := r.db.Collection("email_dead_letters").FindOne(ctx, bson.M{"_id": id, "secret": bson.M{"$ne": true}}).Decode(&email)
+	if err != nil {
+		return err
+	}
+
+	email.Attempts = 0
+	email.FailedAt = time.Time{}
+	email.NextAttemptAt = time.Now()
+	email.UpdatedAt = email.NextAttemptAt
+
+	_, err = r.db.Collection("email_outbox").ReplaceOne(
+		ctx,
+		bson.M{"_id": email.ID},
+		&email,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Collection("email_dead_letters").DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// AddSuppression records suppression, replacing any earlier one for the
+// same address and category.
+func (r repository) AddSuppression(ctx context.Context, suppression *models.Suppression) error {
+	suppression.CreatedAt = time.Now()
+
+	result, err := r.db.Collection("email_suppressions").UpdateOne(
+		ctx,
+		bson.M{"email": suppression.Email, "category": suppression.Category},
+		bson.M{
+			"$set": bson.M{
+				"reason":     suppression.Reason,
+				"detail":     suppression.Detail,
+				"created_at": suppression.CreatedAt,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+	if id, ok := result.UpsertedID.(primitive.ObjectID); ok {
+		suppression.ID = id
+	}
+	return nil
+}
+
+func (r repository) FindSuppressions(ctx context.Context, email string) ([]*models.Suppression, error) {
+	cursor, err := r.db.Collection("email_suppressions").Find(ctx, bson.M{"email": email})
+	if err != nil {
+		return nil, err
+	}
+	var suppressions []*models.Suppression
+	if err := cursor.All(ctx, &suppressions); err != nil {
+		return nil, err
+	}
+	return suppressions, nil
+}
+
+func (r repository) DeleteSuppression(ctx context.Context, email string, category models.EmailCategory) error {
+	_, err := r.db.Collection("email_suppressions").DeleteOne(ctx, bson.M{"email": email, "category": category})
+	return err
+}
+
+func (r repository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.db.Collection("email_outbox").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "next_attempt_at", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Dead letters are kept long enough to look into and retry, then go.
+	_, err = r.db.Collection("email_dead_letters").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "failed_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(30 * 24 * 60 * 60),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Collection("email_suppressions").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}, {Key: "category", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func NewRepository(db *mongo.Database) Repository {
+	return &repository{db}
+}
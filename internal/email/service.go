@@ -1,55 +1,208 @@
 package email
 
 import (
+	"context"
 	"fmj/config"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
 	"fmt"
-	"gopkg.in/mail.v2"
 	"log"
 )
 
 type Service interface {
 	SendVerificationEmail(to, name, code string) error
 	SendWelcomeEmail(to, name string) error
+	SendPasswordResetEmail(to, name, token string) error
+	SendAccountLockedEmail(to, name string) error
+	SendMagicLinkEmail(to, name, token string) error
+	SendLinkConfirmationEmail(to, name, provider, token string) error
+	SendRefundEmail(to, locale, name, creatorName, amount string) error
+	SendRefundNoticeEmail(to, name, amount, reference string) error
+	SendDisputeEmail(to, name, amount, reference, status string) error
+	SendDonationReceiptEmail(to, locale, name, creatorName, amount, reference string) error
+}
+
+// UserFinder looks up the account behind an address, for the language to
+// write to it in.
+type UserFinder interface {
+	FindUserByEmail(email string) (*models.User, error)
+}
+
+// secretEmails are the emails whose link signs someone in or changes their
+// account, so their bodies are never kept longer than it takes to send them.
+var secretEmails = map[string]bool{
+	"verification":      true,
+	"password_reset":    true,
+	"magic_link":        true,
+	"link_confirmation": true,
 }
 
 type service struct {
-	config *config.Config
+	config       *config.Config
+	suppressions Suppressions                        // nil when previewing
+	users        UserFinder                          // where recipients' languages are looked up
+	logo         string                              // where the HTML part loads the logo from
+	deliver      func(to string, msg *Message) error // queues it in the outbox, unless previewing
 }
 
 func (s *service) SendVerificationEmail(to, name, code string) error {
-	subject := "Verify your email address"
-	verifyLink := fmt.Sprintf("%s/auth/verify?code=%s", s.config.BaseURL, code)
-	body := fmt.Sprintf("Hello %s,\n\nPlease verify your email by clicking this link: %s", name, verifyLink)
-
-	return s.sendEmail(to, subject, body)
+	return s.send(to, "verification", models.EmailTransactional, data{
+		"Name":        name,
+		"ActionURL":   fmt.Sprintf("%s/auth/verify?code=%s", s.config.BaseURL, code),
+		"ActionLabel": "email.verification.action",
+	})
 }
 
 func (s *service) SendWelcomeEmail(to, name string) error {
-	subject := "Welcome to our platform!"
-	body := fmt.Sprintf("Hello %s,\n\nWelcome to our platform. We're excited to have you!", name)
+	return s.send(to, "welcome", models.EmailTransactional, data{
+		"Name":        name,
+		"ActionURL":   fmt.Sprintf("%s/dashboard", s.config.BaseURL),
+		"ActionLabel": "email.welcome.action",
+	})
+}
+
+func (s *service) SendPasswordResetEmail(to, name, token string) error {
+	return s.send(to, "password_reset", models.EmailTransactional, data{
+		"Name":        name,
+		"ActionURL":   fmt.Sprintf("%s/auth/reset?token=%s", s.config.BaseURL, token),
+		"ActionLabel": "email.password_reset.action",
+	})
+}
 
-	return s.sendEmail(to, subject, body)
+func (s *service) SendAccountLockedEmail(to, name string) error {
+	return s.send(to, "account_locked", models.EmailTransactional, data{
+		"Name":        name,
+		"ActionURL":   fmt.Sprintf("%s/auth/forgot", s.config.BaseURL),
+		"ActionLabel": "email.account_locked.action",
+	})
 }
 
-func (s *service) sendEmail(to, subject, body string) error {
-	m := mail.NewMessage()
-	m.SetHeader("From", s.config.FromEmail)
-	m.SetHeader("To", to)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/plain", body)
+func (s *service) SendMagicLinkEmail(to, name, token string) error {
+	return s.send(to, "magic_link", models.EmailTransactional, data{
+		"Name":        name,
+		"ActionURL":   fmt.Sprintf("%s/auth/magic/consume?token=%s", s.config.BaseURL, token),
+		"ActionLabel": "email.magic_link.action",
+	})
+}
+
+func (s *service) SendLinkConfirmationEmail(to, name, provider, token string) error {
+	return s.send(to, "link_confirmation", models.EmailTransactional, data{
+		"Name":        name,
+		"Provider":    provider,
+		"ActionURL":   fmt.Sprintf("%s/auth/link/confirm?token=%s", s.config.BaseURL, token),
+		"ActionLabel": "email.link_confirmation.action",
+	})
+}
+
+// SendRefundEmail tells a supporter their donation was refunded. locale is
+// the one they gave in, since guests have no account to look it up on; pass
+// "" to use their account's.
+func (s *service) SendRefundEmail(to, locale, name, creatorName, amount string) error {
+	return s.sendIn(to, locale, "refund", models.EmailTransactional, data{
+		"Name":        name,
+		"CreatorName": creatorName,
+		"Amount":      amount,
+	})
+}
 
-	d := mail.NewDialer(s.config.SMTPHost, s.config.SMTPPort, s.config.SMTPUsername, s.config.SMTPPassword)
+func (s *service) SendRefundNoticeEmail(to, name, amount, reference string) error {
+	return s.send(to, "refund_notice", models.EmailTransactional, data{
+		"Name":        name,
+		"Amount":      amount,
+		"Reference":   reference,
+		"ActionURL":   fmt.Sprintf("%s/dashboard/balance", s.config.BaseURL),
+		"ActionLabel": "email.balance_action",
+	})
+}
 
-	err := d.DialAndSend(m)
+// SendDisputeEmail tells a creator about a chargeback on one of their
+// donations. status is "open", "won" or "lost".
+func (s *service) SendDisputeEmail(to, name, amount, reference, status string) error {
+	d := data{
+		"Name":      name,
+		"Amount":    amount,
+		"Reference": reference,
+		"Status":    status,
+	}
+	if status != "lost" {
+		d["ActionURL"] = fmt.Sprintf("%s/dashboard/balance", s.config.BaseURL)
+		d["ActionLabel"] = "email.balance_action"
+	}
+
+	return s.send(to, "dispute", models.EmailTransactional, d)
+}
+
+// SendDonationReceiptEmail sends a supporter the receipt for a donation or
+// membership payment. Supporters can opt out of receipts. locale is as for
+// SendRefundEmail.
+func (s *service) SendDonationReceiptEmail(to, locale, name, creatorName, amount, reference string) error {
+	return s.sendIn(to, locale, "receipt", models.EmailReceipts, data{
+		"Name":        name,
+		"CreatorName": creatorName,
+		"Amount":      amount,
+		"Reference":   reference,
+	})
+}
+
+// send renders the email called name in the recipient's language and hands
+// it to deliver. Anything but transactional mail is refused with
+// ErrSuppressed when the address is suppressed or opted out, and otherwise
+// carries an unsubscribe link.
+func (s *service) send(to, name string, category models.EmailCategory, d data) error {
+	return s.sendIn(to, "", name, category, d)
+}
+
+// sendIn is send in locale, or in the language on the recipient's account
+// when locale is "".
+func (s *service) sendIn(to, locale, name string, category models.EmailCategory, d data) error {
+	if locale == "" {
+		locale = s.localeFor(to)
+	}
+
+	var unsubscribe string
+	if category != models.EmailTransactional {
+		if s.suppressions != nil {
+			allowed, err := s.suppressions.Allows(context.Background(), to, category)
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				return ErrSuppressed
+			}
+		}
+		unsubscribe = unsubscribeURL(s.config, to, category)
+		d["UnsubscribeURL"] = unsubscribe
+	}
+
+	msg, err := render(name, locale, s.config.BaseURL, s.logo, d)
 	if err != nil {
-		log.Printf("Failed to send email: %v", err)
+		log.Printf("Failed to render email: %v", err)
 		return err
 	}
+	msg.Category = category
+	msg.Unsubscribe = unsubscribe
+	msg.Secret = secretEmails[name]
 
-	fmt.Println("Email sent")
-	return nil
+	return s.deliver(to, msg)
 }
 
-func NewService(config *config.Config) Service {
-	return &service{config: config}
+// localeFor returns the language the account using to picked, or
+// i18n.Default when there is no such account.
+func (s *service) localeFor(to string) string {
+	user, err := s.users.FindUserByEmail(to)
+	if err != nil || !i18n.Supported(user.Locale) {
+		return i18n.Default
+	}
+	return user.Locale
+}
+
+// NewService returns a Service that queues every email in outbox, checking
+// non-transactional ones against suppressions first and writing in the
+// language on the recipient's account in users.
+func NewService(outbox Outbox, suppressions Suppressions, users UserFinder, config *config.Config) Service {
+	s := &service{config: config, suppressions: suppressions, users: users, logo: "cid:" + logoCID}
+	s.deliver = func(to string, msg *Message) error {
+		return outbox.Enqueue(context.Background(), to, msg)
+	}
+	return s
 }
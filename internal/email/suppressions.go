@@ -0,0 +1,260 @@
+package email
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmj/config"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrSuppressed is returned when a non-transactional email isn't sent
+// because the address bounced, complained or opted out.
+var ErrSuppressed = errors.New("the recipient doesn't want this email")
+
+// ErrInvalidUnsubscribe is returned for an unsubscribe link that wasn't
+// signed by us.
+var ErrInvalidUnsubscribe = i18n.NewError("email.error.invalid_unsubscribe")
+
+// ErrInvalidSignature is returned by HandleWebhook when a request doesn't
+// carry the webhook secret's signature.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// UserStore is the part of the user repository suppressions need.
+type UserStore interface {
+	FindUserByEmail(email string) (*models.User, error)
+	SetNotificationPrefs(ctx context.Context, userID primitive.ObjectID, prefs models.NotificationPrefs) error
+}
+
+// Suppressions decides who may get non-transactional email: not addresses
+// that bounced or complained, and not people who opted out of a category,
+// either with an unsubscribe link or in their notification settings.
+type Suppressions interface {
+	Allows(ctx context.Context, address string, category models.EmailCategory) (bool, error)
+	// Unsubscribe opts the address in a signed token out of its category,
+	// and returns the address and category.
+	Unsubscribe(ctx context.Context, token string) (string, models.EmailCategory, error)
+	SetPrefs(ctx context.Context, user *models.User, prefs models.NotificationPrefs) error
+	// HandleWebhook records the bounce or complaint a mail provider
+	// reports.
+	HandleWebhook(ctx context.Context, r *http.Request) error
+}
+
+type suppressions struct {
+	repo   Repository
+	users  UserStore
+	config *config.Config
+}
+
+func (s *suppressions) Allows(ctx context.Context, address string, category models.EmailCategory) (bool, error) {
+	if category == models.EmailTransactional {
+		return true, nil
+	}
+	list, err := s.repo.FindSuppressions(ctx, normalizeAddress(address))
+	if err != nil {
+		return false, err
+	}
+	for _, suppression := range list {
+		if suppression.Category == "" || suppression.Category == category {
+			return false, nil
+		}
+	}
+
+	user, err := s.users.FindUserByEmail(strings.TrimSpace(address))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return user.Notifications.Allows(category), nil
+}
+
+func (s *suppressions) Unsubscribe(ctx context.Context, token string) (string, models.EmailCategory, error) {
+	address, category, err := parseUnsubscribeToken(s.config.SessionSecret, token)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = s.repo.AddSuppression(ctx, &models.Suppression{
+		Email:    address,
+		Category: category,
+		Reason:   models.SuppressionUnsubscribe,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	// Keep an account's settings page in step with the link.
+	user, err := s.users.FindUserByEmail(address)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return address, category, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	prefs := user.Notifications
+	switch category {
+	case models.EmailReceipts:
+		prefs.NoReceipts = true
+	case models.EmailUpdates:
+		prefs.NoUpdates = true
+	}
+	return address, category, s.users.SetNotificationPrefs(ctx, user.ID, prefs)
+}
+
+// SetPrefs saves a user's notification settings. Turning a category back on
+// also lifts an unsubscribe from a link, but never a bounce or complaint.
+func (s *suppressions) SetPrefs(ctx context.Context, user *models.User, prefs models.NotificationPrefs) error {
+	if err := s.users.SetNotificationPrefs(ctx, user.ID, prefs); err != nil {
+		return err
+	}
+	user.Notifications = prefs
+
+	address := normalizeAddress(user.Email)
+	for _, category := range []models.EmailCategory{models.EmailReceipts, models.EmailUpdates} {
+		if !prefs.Allows(category) {
+			continue
+		}
+		if err := s.repo.DeleteSuppression(ctx, address, category); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookEvent is what a mail provider, or the adapter in front of it,
+// posts to the webhook:
+//
+//	{"type": "bounce", "email": "ada@example.com", "bounce_type": "hard", "detail": "550 no such user"}
+//	{"type": "complaint", "email": "ada@example.com"}
+//
+// signed with HMAC-SHA256 of the body under the webhook secret, in hex, in
+// the X-Email-Signature header.
+type webhookEvent struct {
+	Type       string `json:"type"`
+	Email      string `json:"email"`
+	BounceType string `json:"bounce_type"` // "hard" or "soft"
+	Detail     string `json:"detail"`
+}
+
+func (s *suppressions) HandleWebhook(ctx context.Context, r *http.Request) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if !validSignature(s.config.EmailWebhookSecret, body, r.Header.Get("X-Email-Signature")) {
+		return ErrInvalidSignature
+	}
+
+	var event webhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return err
+	}
+	address := normalizeAddress(event.Email)
+	if address == "" {
+		return fmt.Errorf("email webhook: no address in %q event", event.Type)
+	}
+
+	var reason models.SuppressionReason
+	switch event.Type {
+	case "bounce":
+		if event.BounceType == "soft" {
+			// Temporary, e.g. a full mailbox. The outbox retries these.
+			return nil
+		}
+		reason = models.SuppressionBounce
+	case "complaint":
+		reason = models.SuppressionComplaint
+	default:
+		slog.Info("Ignoring email webhook event", slog.String("type", event.Type))
+		return nil
+	}
+
+	slog.Warn("Suppressing email address", slog.String("email", address), slog.String("reason", string(reason)))
+	return s.repo.AddSuppression(ctx, &models.Suppression{
+		Email:  address,
+		Reason: reason,
+		Detail: event.Detail,
+	})
+}
+
+// validSignature reports whether signature is the hex HMAC-SHA256 of body
+// under secret. Without a secret nothing is valid.
+func validSignature(secret string, body []byte, signature string) bool {
+	if secret == "" {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// unsubscribeURL is the signed link that opts address out of category.
+func unsubscribeURL(cfg *config.Config, address string, category models.EmailCategory) string {
+	return fmt.Sprintf("%s/email/unsubscribe?token=%s", cfg.BaseURL, url.QueryEscape(unsubscribeToken(cfg.SessionSecret, address, category)))
+}
+
+// unsubscribeToken signs address and category so unsubscribe links can't
+// be made for someone else's address.
+func unsubscribeToken(secret, address string, category models.EmailCategory) string {
+	payload := []byte(normalizeAddress(address) + "\n" + string(category))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(unsubscribeMAC(secret, payload))
+}
+
+func parseUnsubscribeToken(secret, token string) (string, models.EmailCategory, error) {
+	encodedPayload, encodedMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", ErrInvalidUnsubscribe
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return "", "", ErrInvalidUnsubscribe
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(mac, unsubscribeMAC(secret, payload)) {
+		return "", "", ErrInvalidUnsubscribe
+	}
+
+	address, category, ok := strings.Cut(string(payload), "\n")
+	if !ok || address == "" {
+		return "", "", ErrInvalidUnsubscribe
+	}
+	switch models.EmailCategory(category) {
+	case models.EmailReceipts, models.EmailUpdates:
+		return address, models.EmailCategory(category), nil
+	default:
+		return "", "", ErrInvalidUnsubscribe
+	}
+}
+
+func unsubscribeMAC(secret string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte("unsubscribe:"+secret))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+func NewSuppressions(repo Repository, users UserStore, config *config.Config) Suppressions {
+	return &suppressions{repo: repo, users: users, config: config}
+}
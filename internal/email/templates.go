@@ -0,0 +1,135 @@
+package email
+
+import (
+	"bytes"
+	"embed"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed templates
+var files embed.FS
+
+// logoCID is the Content-ID the logo is attached under; the HTML layout
+// points at it with a cid: URL.
+const logoCID = "logo.png"
+
+// data is what a message template is executed with. Every message gets
+// BaseURL, Logo, Locale, Year and Subject on top of its own fields, and
+// UnsubscribeURL unless it is transactional. ActionLabel is a message key,
+// translated by the layout.
+type data map[string]any
+
+// Message is a rendered email.
+type Message struct {
+	Name        string // the template's, e.g. "verification"
+	Subject     string
+	HTML        string
+	Text        string
+	Category    models.EmailCategory
+	Unsubscribe string // one-click unsubscribe URL, unless transactional
+	Secret      bool   // the body holds a link that signs in or changes the account
+}
+
+// messageTemplate is one email: its HTML part inside layout.html and its
+// subject and text part inside layout.txt.
+type messageTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// templates holds every email by name, e.g. "verification" for
+// templates/verification.html and templates/verification.txt.
+var templates = mustLoadTemplates()
+
+// translateFuncs gives templates a t function translating messages into
+// locale, like the site's.
+func translateFuncs(locale string) map[string]any {
+	return map[string]any{
+		"t": func(key string, args ...any) string {
+			return i18n.T(locale, key, args...)
+		},
+	}
+}
+
+func mustLoadTemplates() map[string]*messageTemplate {
+	// t is bound to the recipient's locale in render; this one only lets the
+	// templates parse.
+	funcs := translateFuncs(i18n.Default)
+	htmlLayout := htmltemplate.Must(htmltemplate.New("layout.html").Funcs(funcs).ParseFS(files, "templates/layout.html"))
+	textLayout := texttemplate.Must(texttemplate.New("layout.txt").Funcs(funcs).ParseFS(files, "templates/layout.txt"))
+
+	names, err := fs.Glob(files, "templates/*.txt")
+	if err != nil {
+		panic(err)
+	}
+
+	loaded := make(map[string]*messageTemplate)
+	for _, path := range names {
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "templates/"), ".txt")
+		if name == "layout" {
+			continue
+		}
+		loaded[name] = &messageTemplate{
+			html: htmltemplate.Must(htmltemplate.Must(htmlLayout.Clone()).ParseFS(files, "templates/"+name+".html")),
+			text: texttemplate.Must(texttemplate.Must(textLayout.Clone()).ParseFS(files, "templates/"+name+".txt")),
+		}
+	}
+	return loaded
+}
+
+// render executes the email called name in locale. logo is where the HTML
+// part finds the logo: the inline attachment when sending, a URL when
+// previewing.
+func render(name, locale, baseURL, logo string, d data) (*Message, error) {
+	tmpl, ok := templates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown email %q", name)
+	}
+	if !i18n.Supported(locale) {
+		locale = i18n.Default
+	}
+
+	// Clone so concurrent sends in different locales don't share funcs.
+	htmlTmpl, err := tmpl.html.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("cloning %s html: %w", name, err)
+	}
+	htmlTmpl.Funcs(translateFuncs(locale))
+	textTmpl, err := tmpl.text.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("cloning %s text: %w", name, err)
+	}
+	textTmpl.Funcs(translateFuncs(locale))
+
+	full := data{"BaseURL": baseURL, "Logo": htmltemplate.URL(logo), "Locale": locale, "Year": time.Now().Year()}
+	for key, value := range d {
+		full[key] = value
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := textTmpl.ExecuteTemplate(&subject, "subject", full); err != nil {
+		return nil, fmt.Errorf("rendering %s subject: %w", name, err)
+	}
+	full["Subject"] = strings.TrimSpace(subject.String())
+
+	if err := textTmpl.ExecuteTemplate(&text, "layout.txt", full); err != nil {
+		return nil, fmt.Errorf("rendering %s text: %w", name, err)
+	}
+	if err := htmlTmpl.ExecuteTemplate(&html, "layout.html", full); err != nil {
+		return nil, fmt.Errorf("rendering %s html: %w", name, err)
+	}
+
+	return &Message{
+		Name:    name,
+		Subject: full["Subject"].(string),
+		HTML:    html.String(),
+		Text:    text.String(),
+	}, nil
+}
@@ -0,0 +1,319 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmj/config"
+	"fmj/internal/models"
+	"fmt"
+	"gopkg.in/mail.v2"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport delivers a rendered email.
+type Transport interface {
+	Name() string
+	Send(ctx context.Context, email *models.Email) error
+}
+
+// NewTransport returns the transport named by cfg.EmailTransport. Without
+// one, emails go over SMTP when SMTP_HOST is set and to files otherwise, so
+// development and CI never need a mail server.
+func NewTransport(cfg *config.Config) (Transport, error) {
+	name := cfg.EmailTransport
+	if name == "" {
+		name = "file"
+		if cfg.SMTPHost != "" {
+			name = "smtp"
+		}
+	}
+
+	switch name {
+	case "smtp":
+		return NewSMTPTransport(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.FromEmail, cfg.SMTPPoolSize), nil
+	case "file":
+		return NewFileTransport(cfg.EmailDir, cfg.FromEmail), nil
+	case "http":
+		if cfg.EmailAPIURL == "" {
+			return nil, fmt.Errorf("email transport %q needs EMAIL_API_URL", name)
+		}
+		return NewHTTPTransport(cfg.EmailAPIURL, cfg.EmailAPIKey, cfg.FromEmail), nil
+	default:
+		return nil, fmt.Errorf("unknown email transport %q", name)
+	}
+}
+
+// buildMessage makes email into a MIME message: multipart/alternative, text
+// first so clients that can't show HTML fall back to it, with the logo
+// attached inline.
+func buildMessage(from string, email *models.Email) *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("From", from)
+	m.SetHeader("To", email.To)
+	m.SetHeader("Subject", email.Subject)
+	if email.Unsubscribe != "" {
+		// One-click unsubscribe, as in RFC 8058.
+		m.SetHeader("List-Unsubscribe", "<"+email.Unsubscribe+">")
+		m.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+	m.SetBody("text/plain", email.Text)
+	m.AddAlternative("text/html", email.HTML)
+	m.Embed(logoCID, mail.SetCopyFunc(func(w io.Writer) error {
+		logo, err := files.ReadFile("templates/logo.png")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(logo)
+		return err
+	}))
+	return m
+}
+
+// smtpIdleTimeout is how long a pooled SMTP connection may sit unused
+// before it is closed rather than reused; most servers drop idle clients
+// after a minute or so.
+const smtpIdleTimeout = 30 * time.Second
+
+// SMTPTransport sends over SMTP, keeping up to a pool's worth of
+// connections open between emails instead of dialing for every one.
+type SMTPTransport struct {
+	dialer *mail.Dialer
+	from   string
+	idle   chan *smtpConn
+}
+
+type smtpConn struct {
+	mail.SendCloser
+	lastUsed time.Time
+}
+
+func NewSMTPTransport(host string, port int, username, password, from string, poolSize int) *SMTPTransport {
+	return &SMTPTransport{
+		dialer: mail.NewDialer(host, port, username, password),
+		from:   from,
+		idle:   make(chan *smtpConn, max(poolSize, 1)),
+	}
+}
+
+func (t *SMTPTransport) Name() string {
+	return "smtp"
+}
+
+func (t *SMTPTransport) Send(ctx context.Context, email *models.Email) error {
+	m := buildMessage(t.from, email)
+
+	conn, reused, err := t.get()
+	if err != nil {
+		return err
+	}
+	if err := mail.Send(conn, m); err != nil {
+		conn.Close()
+		if !reused {
+			return err
+		}
+		// The server may have hung up on the pooled connection; try once
+		// more on a new one.
+		if conn, err = t.dial(); err != nil {
+			return err
+		}
+		if err := mail.Send(conn, m); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	t.put(conn)
+	return nil
+}
+
+// get takes an idle connection from the pool, or dials a new one, and
+// reports whether it was reused.
+func (t *SMTPTransport) get() (*smtpConn, bool, error) {
+	for {
+		select {
+		case conn := <-t.idle:
+			if time.Since(conn.lastUsed) > smtpIdleTimeout {
+				conn.Close()
+				continue
+			}
+			return conn, true, nil
+		default:
+			conn, err := t.dial()
+			return conn, false, err
+		}
+	}
+}
+
+func (t *SMTPTransport) dial() (*smtpConn, error) {
+	sender, err := t.dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return &smtpConn{SendCloser: sender}, nil
+}
+
+// put returns conn to the pool, or closes it when the pool is full.
+func (t *SMTPTransport) put(conn *smtpConn) {
+	conn.lastUsed = time.Now()
+	select {
+	case t.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// FileTransport writes each email as an .eml file into a maildir, for
+// development and tests. Open the files in any mail client, or point one
+// at the directory.
+type FileTransport struct {
+	dir  string
+	from string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func NewFileTransport(dir, from string) *FileTransport {
+	return &FileTransport{dir: dir, from: from}
+}
+
+func (t *FileTransport) Name() string {
+	return "file"
+}
+
+// Send writes into tmp/ first and then moves the file into new/, as
+// maildir readers expect, so they never see half a message.
+func (t *FileTransport) Send(ctx context.Context, email *models.Email) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.dir, sub), 0o755); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	t.seq++
+	name := fmt.Sprintf("%d.%d_%d.%s.eml", time.Now().Unix(), os.Getpid(), t.seq, email.ID.Hex())
+	t.mu.Unlock()
+
+	tmp := filepath.Join(t.dir, "tmp", name)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := buildMessage(t.from, email).WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.dir, "new", name))
+}
+
+// HTTPTransport posts emails as JSON to an email API, or to a local
+// stand-in for one. The body is
+//
+//	{"from", "to", "subject", "html", "text", "headers": {...},
+//	 "attachments": [{"filename", "content_type", "content", "content_id"}]}
+//
+// with attachment content base64 encoded, sent with the key as a bearer
+// token. Any 2xx response counts as sent.
+type HTTPTransport struct {
+	url    string
+	key    string
+	from   string
+	client *http.Client
+}
+
+type httpAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"`
+	ContentID   string `json:"content_id,omitempty"` // set for inline images
+}
+
+type httpEmail struct {
+	From        string            `json:"from"`
+	To          string            `json:"to"`
+	Subject     string            `json:"subject"`
+	HTML        string            `json:"html"`
+	Text        string            `json:"text"`
+	Headers     map[string]string `json:"headers,omitempty"` // e.g. List-Unsubscribe
+	Attachments []httpAttachment  `json:"attachments,omitempty"`
+}
+
+func NewHTTPTransport(url, key, from string) *HTTPTransport {
+	return &HTTPTransport{
+		url:    url,
+		key:    key,
+		from:   from,
+		client: &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (t *HTTPTransport) Name() string {
+	return "http"
+}
+
+func (t *HTTPTransport) Send(ctx context.Context, email *models.Email) error {
+	logo, err := files.ReadFile("templates/logo.png")
+	if err != nil {
+		return err
+	}
+
+	var headers map[string]string
+	if email.Unsubscribe != "" {
+		headers = map[string]string{
+			"List-Unsubscribe":      "<" + email.Unsubscribe + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+	}
+
+	body, err := json.Marshal(httpEmail{
+		From:    t.from,
+		To:      email.To,
+		Subject: email.Subject,
+		HTML:    email.HTML,
+		Text:    email.Text,
+		Headers: headers,
+		Attachments: []httpAttachment{{
+			Filename:    logoCID,
+			ContentType: "image/png",
+			Content:     base64.StdEncoding.EncodeToString(logo),
+			ContentID:   logoCID,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.key != "" {
+		req.Header.Set("Authorization", "Bearer "+t.key)
+	}
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("email: %s: %s: %s", t.url, res.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
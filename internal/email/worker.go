@@ -0,0 +1,51 @@
+package email
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Worker sends queued emails in the background with a pool of senders.
+type Worker struct {
+	outbox   Outbox
+	size     int
+	interval time.Duration
+}
+
+// NewWorker runs size senders, each checking the outbox every interval
+// once it has run dry.
+func NewWorker(outbox Outbox, size int, interval time.Duration) *Worker {
+	return &Worker{outbox: outbox, size: size, interval: interval}
+}
+
+// Start runs the senders until ctx is done.
+func (w *Worker) Start(ctx context.Context) {
+	for i := 0; i < w.size; i++ {
+		go w.run(ctx)
+	}
+}
+
+func (w *Worker) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			sent, err := w.outbox.SendNext(ctx, time.Now())
+			if err != nil {
+				slog.Error("Error sending queued email", slog.String("error", err.Error()))
+				break
+			}
+			if !sent {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Package fx converts money between currencies using exchange rates from a
+// pluggable provider, cached locally so pages never wait on the network.
+package fx
+
+import (
+	"context"
+	"encoding/json"
+	"fmj/config"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BaseCurrency is the currency every rate table is quoted against.
+const BaseCurrency = "USD"
+
+// Rates maps a currency to how much of it one unit of BaseCurrency buys.
+type Rates map[string]*big.Rat
+
+// RateProvider fetches current exchange rates.
+type RateProvider interface {
+	Name() string
+	FetchRates(ctx context.Context) (Rates, error)
+}
+
+// NewProvider returns the provider named by cfg.FXProvider.
+func NewProvider(cfg *config.Config) (RateProvider, error) {
+	switch cfg.FXProvider {
+	case "", "static":
+		return NewStaticProvider(cfg.FXStaticRates)
+	case "http":
+		return NewHTTPProvider(cfg.FXRatesURL), nil
+	default:
+		return nil, fmt.Errorf("unknown exchange rate provider %q", cfg.FXProvider)
+	}
+}
+
+// StaticProvider serves a fixed table, for development and offline use.
+type StaticProvider struct {
+	rates Rates
+}
+
+// NewStaticProvider parses a table such as "NGN=1550,GHS=15.2", quoted
+// against BaseCurrency.
+func NewStaticProvider(table string) (*StaticProvider, error) {
+	rates := Rates{BaseCurrency: big.NewRat(1, 1)}
+	for _, entry := range strings.Split(table, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		code, value, ok := strings.Cut(entry, "=")
+		rate, valid := new(big.Rat).SetString(strings.TrimSpace(value))
+		if !ok || !valid || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("fx: invalid static rate %q", entry)
+		}
+		rates[strings.ToUpper(strings.TrimSpace(code))] = rate
+	}
+	return &StaticProvider{rates: rates}, nil
+}
+
+func (p *StaticProvider) Name() string {
+	return "static"
+}
+
+func (p *StaticProvider) FetchRates(ctx context.Context) (Rates, error) {
+	return p.rates, nil
+}
+
+// HTTPProvider fetches rates from an open.er-api.com compatible endpoint,
+// which answers GET {url}/{base} with {"result": "success", "rates": {...}}.
+type HTTPProvider struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPProvider(url string) *HTTPProvider {
+	return &HTTPProvider{
+		url:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *HTTPProvider) Name() string {
+	return "http"
+}
+
+func (p *HTTPProvider) FetchRates(ctx context.Context) (Rates, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+"/"+BaseCurrency, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fx: %s: %s", p.url, res.Status)
+	}
+
+	var body struct {
+		Result string                 `json:"result"`
+		Rates  map[string]json.Number `json:"rates"`
+	}
+	decoder := json.NewDecoder(io.LimitReader(res.Body, 1<<20))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Result != "success" {
+		return nil, fmt.Errorf("fx: %s: result %q", p.url, body.Result)
+	}
+
+	rates := make(Rates, len(body.Rates))
+	for code, value := range body.Rates {
+		rate, ok := new(big.Rat).SetString(value.String())
+		if !ok || rate.Sign() <= 0 {
+			continue
+		}
+		rates[code] = rate
+	}
+	return rates, nil
+}
@@ -0,0 +1,60 @@
+package fx
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math/big"
+	"time"
+)
+
+// Repository stores the last rate table fetched, so a restart or a provider
+// outage doesn't leave us without rates.
+type Repository interface {
+	SaveRates(ctx context.Context, rates Rates, fetchedAt time.Time) error
+	FindRates(ctx context.Context) (Rates, time.Time, error)
+}
+
+type repository struct {
+	db *mongo.Database
+}
+
+// rateDocument keeps rates as exact decimal strings.
+type rateDocument struct {
+	Base      string            `bson:"_id"`
+	Rates     map[string]string `bson:"rates"`
+	FetchedAt time.Time         `bson:"fetched_at"`
+}
+
+func (r repository) SaveRates(ctx context.Context, rates Rates, fetchedAt time.Time) error {
+	doc := rateDocument{Base: BaseCurrency, Rates: make(map[string]string, len(rates)), FetchedAt: fetchedAt}
+	for code, rate := range rates {
+		doc.Rates[code] = rate.RatString()
+	}
+	_, err := r.db.Collection("exchange_rates").ReplaceOne(
+		ctx,
+		bson.M{"_id": BaseCurrency},
+		doc,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (r repository) FindRates(ctx context.Context) (Rates, time.Time, error) {
+	var doc rateDocument
+	if err := r.db.Collection("exchange_rates").FindOne(ctx, bson.M{"_id": BaseCurrency}).Decode(&doc); err != nil {
+		return nil, time.Time{}, err
+	}
+	rates := make(Rates, len(doc.Rates))
+	for code, value := range doc.Rates {
+		if rate, ok := new(big.Rat).SetString(value); ok {
+			rates[code] = rate
+		}
+	}
+	return rates, doc.FetchedAt, nil
+}
+
+func NewRepository(db *mongo.Database) Repository {
+	return &repository{db}
+}
@@ -0,0 +1,150 @@
+package fx
+
+import (
+	"context"
+	"errors"
+	"fmj/internal/money"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// ErrNoRate is returned when there is no rate for a currency.
+var ErrNoRate = errors.New("fx: no exchange rate")
+
+// ratesTTL is how long a rate table is used before fetching a new one.
+const ratesTTL = 6 * time.Hour
+
+type Service interface {
+	Convert(ctx context.Context, m money.Money, to string) (money.Money, error)
+	Sum(ctx context.Context, amounts []money.Money, to string) (money.Money, error)
+}
+
+type service struct {
+	provider RateProvider
+	repo     Repository
+
+	mu        sync.Mutex
+	rates     Rates
+	fetchedAt time.Time
+}
+
+// Convert returns m in currency to, rounded to the nearest minor unit.
+// Conversions are for display; money only ever moves in the currency it was
+// paid in.
+func (s *service) Convert(ctx context.Context, m money.Money, to string) (money.Money, error) {
+	if m.Currency == to {
+		return m, nil
+	}
+	rates, err := s.currentRates(ctx)
+	if err != nil {
+		return money.Money{}, err
+	}
+	fromRate, ok := rates[m.Currency]
+	if !ok {
+		return money.Money{}, fmt.Errorf("%w for %s", ErrNoRate, m.Currency)
+	}
+	toRate, ok := rates[to]
+	if !ok {
+		return money.Money{}, fmt.Errorf("%w for %s", ErrNoRate, to)
+	}
+	fromCurrency, ok := money.Lookup(m.Currency)
+	if !ok {
+		return money.Money{}, fmt.Errorf("fx: unsupported currency %s", m.Currency)
+	}
+	toCurrency, ok := money.Lookup(to)
+	if !ok {
+		return money.Money{}, fmt.Errorf("fx: unsupported currency %s", to)
+	}
+
+	// minor * (toRate / fromRate) * 10^(toExp - fromExp)
+	amount := new(big.Rat).SetInt64(m.Minor)
+	amount.Mul(amount, toRate)
+	amount.Quo(amount, fromRate)
+	amount.Mul(amount, scale(toCurrency.Exponent-fromCurrency.Exponent))
+	return money.New(round(amount), to), nil
+}
+
+// Sum converts every amount to currency to and adds them up.
+func (s *service) Sum(ctx context.Context, amounts []money.Money, to string) (money.Money, error) {
+	total := money.New(0, to)
+	for _, amount := range amounts {
+		converted, err := s.Convert(ctx, amount, to)
+		if err != nil {
+			return money.Money{}, err
+		}
+		if total, err = total.Add(converted); err != nil {
+			return money.Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// currentRates returns the cached table, refreshing it from the stored copy
+// or the provider once it is older than ratesTTL. A stale table is better
+// than none, so refresh failures fall back to it.
+func (s *service) currentRates(ctx context.Context) (Rates, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rates != nil && time.Since(s.fetchedAt) < ratesTTL {
+		return s.rates, nil
+	}
+
+	if rates, fetchedAt, err := s.repo.FindRates(ctx); err == nil && fetchedAt.After(s.fetchedAt) {
+		s.rates, s.fetchedAt = rates, fetchedAt
+		if time.Since(fetchedAt) < ratesTTL {
+			return s.rates, nil
+		}
+	}
+
+	rates, err := s.provider.FetchRates(ctx)
+	if err != nil {
+		if s.rates != nil {
+			slog.Warn("Using stale exchange rates", slog.String("provider", s.provider.Name()), slog.String("error", err.Error()))
+			return s.rates, nil
+		}
+		return nil, err
+	}
+
+	s.rates, s.fetchedAt = rates, time.Now()
+	if err := s.repo.SaveRates(ctx, rates, s.fetchedAt); err != nil {
+		slog.Error("Error saving exchange rates", slog.String("error", err.Error()))
+	}
+	return s.rates, nil
+}
+
+// scale returns 10^n as a rational, for any sign of n.
+func scale(n int) *big.Rat {
+	p := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(n))), nil)
+	if n < 0 {
+		return new(big.Rat).SetFrac(big.NewInt(1), p)
+	}
+	return new(big.Rat).SetInt(p)
+}
+
+// round rounds r to the nearest integer, halves away from zero.
+func round(r *big.Rat) int64 {
+	num := new(big.Int).Set(r.Num())
+	den := r.Denom()
+	half := new(big.Int).Quo(den, big.NewInt(2))
+	if num.Sign() < 0 {
+		num.Sub(num, half)
+	} else {
+		num.Add(num, half)
+	}
+	return num.Quo(num, den).Int64()
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func NewService(provider RateProvider, repo Repository) Service {
+	return &service{provider: provider, repo: repo}
+}
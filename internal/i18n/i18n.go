@@ -0,0 +1,175 @@
+// Package i18n translates the site and its emails. Messages live in one JSON
+// catalog per locale under locales/, keyed by dotted names such as
+// "nav.login", with {name} placeholders filled in by T.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed locales/*.json
+var files embed.FS
+
+// Default is the locale used when nothing better is known, and where missing
+// messages are looked up.
+const Default = "en"
+
+// Cookie is the cookie that remembers the language a visitor picked.
+const Cookie = "lang"
+
+// Language is a locale people can pick.
+type Language struct {
+	Code string
+	Name string // in the language itself, e.g. "Français"
+}
+
+// Languages lists the supported locales in the order they are offered.
+var Languages = []Language{
+	{Code: "en", Name: "English"},
+	{Code: "fr", Name: "Français"},
+	{Code: "pcm", Name: "Naijá"},
+	{Code: "sw", Name: "Kiswahili"},
+	{Code: "yo", Name: "Yorùbá"},
+}
+
+// catalogs holds every locale's messages by key.
+var catalogs = mustLoadCatalogs()
+
+func mustLoadCatalogs() map[string]map[string]string {
+	loaded := make(map[string]map[string]string)
+	for _, language := range Languages {
+		raw, err := fs.ReadFile(files, "locales/"+language.Code+".json")
+		if err != nil {
+			panic(err)
+		}
+		messages := make(map[string]string)
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			panic(fmt.Errorf("parsing %s catalog: %w", language.Code, err))
+		}
+		loaded[language.Code] = messages
+	}
+	return loaded
+}
+
+// Supported reports whether locale has a catalog.
+func Supported(locale string) bool {
+	_, ok := catalogs[locale]
+	return ok
+}
+
+// T returns the message key in locale, falling back to English and then to
+// the key itself. args are name and value pairs for the message's
+// placeholders, e.g. T("fr", "wall.replied", "name", "Ada").
+func T(locale, key string, args ...any) string {
+	message, ok := catalogs[locale][key]
+	if !ok {
+		message, ok = catalogs[Default][key]
+	}
+	if !ok {
+		return key
+	}
+
+	if len(args) == 0 {
+		return message
+	}
+	pairs := make([]string, 0, len(args))
+	for i := 0; i+1 < len(args); i += 2 {
+		pairs = append(pairs, "{"+fmt.Sprint(args[i])+"}", fmt.Sprint(args[i+1]))
+	}
+	return strings.NewReplacer(pairs...).Replace(message)
+}
+
+// Error is an error meant for people: a message key and its placeholder
+// arguments, shown in their locale by Message. Error() is the English
+// message, for logs.
+type Error struct {
+	Key  string
+	Args []any
+}
+
+// NewError returns an Error for the message key, e.g.
+// NewError("payouts.error.minimum", "amount", minimum).
+func NewError(key string, args ...any) *Error {
+	return &Error{Key: key, Args: args}
+}
+
+func (e *Error) Error() string {
+	return T(Default, e.Key, e.Args...)
+}
+
+// localeFormatter is a value that formats itself for a locale, like
+// money.Money.
+type localeFormatter interface {
+	Format(locale string) string
+}
+
+// Message returns err as it should be shown in locale: translated if it is or
+// wraps an *Error, and err.Error() otherwise.
+func Message(locale string, err error) string {
+	var e *Error
+	if !errors.As(err, &e) {
+		return err.Error()
+	}
+	args := make([]any, len(e.Args))
+	for i, arg := range e.Args {
+		if value, ok := arg.(localeFormatter); ok {
+			arg = value.Format(locale)
+		}
+		args[i] = arg
+	}
+	return T(locale, e.Key, args...)
+}
+
+// Date formats t as a day, month and year in locale, e.g. "3 mars 2025".
+func Date(locale string, t time.Time) string {
+	month := T(locale, "month."+strconv.Itoa(int(t.Month())))
+	return fmt.Sprintf("%d %s %d", t.Day(), month, t.Year())
+}
+
+// Negotiate picks the best supported locale from an Accept-Language header,
+// matching "fr-CA" to "fr" when there is no exact match. It returns Default
+// when nothing matches.
+func Negotiate(acceptLanguage string) string {
+	type preference struct {
+		tag string
+		q   float64
+	}
+
+	var preferences []preference
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			preferences = append(preferences, preference{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(preferences, func(i, j int) bool { return preferences[i].q > preferences[j].q })
+
+	for _, p := range preferences {
+		if Supported(p.tag) {
+			return p.tag
+		}
+		if base, _, _ := strings.Cut(p.tag, "-"); Supported(base) {
+			return base
+		}
+	}
+	return Default
+}
@@ -0,0 +1,90 @@
+package ledger
+
+import (
+	"errors"
+	"fmj/internal/creators"
+	"fmj/internal/utils"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// recentEntries is how many ledger entries the balance page shows.
+const recentEntries = 50
+
+type Handler struct {
+	service  Service
+	creators creators.Service
+}
+
+func NewHandler(service Service, creatorService creators.Service) *Handler {
+	return &Handler{service: service, creators: creatorService}
+}
+
+// RegisterDashboardRoutes registers the creator's balance page. r must
+// already require authentication.
+func (h *Handler) RegisterDashboardRoutes(r *gin.RouterGroup) {
+	r.GET("/dashboard/balance", h.ShowBalance)
+}
+
+// RegisterAdminRoutes registers the ledger check. r must already require
+// the admin role.
+func (h *Handler) RegisterAdminRoutes(r *gin.RouterGroup) {
+	r.GET("/admin/ledger", h.ShowCheck)
+}
+
+func (h *Handler) ShowBalance(c *gin.Context) {
+	balancePage := filepath.Join("templates", "pages", "dashboard_balance.html")
+	user := utils.CurrentUser(c)
+
+	creator, err := h.creators.GetByUser(c, user.ID)
+	if errors.Is(err, creators.ErrCreatorNotFound) {
+		utils.RenderDashboard(c, balancePage, nil)
+		return
+	}
+	if err != nil {
+		slog.Error("Error loading creator", slog.String("user_id", user.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	balances, err := h.service.Balances(c, creator.ID)
+	if err != nil {
+		slog.Error("Error loading balance", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	entries, err := h.service.RecentEntries(c, creator.ID, recentEntries)
+	if err != nil {
+		slog.Error("Error loading ledger entries", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Creator":  creator,
+		"Balances": balances,
+		"Entries":  entries,
+		"Now":      time.Now(),
+	}
+	utils.RenderDashboard(c, balancePage, data)
+}
+
+func (h *Handler) ShowCheck(c *gin.Context) {
+	checkPage := filepath.Join("templates", "pages", "admin_ledger.html")
+
+	violations, err := h.service.CheckInvariants(c)
+	if err != nil {
+		slog.Error("Error checking ledger", slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Violations": violations,
+		"CheckedAt":  time.Now(),
+	}
+	utils.RenderDashboard(c, checkPage, data)
+}
@@ -0,0 +1,307 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmj/internal/models"
+	"fmj/internal/money"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// ErrInsufficientFunds is returned by RecordDebit when a transaction would
+// take more from an account than it has available.
+var ErrInsufficientFunds = errors.New("ledger: not enough available")
+
+// AccountTotal is the sum of the postings to an account in one currency.
+type AccountTotal struct {
+	Account  string
+	Currency string
+	Minor    int64
+}
+
+type Repository interface {
+	Record(ctx context.Context, tx *models.LedgerTransaction) (bool, error)
+	RecordDebit(ctx context.Context, tx *models.LedgerTransaction, account string) (bool, error)
+	RecordedDonationReferences(ctx context.Context) (map[string]bool, error)
+	FindTransactionsByAccount(ctx context.Context, account string, limit int64) ([]*models.LedgerTransaction, error)
+	AccountBalance(ctx context.Context, account string, now time.Time) (available, pending []money.Money, err error)
+	UnbalancedTransactions(ctx context.Context) ([]*models.LedgerTransaction, error)
+	PostingTotals(ctx context.Context) ([]AccountTotal, error)
+	FindAccounts(ctx context.Context) ([]*models.LedgerAccount, error)
+	RequireReplicaSet(ctx context.Context) error
+	EnsureIndexes(ctx context.Context) error
+}
+
+type repository struct {
+	db *mongo.Database
+}
+
+// Record writes a ledger transaction and updates the balances of the
+// accounts it touches, all in one database transaction. It reports false
+// when a transaction with the same reference was already recorded.
+func (r repository) Record(ctx context.Context, tx *models.LedgerTransaction) (bool, error) {
+	return r.record(ctx, tx, nil)
+}
+
+// RecordDebit records tx like Record, unless it would leave the credit
+// balance account has available below zero in a currency tx posts to it,
+// in which case nothing is written and it returns ErrInsufficientFunds. The balance is
+// checked inside the same transaction, and concurrent debits conflict on
+// the account's document, so two can't both spend the same money.
+func (r repository) RecordDebit(ctx context.Context, tx *models.LedgerTransaction, account string) (bool, error) {
+	debited := make(map[string]bool)
+	for _, posting := range tx.Postings {
+		if posting.Account == account {
+			debited[posting.Amount.Currency] = true
+		}
+	}
+	return r.record(ctx, tx, func(sc mongo.SessionContext) error {
+		available, _, err := r.AccountBalance(sc, account, tx.CreatedAt)
+		if err != nil {
+			return err
+		}
+		for _, m := range available {
+			// A credit balance below zero sums to more than zero.
+			if debited[m.Currency] && m.Minor > 0 {
+				return ErrInsufficientFunds
+			}
+		}
+		return nil
+	})
+}
+
+// record writes tx and its balance updates in a transaction, then runs
+// check, if any, aborting when it fails.
+func (r repository) record(ctx context.Context, tx *models.LedgerTransaction, check func(mongo.SessionContext) error) (bool, error) {
+	session, err := r.db.Client().StartSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.EndSession(ctx)
+
+	tx.CreatedAt = time.Now()
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		result, err := r.db.Collection("ledger_transactions").InsertOne(sc, tx)
+		if err != nil {
+			return nil, err
+		}
+		for _, posting := range tx.Postings {
+			_, err := r.db.Collection("ledger_accounts").UpdateOne(
+				sc,
+				bson.M{"_id": posting.Account},
+				bson.M{
+					"$inc": bson.M{"balances." + posting.Amount.Currency: posting.Amount.Minor},
+					"$set": bson.M{"updated_at": tx.CreatedAt},
+				},
+				options.Update().SetUpsert(true),
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if check != nil {
+			if err := check(sc); err != nil {
+				return nil, err
+			}
+		}
+		return result.InsertedID, nil
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RecordedDonationReferences returns the references of the ledger
+// transactions recorded for donations, e.g. "donation:<id>" and
+// "refund:<id>".
+func (r repository) RecordedDonationReferences(ctx context.Context) (map[string]bool, error) {
+	references, err := r.db.Collection("ledger_transactions").Distinct(ctx, "reference", bson.M{"donation_id": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[string]bool, len(references))
+	for _, reference := range references {
+		if s, ok := reference.(string); ok {
+			recorded[s] = true
+		}
+	}
+	return recorded, nil
+}
+
+// FindTransactionsByAccount returns the most recent ledger transactions
+// posting to account, newest first.
+func (r repository) FindTransactionsByAccount(ctx context.Context, account string, limit int64) ([]*models.LedgerTransaction, error) {
+	cursor, err := r.db.Collection("ledger_transactions").Find(
+		ctx,
+		bson.M{"postings.account": account},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var transactions []*models.LedgerTransaction
+	if err := cursor.All(ctx, &transactions); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// AccountBalance sums the postings to an account in each currency, split by
+// whether they are available at now. Amounts keep the ledger's sign: debits
+// positive, credits negative.
+func (r repository) AccountBalance(ctx context.Context, account string, now time.Time) (available, pending []money.Money, err error) {
+	cursor, err := r.db.Collection("ledger_transactions").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"postings.account": account}}},
+		{{Key: "$unwind", Value: "$postings"}},
+		{{Key: "$match", Value: bson.M{"postings.account": account}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"currency": "$postings.amount.currency",
+				"pending":  bson.M{"$gt": bson.A{"$postings.available_at", now}},
+			},
+			"minor": bson.M{"$sum": "$postings.amount.minor"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.currency", Value: 1}}}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				Currency string `bson:"currency"`
+				Pending  bool   `bson:"pending"`
+			} `bson:"_id"`
+			Minor int64 `bson:"minor"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, nil, err
+		}
+		if row.ID.Pending {
+			pending = append(pending, money.New(row.Minor, row.ID.Currency))
+		} else {
+			available = append(available, money.New(row.Minor, row.ID.Currency))
+		}
+	}
+	return available, pending, cursor.Err()
+}
+
+// UnbalancedTransactions returns the transactions whose postings don't sum
+// to zero in some currency.
+func (r repository) UnbalancedTransactions(ctx context.Context) ([]*models.LedgerTransaction, error) {
+	cursor, err := r.db.Collection("ledger_transactions").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unwind", Value: "$postings"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"tx": "$_id", "currency": "$postings.amount.currency"},
+			"minor": bson.M{"$sum": "$postings.amount.minor"},
+		}}},
+		{{Key: "$match", Value: bson.M{"minor": bson.M{"$ne": 0}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$_id.tx"}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         "ledger_transactions",
+			"localField":   "_id",
+			"foreignField": "_id",
+			"as":           "tx",
+		}}},
+		{{Key: "$unwind", Value: "$tx"}},
+		{{Key: "$replaceWith", Value: "$tx"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var transactions []*models.LedgerTransaction
+	if err := cursor.All(ctx, &transactions); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// PostingTotals sums every account's postings in each currency.
+func (r repository) PostingTotals(ctx context.Context) ([]AccountTotal, error) {
+	cursor, err := r.db.Collection("ledger_transactions").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unwind", Value: "$postings"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"account": "$postings.account", "currency": "$postings.amount.currency"},
+			"minor": bson.M{"$sum": "$postings.amount.minor"},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var totals []AccountTotal
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				Account  string `bson:"account"`
+				Currency string `bson:"currency"`
+			} `bson:"_id"`
+			Minor int64 `bson:"minor"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, err
+		}
+		totals = append(totals, AccountTotal{Account: row.ID.Account, Currency: row.ID.Currency, Minor: row.Minor})
+	}
+	return totals, cursor.Err()
+}
+
+func (r repository) FindAccounts(ctx context.Context) ([]*models.LedgerAccount, error) {
+	cursor, err := r.db.Collection("ledger_accounts").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var accounts []*models.LedgerAccount
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// RequireReplicaSet fails unless MongoDB can run the transactions Record
+// needs, which a standalone server can't.
+func (r repository) RequireReplicaSet(ctx context.Context) error {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := r.db.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return err
+	}
+	// mongos answers "isdbgrid" and supports transactions too.
+	if hello.SetName == "" && hello.Msg != "isdbgrid" {
+		return errors.New("ledger: MongoDB is running standalone, but the ledger needs transactions; " +
+			"start mongod with --replSet, run rs.initiate() once and add replicaSet to MONGO_URI")
+	}
+	return nil
+}
+
+// EnsureIndexes also creates the collections Record writes to, since they
+// can't be created inside a transaction before MongoDB 4.4.
+func (r repository) EnsureIndexes(ctx context.Context) error {
+	err := r.db.CreateCollection(ctx, "ledger_accounts")
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists") {
+		return err
+	}
+
+	_, err = r.db.Collection("ledger_transactions").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "reference", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "postings.account", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	return err
+}
+
+func NewRepository(db *mongo.Database) Repository {
+	return &repository{db}
+}
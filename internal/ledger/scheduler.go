@@ -0,0 +1,47 @@
+package ledger
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Scheduler records postings the ledger missed and checks its invariants
+// in the background, logging any violation, so a broken ledger is noticed
+// before payouts go out.
+type Scheduler struct {
+	service   Service
+	donations DonationSource
+	interval  time.Duration
+}
+
+func NewScheduler(service Service, donations DonationSource, interval time.Duration) *Scheduler {
+	return &Scheduler{service: service, donations: donations, interval: interval}
+}
+
+// Start runs the scheduler every interval until ctx is done.
+func (s *Scheduler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.service.Reconcile(ctx, s.donations); err != nil {
+				slog.Error("Error reconciling ledger", slog.String("error", err.Error()))
+			}
+			violations, err := s.service.CheckInvariants(ctx)
+			if err != nil {
+				slog.Error("Error checking ledger", slog.String("error", err.Error()))
+			}
+			for _, violation := range violations {
+				slog.Error("Ledger invariant violated", slog.String("violation", violation))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
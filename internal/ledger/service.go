@@ -0,0 +1,472 @@
+package ledger
+
+import (
+	"context"
+	"fmj/config"
+	"fmj/internal/models"
+	"fmj/internal/money"
+	"fmj/internal/payments"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+const (
+	// PlatformFeesAccount collects the platform's fee on each donation.
+	PlatformFeesAccount = "platform:fees"
+	// PayoutsInTransitAccount holds payouts between the creator asking for
+	// them and the gateway sending them.
+	PayoutsInTransitAccount = "payouts:in_transit"
+)
+
+// CreatorAccount is what the platform owes a creator. It carries a credit
+// balance, so money owed shows up as a negative sum of postings.
+func CreatorAccount(creatorID primitive.ObjectID) string {
+	return "creator:" + creatorID.Hex()
+}
+
+// GatewayAccount is the money a gateway holds for the platform. Supporters
+// pay into it and payouts and refunds leave from it.
+func GatewayAccount(gateway string) string {
+	return "gateway:" + gateway
+}
+
+// Balance is what the platform owes a creator in one currency.
+type Balance struct {
+	Currency  string
+	Available money.Money // can be paid out now
+	Pending   money.Money // still in the hold period
+}
+
+// Total is the available and pending balance together.
+func (b Balance) Total() money.Money {
+	total, _ := b.Available.Add(b.Pending)
+	return total
+}
+
+// Entry is a ledger transaction as seen from a creator's account.
+type Entry struct {
+	*models.LedgerTransaction
+	Amount      money.Money // positive when it adds to what the creator is owed
+	AvailableAt time.Time
+}
+
+// DonationSource walks every settled donation. payments.Service satisfies
+// it.
+type DonationSource interface {
+	EachSettledDonation(ctx context.Context, fn func(*models.Donation) error) error
+}
+
+type Service interface {
+	RecordDonation(ctx context.Context, donation *models.Donation, gatewayFee money.Money) error
+	RecordRefund(ctx context.Context, donation *models.Donation, amount money.Money, reference string) error
+	RecordChargeback(ctx context.Context, donation *models.Donation, reference string) error
+	ReverseChargeback(ctx context.Context, donation *models.Donation, reference string) error
+	ReservePayout(ctx context.Context, creatorID primitive.ObjectID, amount money.Money, reference string) error
+	RecordPayout(ctx context.Context, creatorID primitive.ObjectID, amount money.Money, gateway, reference string) error
+	ReleasePayout(ctx context.Context, creatorID primitive.ObjectID, amount money.Money, reference string) error
+	DonationSettled(ctx context.Context, donation *models.Donation, tx *payments.Transaction) error
+	DonationStatusChanged(ctx context.Context, donation *models.Donation, from models.DonationStatus) error
+	Balances(ctx context.Context, creatorID primitive.ObjectID) ([]Balance, error)
+	RecentEntries(ctx context.Context, creatorID primitive.ObjectID, limit int64) ([]Entry, error)
+	CheckInvariants(ctx context.Context) ([]string, error)
+	Reconcile(ctx context.Context, donations DonationSource) error
+}
+
+type service struct {
+	repo   Repository
+	feeBPS int64
+	hold   time.Duration
+}
+
+// RecordDonation credits a creator with a donation, less the platform's
+// fee and whatever the gateway kept. The money stays pending for the hold
+// period, so refunds and chargebacks can still come out of it.
+func (s *service) RecordDonation(ctx context.Context, donation *models.Donation, gatewayFee money.Money) error {
+	paidAt := donation.PaidAt
+	if paidAt.IsZero() {
+		paidAt = time.Now()
+	}
+	availableAt := paidAt.Add(s.hold)
+
+	creator := CreatorAccount(donation.CreatorID)
+	gateway := GatewayAccount(donation.Gateway)
+	gross := donation.Amount
+
+	postings := []models.Posting{
+		{Account: gateway, Amount: gross},
+		{Account: creator, Amount: gross.Neg(), AvailableAt: availableAt},
+	}
+	if fee := money.New(gross.Minor*s.feeBPS/10000, gross.Currency); fee.Minor > 0 {
+		postings = append(postings,
+			models.Posting{Account: creator, Amount: fee, AvailableAt: availableAt},
+			models.Posting{Account: PlatformFeesAccount, Amount: fee.Neg()},
+		)
+	}
+	if gatewayFee.Minor > 0 && gatewayFee.Currency == gross.Currency {
+		postings = append(postings,
+			models.Posting{Account: creator, Amount: gatewayFee, AvailableAt: availableAt},
+			models.Posting{Account: gateway, Amount: gatewayFee.Neg()},
+		)
+	}
+
+	return s.record(ctx, &models.LedgerTransaction{
+		Reference:  donationReference(donation),
+		Kind:       models.LedgerDonation,
+		CreatorID:  donation.CreatorID,
+		DonationID: &donation.ID,
+		Memo:       donation.Reference,
+		Postings:   postings,
+	})
+}
+
+// RecordRefund takes a refunded amount back from the creator. Fees aren't
+// returned, so the creator bears the full amount.
+func (s *service) RecordRefund(ctx context.Context, donation *models.Donation, amount money.Money, reference string) error {
+	if amount.Currency != donation.Amount.Currency {
+		return fmt.Errorf("ledger: refund in %s for a donation in %s", amount.Currency, donation.Amount.Currency)
+	}
+	return s.takeBack(ctx, donation, models.LedgerRefund, amount, reference)
+}
+
+// RecordChargeback takes a disputed donation back from the creator, so it
+// can't be paid out while the chargeback is open.
+func (s *service) RecordChargeback(ctx context.Context, donation *models.Donation, reference string) error {
+	return s.takeBack(ctx, donation, models.LedgerChargeback, donation.Amount, reference)
+}
+
+// ReverseChargeback gives the creator back a donation whose chargeback was
+// won. It is available at once.
+func (s *service) ReverseChargeback(ctx context.Context, donation *models.Donation, reference string) error {
+	return s.record(ctx, &models.LedgerTransaction{
+		Reference:  reference,
+		Kind:       models.LedgerChargebackReversal,
+		CreatorID:  donation.CreatorID,
+		DonationID: &donation.ID,
+		Memo:       donation.Reference,
+		Postings: []models.Posting{
+			{Account: GatewayAccount(donation.Gateway), Amount: donation.Amount},
+			{Account: CreatorAccount(donation.CreatorID), Amount: donation.Amount.Neg(), AvailableAt: time.Now()},
+		},
+	})
+}
+
+// takeBack debits amount of donation from the creator's balance.
+func (s *service) takeBack(ctx context.Context, donation *models.Donation, kind models.LedgerKind, amount money.Money, reference string) error {
+	return s.record(ctx, &models.LedgerTransaction{
+		Reference:  reference,
+		Kind:       kind,
+		CreatorID:  donation.CreatorID,
+		DonationID: &donation.ID,
+		Memo:       donation.Reference,
+		Postings: []models.Posting{
+			{Account: CreatorAccount(donation.CreatorID), Amount: amount, AvailableAt: time.Now()},
+			{Account: GatewayAccount(donation.Gateway), Amount: amount.Neg()},
+		},
+	})
+}
+
+// ReservePayout takes a payout out of the creator's balance as soon as they
+// ask for it, so the same money can't be asked for twice. It returns
+// ErrInsufficientFunds when they don't have amount available.
+func (s *service) ReservePayout(ctx context.Context, creatorID primitive.ObjectID, amount money.Money, reference string) error {
+	tx := &models.LedgerTransaction{
+		Reference: reference,
+		Kind:      models.LedgerPayout,
+		CreatorID: creatorID,
+		Postings: []models.Posting{
+			{Account: CreatorAccount(creatorID), Amount: amount, AvailableAt: time.Now()},
+			{Account: PayoutsInTransitAccount, Amount: amount.Neg()},
+		},
+	}
+	if err := checkBalanced(tx); err != nil {
+		return err
+	}
+	_, err := s.repo.RecordDebit(ctx, tx, CreatorAccount(creatorID))
+	return err
+}
+
+// RecordPayout records a reserved payout leaving through gateway.
+func (s *service) RecordPayout(ctx context.Context, creatorID primitive.ObjectID, amount money.Money, gateway, reference string) error {
+	return s.record(ctx, &models.LedgerTransaction{
+		Reference: reference,
+		Kind:      models.LedgerPayoutSent,
+		CreatorID: creatorID,
+		Postings: []models.Posting{
+			{Account: PayoutsInTransitAccount, Amount: amount},
+			{Account: GatewayAccount(gateway), Amount: amount.Neg()},
+		},
+	})
+}
+
+// ReleasePayout gives a reserved payout back to the creator.
+func (s *service) ReleasePayout(ctx context.Context, creatorID primitive.ObjectID, amount money.Money, reference string) error {
+	return s.record(ctx, &models.LedgerTransaction{
+		Reference: reference,
+		Kind:      models.LedgerPayoutReversal,
+		CreatorID: creatorID,
+		Postings: []models.Posting{
+			{Account: PayoutsInTransitAccount, Amount: amount},
+			{Account: CreatorAccount(creatorID), Amount: amount.Neg(), AvailableAt: time.Now()},
+		},
+	})
+}
+
+// record checks a transaction balances before writing it. Recording a
+// reference that is already in the ledger does nothing.
+func (s *service) record(ctx context.Context, tx *models.LedgerTransaction) error {
+	if err := checkBalanced(tx); err != nil {
+		return err
+	}
+	_, err := s.repo.Record(ctx, tx)
+	return err
+}
+
+// checkBalanced returns an error unless tx's postings sum to zero in every
+// currency.
+func checkBalanced(tx *models.LedgerTransaction) error {
+	sums := make(map[string]int64)
+	for _, posting := range tx.Postings {
+		if posting.Amount.Currency == "" {
+			return fmt.Errorf("ledger: posting to %s has no currency", posting.Account)
+		}
+		sums[posting.Amount.Currency] += posting.Amount.Minor
+	}
+	for currency, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("ledger: %s doesn't balance in %s", tx.Reference, currency)
+		}
+	}
+	return nil
+}
+
+// DonationSettled records succeeded donations as payments settles them.
+func (s *service) DonationSettled(ctx context.Context, donation *models.Donation, tx *payments.Transaction) error {
+	if donation.Status != models.DonationSucceeded {
+		return nil
+	}
+	return s.RecordDonation(ctx, donation, tx.Fee)
+}
+
+// DonationStatusChanged records refunds and chargebacks as payments moves
+// settled donations on. A lost chargeback needs nothing more, as the money
+// was already taken back when it opened.
+func (s *service) DonationStatusChanged(ctx context.Context, donation *models.Donation, from models.DonationStatus) error {
+	switch {
+	case donation.Status == models.DonationRefunded:
+		return s.RecordRefund(ctx, donation, donation.Amount, refundReference(donation))
+	case donation.Status == models.DonationDisputed:
+		return s.RecordChargeback(ctx, donation, chargebackReference(donation))
+	case donation.Status == models.DonationSucceeded && from == models.DonationDisputed:
+		return s.ReverseChargeback(ctx, donation, chargebackReversalReference(donation))
+	}
+	return nil
+}
+
+// The references of a donation's ledger transactions. Recording one twice
+// does nothing, which is what lets Reconcile catch up safely.
+func donationReference(donation *models.Donation) string {
+	return "donation:" + donation.ID.Hex()
+}
+
+func refundReference(donation *models.Donation) string {
+	return "refund:" + donation.ID.Hex()
+}
+
+func chargebackReference(donation *models.Donation) string {
+	return "chargeback:" + donation.ID.Hex() + ":" + donation.Dispute.GatewayReference
+}
+
+func chargebackReversalReference(donation *models.Donation) string {
+	return "chargeback_reversal:" + donation.ID.Hex() + ":" + donation.Dispute.GatewayReference
+}
+
+// Balances returns what the platform owes a creator in each currency.
+func (s *service) Balances(ctx context.Context, creatorID primitive.ObjectID) ([]Balance, error) {
+	available, pending, err := s.repo.AccountBalance(ctx, CreatorAccount(creatorID), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	byCurrency := make(map[string]*Balance)
+	balance := func(currency string) *Balance {
+		if byCurrency[currency] == nil {
+			byCurrency[currency] = &Balance{
+				Currency:  currency,
+				Available: money.New(0, currency),
+				Pending:   money.New(0, currency),
+			}
+		}
+		return byCurrency[currency]
+	}
+	// Creator accounts carry credit balances, so flip the sign.
+	for _, m := range available {
+		balance(m.Currency).Available = m.Neg()
+	}
+	for _, m := range pending {
+		balance(m.Currency).Pending = m.Neg()
+	}
+
+	balances := make([]Balance, 0, len(byCurrency))
+	for _, b := range byCurrency {
+		balances = append(balances, *b)
+	}
+	sort.Slice(balances, func(i, j int) bool { return balances[i].Currency < balances[j].Currency })
+	return balances, nil
+}
+
+// RecentEntries returns the creator's latest ledger transactions with what
+// each did to their balance.
+func (s *service) RecentEntries(ctx context.Context, creatorID primitive.ObjectID, limit int64) ([]Entry, error) {
+	account := CreatorAccount(creatorID)
+	transactions, err := s.repo.FindTransactionsByAccount(ctx, account, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(transactions))
+	for _, tx := range transactions {
+		entry := Entry{LedgerTransaction: tx}
+		for _, posting := range tx.Postings {
+			if posting.Account != account {
+				continue
+			}
+			if entry.Amount.Currency == "" {
+				entry.Amount = money.New(0, posting.Amount.Currency)
+			}
+			if sum, err := entry.Amount.Add(posting.Amount.Neg()); err == nil {
+				entry.Amount = sum
+			}
+			entry.AvailableAt = posting.AvailableAt
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// CheckInvariants verifies the ledger: every transaction balances, so all
+// accounts together sum to zero in each currency, and every account's
+// stored balance matches the sum of its postings. It returns a description
+// of each violation found.
+func (s *service) CheckInvariants(ctx context.Context) ([]string, error) {
+	var violations []string
+
+	unbalanced, err := s.repo.UnbalancedTransactions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range unbalanced {
+		violations = append(violations, fmt.Sprintf("transaction %s doesn't balance", tx.Reference))
+	}
+
+	totals, err := s.repo.PostingTotals(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byCurrency := make(map[string]int64)
+	postings := make(map[string]map[string]int64)
+	for _, total := range totals {
+		byCurrency[total.Currency] += total.Minor
+		if postings[total.Account] == nil {
+			postings[total.Account] = make(map[string]int64)
+		}
+		postings[total.Account][total.Currency] = total.Minor
+	}
+	for currency, sum := range byCurrency {
+		if sum != 0 {
+			violations = append(violations, fmt.Sprintf("accounts sum to %s instead of zero", money.New(sum, currency)))
+		}
+	}
+
+	accounts, err := s.repo.FindAccounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]map[string]int64)
+	for _, account := range accounts {
+		stored[account.ID] = account.Balances
+	}
+	for account, sums := range postings {
+		for currency, sum := range sums {
+			if balance := stored[account][currency]; balance != sum {
+				violations = append(violations, fmt.Sprintf("account %s has a balance of %s but its postings sum to %s",
+					account, money.New(balance, currency), money.New(sum, currency)))
+			}
+		}
+	}
+	for account, balances := range stored {
+		for currency, balance := range balances {
+			if _, ok := postings[account][currency]; !ok && balance != 0 {
+				violations = append(violations, fmt.Sprintf("account %s has a balance of %s but no postings",
+					account, money.New(balance, currency)))
+			}
+		}
+	}
+
+	sort.Strings(violations)
+	return violations, nil
+}
+
+// Reconcile records what the ledger is missing for settled donations: ones
+// that settled before the ledger existed, and postings the settlement and
+// status listeners failed to write. Donations recorded here lost their
+// gateway fee, so they are recorded without one. Only a donation's latest
+// chargeback is known, so earlier ones can't be caught up.
+func (s *service) Reconcile(ctx context.Context, donations DonationSource) error {
+	recorded, err := s.repo.RecordedDonationReferences(ctx)
+	if err != nil {
+		return err
+	}
+	ensure := func(reference string, record func() error) error {
+		if recorded[reference] {
+			return nil
+		}
+		slog.Warn("Recording missing ledger transaction", slog.String("reference", reference))
+		return record()
+	}
+
+	return donations.EachSettledDonation(ctx, func(donation *models.Donation) error {
+		// Every settled donation succeeded first.
+		err := ensure(donationReference(donation), func() error {
+			return s.RecordDonation(ctx, donation, money.Money{})
+		})
+		if err != nil {
+			return err
+		}
+
+		if dispute := donation.Dispute; dispute != nil {
+			err := ensure(chargebackReference(donation), func() error {
+				return s.RecordChargeback(ctx, donation, chargebackReference(donation))
+			})
+			if err != nil {
+				return err
+			}
+			// A resolved chargeback that wasn't lost was won.
+			if !dispute.ResolvedAt.IsZero() && donation.Status != models.DonationLost {
+				err := ensure(chargebackReversalReference(donation), func() error {
+					return s.ReverseChargeback(ctx, donation, chargebackReversalReference(donation))
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if donation.Status == models.DonationRefunded {
+			return ensure(refundReference(donation), func() error {
+				return s.RecordRefund(ctx, donation, donation.Amount, refundReference(donation))
+			})
+		}
+		return nil
+	})
+}
+
+func NewService(repo Repository, cfg *config.Config) Service {
+	return &service{
+		repo:   repo,
+		feeBPS: int64(cfg.PlatformFeeBPS),
+		hold:   time.Duration(cfg.PayoutHoldDays) * 24 * time.Hour,
+	}
+}
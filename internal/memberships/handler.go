@@ -0,0 +1,307 @@
+package memberships
+
+import (
+	"context"
+	"errors"
+	"fmj/internal/creators"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmj/internal/money"
+	"fmj/internal/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Handler struct {
+	service  Service
+	creators creators.Service
+}
+
+func NewHandler(service Service, creatorService creators.Service) *Handler {
+	return &Handler{service: service, creators: creatorService}
+}
+
+// RegisterRoutes registers joining a creator from their page.
+func (h *Handler) RegisterRoutes(r *gin.Engine) {
+	r.POST("/:slug/join", h.Join)
+}
+
+// RegisterDashboardRoutes registers the supporter's and the creator's
+// membership pages. r must already require authentication.
+func (h *Handler) RegisterDashboardRoutes(r *gin.RouterGroup) {
+	r.GET("/dashboard/memberships", h.ShowMemberships)
+	r.POST("/dashboard/memberships/:id/cancel", h.Cancel)
+	r.POST("/dashboard/memberships/:id/resume", h.Resume)
+	r.GET("/dashboard/members", h.ShowMembers)
+	r.GET("/dashboard/tiers", h.ShowTiers)
+	r.POST("/dashboard/tiers", h.SaveTier)
+	r.POST("/dashboard/tiers/:id", h.SaveTier)
+	r.POST("/dashboard/tiers/:id/archive", h.ArchiveTier)
+	r.POST("/dashboard/tiers/:id/restore", h.RestoreTier)
+}
+
+func (h *Handler) Join(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	creator, err := h.creators.GetBySlug(c, c.Param("slug"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	user := utils.CurrentUser(c)
+	if user == nil {
+		data = map[string]interface{}{
+			"Error":         i18n.T(c.GetString(utils.LocaleKey), "toast.sign_in_to_join"),
+			"ErrorLink":     "/auth/login",
+			"ErrorLinkText": i18n.T(c.GetString(utils.LocaleKey), "auth.login.title"),
+		}
+		utils.Render(c, toastPage, data)
+		return
+	}
+
+	tierID, _ := primitive.ObjectIDFromHex(c.PostForm("tier"))
+	url, err := h.service.Join(c, creator, tierID, user)
+	if err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
+		}
+		if errors.Is(err, ErrAlreadyMember) {
+			data["ErrorLink"] = "/dashboard/memberships"
+			data["ErrorLinkText"] = i18n.T(c.GetString(utils.LocaleKey), "toast.see_memberships")
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error joining membership", slog.String("creator", creator.Slug), slog.String("error", err.Error()))
+		return
+	}
+
+	c.Header("HX-Redirect", url)
+}
+
+func (h *Handler) ShowMemberships(c *gin.Context) {
+	h.renderMemberships(c, "")
+}
+
+func (h *Handler) Cancel(c *gin.Context) {
+	h.updateMembership(c, h.service.Cancel)
+}
+
+func (h *Handler) Resume(c *gin.Context) {
+	h.updateMembership(c, h.service.Resume)
+}
+
+// updateMembership applies change to the supporter's membership in the URL.
+func (h *Handler) updateMembership(c *gin.Context, change func(context.Context, *models.User, primitive.ObjectID) error) {
+	user := utils.CurrentUser(c)
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err := change(c, user, id); err != nil {
+		if errors.Is(err, ErrSubscriptionNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		slog.Error("Error updating membership", slog.String("subscription_id", id.Hex()), slog.String("error", err.Error()))
+		h.renderMemberships(c, i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/memberships")
+}
+
+func (h *Handler) renderMemberships(c *gin.Context, errMsg string) {
+	membershipsPage := filepath.Join("templates", "pages", "dashboard_memberships.html")
+	user := utils.CurrentUser(c)
+
+	memberships, err := h.service.SupporterMemberships(c, user)
+	if err != nil {
+		slog.Error("Error loading memberships", slog.String("user_id", user.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Memberships": memberships,
+		"Now":         time.Now(),
+		"GracePeriod": GracePeriod,
+		"Error":       errMsg,
+	}
+	utils.RenderDashboard(c, membershipsPage, data)
+}
+
+func (h *Handler) ShowMembers(c *gin.Context) {
+	membersPage := filepath.Join("templates", "pages", "dashboard_members.html")
+
+	creator, ok := creators.Current(c, h.creators, membersPage)
+	if !ok {
+		return
+	}
+
+	members, err := h.service.CreatorMembers(c, creator)
+	if err != nil {
+		slog.Error("Error loading members", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Creator":     creator,
+		"Members":     members,
+		"Now":         time.Now(),
+		"GracePeriod": GracePeriod,
+	}
+	utils.RenderDashboard(c, membersPage, data)
+}
+
+// tierRow is one form on the tier editor. Tier is nil for a new tier. Submit
+// is the button's message key, e.g. "tiers.save".
+type tierRow struct {
+	Tier     *models.Tier
+	Form     TierForm
+	Action   string
+	Submit   string
+	Currency string
+}
+
+func (h *Handler) ShowTiers(c *gin.Context) {
+	tiersPage := filepath.Join("templates", "pages", "dashboard_tiers.html")
+
+	creator, ok := creators.Current(c, h.creators, tiersPage)
+	if !ok {
+		return
+	}
+	h.renderTiers(c, creator, primitive.NilObjectID, TierForm{}, "")
+}
+
+func (h *Handler) SaveTier(c *gin.Context) {
+	tiersPage := filepath.Join("templates", "pages", "dashboard_tiers.html")
+
+	creator, ok := creators.Current(c, h.creators, tiersPage)
+	if !ok {
+		return
+	}
+
+	var tierID primitive.ObjectID
+	if id := c.Param("id"); id != "" {
+		var err error
+		if tierID, err = primitive.ObjectIDFromHex(id); err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+	}
+
+	form := TierForm{
+		Name:        c.PostForm("name"),
+		Price:       c.PostForm("price"),
+		Description: c.PostForm("description"),
+		Benefits:    c.PostForm("benefits"),
+	}
+	if _, err := h.service.SaveTier(c, creator, tierID, form); err != nil {
+		if errors.Is(err, ErrTierNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		slog.Error("Error saving tier", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		// Show the form again with what the creator typed.
+		h.renderTiers(c, creator, tierID, form, i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/tiers?saved=1")
+}
+
+func (h *Handler) ArchiveTier(c *gin.Context) {
+	h.setTierArchived(c, true)
+}
+
+func (h *Handler) RestoreTier(c *gin.Context) {
+	h.setTierArchived(c, false)
+}
+
+func (h *Handler) setTierArchived(c *gin.Context, archived bool) {
+	tiersPage := filepath.Join("templates", "pages", "dashboard_tiers.html")
+
+	creator, ok := creators.Current(c, h.creators, tiersPage)
+	if !ok {
+		return
+	}
+	tierID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := h.service.SetTierArchived(c, creator, tierID, archived); err != nil {
+		if errors.Is(err, ErrTierNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		slog.Error("Error archiving tier", slog.String("tier_id", tierID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/tiers?saved=1")
+}
+
+// renderTiers shows the tier editor. draft replaces the stored values of
+// the tier with draftID, or fills the new tier form when draftID is nil.
+func (h *Handler) renderTiers(c *gin.Context, creator *models.Creator, draftID primitive.ObjectID, draft TierForm, errMsg string) {
+	tiersPage := filepath.Join("templates", "pages", "dashboard_tiers.html")
+
+	tiers, err := h.service.ListAllTiers(c, creator.ID)
+	if err != nil {
+		slog.Error("Error loading tiers", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	rows := make([]tierRow, 0, len(tiers))
+	for _, tier := range tiers {
+		form := TierForm{
+			Name:        tier.Name,
+			Price:       priceInput(tier.Price),
+			Description: tier.Description,
+			Benefits:    strings.Join(tier.Benefits, "\n"),
+		}
+		if tier.ID == draftID {
+			form = draft
+		}
+		rows = append(rows, tierRow{
+			Tier:     tier,
+			Form:     form,
+			Action:   "/dashboard/tiers/" + tier.ID.Hex(),
+			Submit:   "tiers.save",
+			Currency: creator.UnitPrice.Currency,
+		})
+	}
+
+	newTier := tierRow{Action: "/dashboard/tiers", Submit: "tiers.add", Currency: creator.UnitPrice.Currency}
+	if draftID.IsZero() {
+		newTier.Form = draft
+	}
+
+	data := map[string]interface{}{
+		"Creator": creator,
+		"Tiers":   rows,
+		"NewTier": newTier,
+		"CanAdd":  len(tiers) < maxTiers,
+		"Saved":   c.Query("saved") != "",
+		"Error":   errMsg,
+	}
+	utils.RenderDashboard(c, tiersPage, data)
+}
+
+// priceInput renders a price for a price input, e.g. "5000" or "2.50".
+func priceInput(price money.Money) string {
+	return strings.TrimSuffix(price.Major(), ".00")
+}
@@ -0,0 +1,222 @@
+package memberships
+
+import (
+	"context"
+	"fmj/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Repository interface {
+	CreateTier(ctx context.Context, tier *models.Tier) error
+	UpdateTier(ctx context.Context, tier *models.Tier) error
+	FindTierByID(ctx context.Context, id primitive.ObjectID) (*models.Tier, error)
+	FindTiersByCreator(ctx context.Context, creatorID primitive.ObjectID, includeArchived bool) ([]*models.Tier, error)
+	CreateSubscription(ctx context.Context, subscription *models.Subscription) error
+	UpdateSubscription(ctx context.Context, subscription *models.Subscription) error
+	FindSubscriptionByID(ctx context.Context, id primitive.ObjectID) (*models.Subscription, error)
+	FindLiveSubscription(ctx context.Context, supporterID, creatorID primitive.ObjectID) (*models.Subscription, error)
+	FindSubscriptionsBySupporter(ctx context.Context, supporterID primitive.ObjectID) ([]*models.Subscription, error)
+	FindSubscriptionsByCreator(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Subscription, error)
+	ClaimDueRenewal(ctx context.Context, now time.Time, lease time.Duration) (*models.Subscription, error)
+	EndCancelledSubscriptions(ctx context.Context, now time.Time) (int64, error)
+	EnsureIndexes(ctx context.Context) error
+}
+
+type repository struct {
+	db *mongo.Database
+}
+
+// liveStatuses are the statuses of subscriptions that haven't ended.
+var liveStatuses = bson.A{models.SubscriptionPending, models.SubscriptionActive, models.SubscriptionPastDue}
+
+func (r repository) CreateTier(ctx context.Context, tier *models.Tier) error {
+	tier.CreatedAt = time.Now()
+	tier.UpdatedAt = time.Now()
+
+	result, err := r.db.Collection("tiers").InsertOne(ctx, tier)
+	if err != nil {
+		return err
+	}
+	tier.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (r repository) UpdateTier(ctx context.Context, tier *models.Tier) error {
+	tier.UpdatedAt = time.Now()
+	_, err := r.db.Collection("tiers").ReplaceOne(
+		ctx,
+		bson.M{"_id": tier.ID},
+		tier,
+	)
+	return err
+}
+
+func (r repository) FindTierByID(ctx context.Context, id primitive.ObjectID) (*models.Tier, error) {
+	var tier models.Tier
+	err := r.db.Collection("tiers").FindOne(ctx, bson.M{"_id": id}).Decode(&tier)
+	if err != nil {
+		return nil, err
+	}
+	return &tier, nil
+}
+
+// FindTiersByCreator returns a creator's tiers, cheapest first.
+func (r repository) FindTiersByCreator(ctx context.Context, creatorID primitive.ObjectID, includeArchived bool) ([]*models.Tier, error) {
+	filter := bson.M{"creator_id": creatorID}
+	if !includeArchived {
+		filter["archived"] = false
+	}
+	cursor, err := r.db.Collection("tiers").Find(
+		ctx,
+		filter,
+		options.Find().SetSort(bson.D{{Key: "price.minor", Value: 1}, {Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var tiers []*models.Tier
+	if err := cursor.All(ctx, &tiers); err != nil {
+		return nil, err
+	}
+	return tiers, nil
+}
+
+func (r repository) CreateSubscription(ctx context.Context, subscription *models.Subscription) error {
+	subscription.CreatedAt = time.Now()
+	subscription.UpdatedAt = time.Now()
+
+	result, err := r.db.Collection("subscriptions").InsertOne(ctx, subscription)
+	if err != nil {
+		return err
+	}
+	subscription.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (r repository) UpdateSubscription(ctx context.Context, subscription *models.Subscription) error {
+	subscription.UpdatedAt = time.Now()
+	_, err := r.db.Collection("subscriptions").ReplaceOne(
+		ctx,
+		bson.M{"_id": subscription.ID},
+		subscription,
+	)
+	return err
+}
+
+func (r repository) FindSubscriptionByID(ctx context.Context, id primitive.ObjectID) (*models.Subscription, error) {
+	var subscription models.Subscription
+	err := r.db.Collection("subscriptions").FindOne(ctx, bson.M{"_id": id}).Decode(&subscription)
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// FindLiveSubscription returns the supporter's subscription to the creator
+// that hasn't ended, if any.
+func (r repository) FindLiveSubscription(ctx context.Context, supporterID, creatorID primitive.ObjectID) (*models.Subscription, error) {
+	var subscription models.Subscription
+	err := r.db.Collection("subscriptions").FindOne(ctx, bson.M{
+		"supporter_id": supporterID,
+		"creator_id":   creatorID,
+		"status":       bson.M{"$in": liveStatuses},
+	}).Decode(&subscription)
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+func (r repository) FindSubscriptionsBySupporter(ctx context.Context, supporterID primitive.ObjectID) ([]*models.Subscription, error) {
+	return r.findSubscriptions(ctx, bson.M{
+		"supporter_id": supporterID,
+		"status":       bson.M{"$ne": models.SubscriptionIncomplete},
+	})
+}
+
+func (r repository) FindSubscriptionsByCreator(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Subscription, error) {
+	return r.findSubscriptions(ctx, bson.M{
+		"creator_id": creatorID,
+		"status":     bson.M{"$nin": bson.A{models.SubscriptionPending, models.SubscriptionIncomplete}},
+	})
+}
+
+// findSubscriptions returns the matching subscriptions, newest first.
+func (r repository) findSubscriptions(ctx context.Context, filter bson.M) ([]*models.Subscription, error) {
+	cursor, err := r.db.Collection("subscriptions").Find(
+		ctx,
+		filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var subscriptions []*models.Subscription
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// ClaimDueRenewal picks one subscription due for a charge and pushes its
+// next charge back by lease, so no other worker picks it up meanwhile. It
+// returns mongo.ErrNoDocuments when nothing is due.
+func (r repository) ClaimDueRenewal(ctx context.Context, now time.Time, lease time.Duration) (*models.Subscription, error) {
+	var subscription models.Subscription
+	err := r.db.Collection("subscriptions").FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"status":               bson.M{"$in": bson.A{models.SubscriptionActive, models.SubscriptionPastDue}},
+			"cancel_at_period_end": false,
+			"next_charge_at":       bson.M{"$lte": now},
+		},
+		bson.M{"$set": bson.M{"next_charge_at": now.Add(lease), "updated_at": now}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_charge_at", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&subscription)
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// EndCancelledSubscriptions ends subscriptions cancelled by their supporter
+// once the paid-for period is over.
+func (r repository) EndCancelledSubscriptions(ctx context.Context, now time.Time) (int64, error) {
+	res, err := r.db.Collection("subscriptions").UpdateMany(
+		ctx,
+		bson.M{
+			"status":               bson.M{"$in": bson.A{models.SubscriptionActive, models.SubscriptionPastDue}},
+			"cancel_at_period_end": true,
+			"current_period_end":   bson.M{"$lte": now},
+		},
+		bson.M{"$set": bson.M{"status": models.SubscriptionCancelled, "ended_at": now, "updated_at": now}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (r repository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.db.Collection("tiers").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "creator_id", Value: 1}, {Key: "price.minor", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Collection("subscriptions").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "supporter_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "creator_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_charge_at", Value: 1}}},
+	})
+	return err
+}
+
+func NewRepository(db *mongo.Database) Repository {
+	return &repository{db}
+}
@@ -0,0 +1,38 @@
+package memberships
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Scheduler renews memberships in the background. Renewals are claimed one
+// at a time, so running it on several servers is safe.
+type Scheduler struct {
+	service  Service
+	interval time.Duration
+}
+
+func NewScheduler(service Service, interval time.Duration) *Scheduler {
+	return &Scheduler{service: service, interval: interval}
+}
+
+// Start runs the scheduler every interval until ctx is done.
+func (s *Scheduler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.service.RenewDue(ctx, time.Now()); err != nil {
+				slog.Error("Error renewing memberships", slog.String("error", err.Error()))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
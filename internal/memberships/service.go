@@ -0,0 +1,485 @@
+package memberships
+
+import (
+	"context"
+	"errors"
+	"fmj/internal/creators"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmj/internal/money"
+	"fmj/internal/payments"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// ErrTierNotFound is returned when no tier matches.
+var ErrTierNotFound = i18n.NewError("memberships.error.tier_not_found")
+
+// ErrSubscriptionNotFound is returned when no subscription matches, or it
+// belongs to someone else.
+var ErrSubscriptionNotFound = i18n.NewError("memberships.error.not_found")
+
+// ErrAlreadyMember is returned when joining a creator the supporter is
+// already a member of.
+var ErrAlreadyMember = i18n.NewError("memberships.error.already_member")
+
+const (
+	maxTiers                 = 10
+	maxTierNameLength        = 60
+	maxTierDescriptionLength = 1000
+	maxBenefits              = 10
+	maxBenefitLength         = 200
+
+	// GracePeriod is how long members keep their benefits while a failed
+	// renewal is retried.
+	GracePeriod = 7 * 24 * time.Hour
+
+	// renewalLease keeps a renewal from being picked up twice while it is
+	// being charged.
+	renewalLease = time.Hour
+
+	// pendingChargeWait is how long to wait for the gateway to settle a
+	// renewal before asking it again.
+	pendingChargeWait = 6 * time.Hour
+)
+
+// retryDelays are the waits before each retry of a failed renewal. They
+// all fit in the grace period; the membership lapses when they run out.
+var retryDelays = []time.Duration{24 * time.Hour, 48 * time.Hour, 72 * time.Hour}
+
+// TierForm is what a creator fills in for a tier.
+type TierForm struct {
+	Name        string
+	Price       string // in major units of the creator's payout currency
+	Description string
+	Benefits    string // one per line
+}
+
+// Membership is a subscription with the people on either side of it.
+type Membership struct {
+	*models.Subscription
+	Creator   *models.Creator
+	Supporter *models.User
+}
+
+// UserFinder looks users up. auth.Repository satisfies it.
+type UserFinder interface {
+	FindUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error)
+}
+
+type Service interface {
+	ListTiers(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Tier, error)
+	ListAllTiers(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Tier, error)
+	SaveTier(ctx context.Context, creator *models.Creator, tierID primitive.ObjectID, form TierForm) (*models.Tier, error)
+	SetTierArchived(ctx context.Context, creator *models.Creator, tierID primitive.ObjectID, archived bool) error
+	Join(ctx context.Context, creator *models.Creator, tierID primitive.ObjectID, supporter *models.User) (string, error)
+	Cancel(ctx context.Context, supporter *models.User, subscriptionID primitive.ObjectID) error
+	Resume(ctx context.Context, supporter *models.User, subscriptionID primitive.ObjectID) error
+	SupporterMemberships(ctx context.Context, supporter *models.User) ([]Membership, error)
+	CreatorMembers(ctx context.Context, creator *models.Creator) ([]Membership, error)
+	RenewDue(ctx context.Context, now time.Time) error
+	DonationSettled(ctx context.Context, donation *models.Donation, tx *payments.Transaction) error
+}
+
+type service struct {
+	repo     Repository
+	payments payments.Service
+	creators creators.Service
+	users    UserFinder
+}
+
+// ListTiers returns the tiers a creator offers to new members.
+func (s *service) ListTiers(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Tier, error) {
+	return s.repo.FindTiersByCreator(ctx, creatorID, false)
+}
+
+// ListAllTiers returns every tier of a creator, archived ones included.
+func (s *service) ListAllTiers(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Tier, error) {
+	return s.repo.FindTiersByCreator(ctx, creatorID, true)
+}
+
+// SaveTier creates a tier, or updates it when tierID is set. Existing
+// members keep the price they joined at.
+func (s *service) SaveTier(ctx context.Context, creator *models.Creator, tierID primitive.ObjectID, form TierForm) (*models.Tier, error) {
+	tier := &models.Tier{CreatorID: creator.ID}
+	if !tierID.IsZero() {
+		var err error
+		if tier, err = s.creatorTier(ctx, creator, tierID); err != nil {
+			return nil, err
+		}
+	} else {
+		tiers, err := s.repo.FindTiersByCreator(ctx, creator.ID, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(tiers) >= maxTiers {
+			return nil, i18n.NewError("memberships.error.too_many_tiers", "count", maxTiers)
+		}
+	}
+
+	name := strings.TrimSpace(form.Name)
+	if name == "" {
+		return nil, i18n.NewError("memberships.error.name_required")
+	}
+	if len([]rune(name)) > maxTierNameLength {
+		return nil, i18n.NewError("memberships.error.name_too_long", "count", maxTierNameLength)
+	}
+
+	price, err := money.Parse(form.Price, creator.UnitPrice.Currency)
+	if err != nil || price.Minor <= 0 {
+		return nil, i18n.NewError("memberships.error.price")
+	}
+
+	description := strings.TrimSpace(form.Description)
+	if len([]rune(description)) > maxTierDescriptionLength {
+		return nil, i18n.NewError("memberships.error.description_too_long", "count", maxTierDescriptionLength)
+	}
+
+	var benefits []string
+	for _, line := range strings.Split(form.Benefits, "\n") {
+		benefit := strings.TrimSpace(line)
+		if benefit == "" {
+			continue
+		}
+		if len([]rune(benefit)) > maxBenefitLength {
+			return nil, i18n.NewError("memberships.error.benefit_too_long", "count", maxBenefitLength)
+		}
+		benefits = append(benefits, benefit)
+	}
+	if len(benefits) > maxBenefits {
+		return nil, i18n.NewError("memberships.error.too_many_benefits", "count", maxBenefits)
+	}
+
+	tier.Name = name
+	tier.Price = price
+	tier.Description = description
+	tier.Benefits = benefits
+
+	if tier.ID.IsZero() {
+		err = s.repo.CreateTier(ctx, tier)
+	} else {
+		err = s.repo.UpdateTier(ctx, tier)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tier, nil
+}
+
+// SetTierArchived hides a tier from new members, or offers it again.
+func (s *service) SetTierArchived(ctx context.Context, creator *models.Creator, tierID primitive.ObjectID, archived bool) error {
+	tier, err := s.creatorTier(ctx, creator, tierID)
+	if err != nil {
+		return err
+	}
+	tier.Archived = archived
+	return s.repo.UpdateTier(ctx, tier)
+}
+
+// creatorTier returns the creator's tier with id.
+func (s *service) creatorTier(ctx context.Context, creator *models.Creator, id primitive.ObjectID) (*models.Tier, error) {
+	tier, err := s.repo.FindTierByID(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && tier.CreatorID != creator.ID) {
+		return nil, ErrTierNotFound
+	}
+	return tier, err
+}
+
+// Join starts a membership and returns the gateway page where the supporter
+// pays the first month.
+func (s *service) Join(ctx context.Context, creator *models.Creator, tierID primitive.ObjectID, supporter *models.User) (string, error) {
+	if creator.UserID == supporter.ID {
+		return "", i18n.NewError("memberships.error.own_page")
+	}
+	tier, err := s.creatorTier(ctx, creator, tierID)
+	if err != nil {
+		return "", err
+	}
+	if tier.Archived {
+		return "", i18n.NewError("memberships.error.tier_closed")
+	}
+
+	existing, err := s.repo.FindLiveSubscription(ctx, supporter.ID, creator.ID)
+	switch {
+	case err == nil && existing.Status == models.SubscriptionPending:
+		// An earlier checkout that was never finished.
+		s.end(existing, models.SubscriptionIncomplete, time.Now())
+		if err := s.repo.UpdateSubscription(ctx, existing); err != nil {
+			return "", err
+		}
+	case err == nil:
+		return "", ErrAlreadyMember
+	case !errors.Is(err, mongo.ErrNoDocuments):
+		return "", err
+	}
+
+	subscription := &models.Subscription{
+		CreatorID:   creator.ID,
+		TierID:      tier.ID,
+		SupporterID: supporter.ID,
+		TierName:    tier.Name,
+		Price:       tier.Price,
+		Email:       supporter.Email,
+		Status:      models.SubscriptionPending,
+	}
+	if err := s.repo.CreateSubscription(ctx, subscription); err != nil {
+		return "", err
+	}
+
+	url, err := s.payments.StartSubscriptionCheckout(ctx, creator, subscription)
+	if err != nil {
+		s.end(subscription, models.SubscriptionIncomplete, time.Now())
+		if updateErr := s.repo.UpdateSubscription(ctx, subscription); updateErr != nil {
+			slog.Error("Error ending subscription", slog.String("subscription_id", subscription.ID.Hex()), slog.String("error", updateErr.Error()))
+		}
+		return "", err
+	}
+	return url, nil
+}
+
+// Cancel stops a membership from renewing. The supporter keeps their
+// benefits until the end of the period they paid for, except when a renewal
+// is already failing, which ends the membership at once.
+func (s *service) Cancel(ctx context.Context, supporter *models.User, subscriptionID primitive.ObjectID) error {
+	subscription, err := s.supporterSubscription(ctx, supporter, subscriptionID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	switch subscription.Status {
+	case models.SubscriptionActive:
+		subscription.CancelAtPeriodEnd = true
+	case models.SubscriptionPastDue:
+		s.end(subscription, models.SubscriptionCancelled, now)
+	case models.SubscriptionPending:
+		s.end(subscription, models.SubscriptionIncomplete, now)
+	default:
+		return i18n.NewError("memberships.error.ended")
+	}
+	return s.repo.UpdateSubscription(ctx, subscription)
+}
+
+// Resume undoes Cancel while the paid-for period is still running.
+func (s *service) Resume(ctx context.Context, supporter *models.User, subscriptionID primitive.ObjectID) error {
+	subscription, err := s.supporterSubscription(ctx, supporter, subscriptionID)
+	if err != nil {
+		return err
+	}
+	if subscription.Status != models.SubscriptionActive || !subscription.CancelAtPeriodEnd || !time.Now().Before(subscription.CurrentPeriodEnd) {
+		return i18n.NewError("memberships.error.cant_resume")
+	}
+	subscription.CancelAtPeriodEnd = false
+	return s.repo.UpdateSubscription(ctx, subscription)
+}
+
+// supporterSubscription returns the supporter's subscription with id.
+func (s *service) supporterSubscription(ctx context.Context, supporter *models.User, id primitive.ObjectID) (*models.Subscription, error) {
+	subscription, err := s.repo.FindSubscriptionByID(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && subscription.SupporterID != supporter.ID) {
+		return nil, ErrSubscriptionNotFound
+	}
+	return subscription, err
+}
+
+// SupporterMemberships lists the supporter's memberships with the creators
+// they support.
+func (s *service) SupporterMemberships(ctx context.Context, supporter *models.User) ([]Membership, error) {
+	subscriptions, err := s.repo.FindSubscriptionsBySupporter(ctx, supporter.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships := make([]Membership, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		creator, err := s.creators.GetByID(ctx, subscription.CreatorID)
+		if errors.Is(err, creators.ErrCreatorNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, Membership{Subscription: subscription, Creator: creator, Supporter: supporter})
+	}
+	return memberships, nil
+}
+
+// CreatorMembers lists everyone who has been a member of the creator's page.
+func (s *service) CreatorMembers(ctx context.Context, creator *models.Creator) ([]Membership, error) {
+	subscriptions, err := s.repo.FindSubscriptionsByCreator(ctx, creator.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]Membership, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		supporter, err := s.users.FindUserByID(ctx, subscription.SupporterID)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, Membership{Subscription: subscription, Creator: creator, Supporter: supporter})
+	}
+	return members, nil
+}
+
+// RenewDue ends memberships cancelled at the end of their period and
+// charges every one due for renewal at now.
+func (s *service) RenewDue(ctx context.Context, now time.Time) error {
+	if _, err := s.repo.EndCancelledSubscriptions(ctx, now); err != nil {
+		return err
+	}
+
+	for {
+		subscription, err := s.repo.ClaimDueRenewal(ctx, now, renewalLease)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.renew(ctx, subscription, now); err != nil {
+			slog.Error("Error renewing membership", slog.String("subscription_id", subscription.ID.Hex()), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// renew charges one claimed subscription. Settled charges update the
+// subscription through DonationSettled, so it is reloaded before any
+// change made here.
+func (s *service) renew(ctx context.Context, subscription *models.Subscription, now time.Time) error {
+	if subscription.PendingCharge != "" {
+		// Ask the gateway again about the renewal we are waiting on,
+		// rather than charging twice.
+		if _, err := s.payments.ConfirmDonation(ctx, subscription.PendingCharge); err != nil {
+			return err
+		}
+		return s.waitForPendingCharge(ctx, subscription.ID, subscription.PendingCharge, now)
+	}
+
+	donation, err := s.payments.ChargeSubscription(ctx, subscription)
+	if errors.Is(err, payments.ErrNoAuthorization) {
+		s.end(subscription, models.SubscriptionLapsed, now)
+		return s.repo.UpdateSubscription(ctx, subscription)
+	}
+	if donation == nil {
+		if err == nil {
+			err = errors.New("no donation recorded")
+		}
+		return s.renewalFailed(ctx, subscription.ID, now, err)
+	}
+	if err != nil {
+		slog.Error("Error charging membership renewal", slog.String("subscription_id", subscription.ID.Hex()), slog.String("error", err.Error()))
+	}
+	return s.waitForPendingCharge(ctx, subscription.ID, donation.Reference, now)
+}
+
+// waitForPendingCharge records that the renewal with reference hasn't
+// settled yet, unless it has since.
+func (s *service) waitForPendingCharge(ctx context.Context, subscriptionID primitive.ObjectID, reference string, now time.Time) error {
+	donation, err := s.payments.GetDonation(ctx, reference)
+	if err != nil {
+		return err
+	}
+	if donation.Status != models.DonationPending {
+		return nil
+	}
+
+	subscription, err := s.repo.FindSubscriptionByID(ctx, subscriptionID)
+	if err != nil {
+		return err
+	}
+	subscription.PendingCharge = reference
+	subscription.NextChargeAt = now.Add(pendingChargeWait)
+	return s.repo.UpdateSubscription(ctx, subscription)
+}
+
+// renewalFailed schedules a retry of a renewal that couldn't be charged,
+// or lapses the membership when the retries have run out.
+func (s *service) renewalFailed(ctx context.Context, subscriptionID primitive.ObjectID, now time.Time, cause error) error {
+	subscription, err := s.repo.FindSubscriptionByID(ctx, subscriptionID)
+	if err != nil {
+		return err
+	}
+	s.recordFailure(subscription, now)
+	slog.Warn("Membership renewal failed",
+		slog.String("subscription_id", subscription.ID.Hex()),
+		slog.Int("attempt", subscription.FailedAttempts),
+		slog.String("error", cause.Error()))
+	return s.repo.UpdateSubscription(ctx, subscription)
+}
+
+// recordFailure counts a failed renewal on subscription.
+func (s *service) recordFailure(subscription *models.Subscription, now time.Time) {
+	subscription.FailedAttempts++
+	if subscription.FailedAttempts > len(retryDelays) {
+		s.end(subscription, models.SubscriptionLapsed, now)
+		return
+	}
+	subscription.Status = models.SubscriptionPastDue
+	subscription.NextChargeAt = now.Add(retryDelays[subscription.FailedAttempts-1])
+}
+
+// DonationSettled updates a membership when one of its payments settles.
+// It satisfies payments.SettlementListener.
+func (s *service) DonationSettled(ctx context.Context, donation *models.Donation, tx *payments.Transaction) error {
+	if donation.SubscriptionID == nil {
+		return nil
+	}
+	subscription, err := s.repo.FindSubscriptionByID(ctx, *donation.SubscriptionID)
+	if err != nil {
+		return fmt.Errorf("subscription %s: %w", donation.SubscriptionID.Hex(), err)
+	}
+
+	now := time.Now()
+	if subscription.PendingCharge == donation.Reference {
+		subscription.PendingCharge = ""
+	}
+
+	switch {
+	case donation.Status == models.DonationSucceeded && subscription.Status == models.SubscriptionCancelled:
+		// Paid after the supporter cancelled; this needs a refund, not
+		// another month.
+		slog.Warn("Payment for a cancelled membership",
+			slog.String("subscription_id", subscription.ID.Hex()), slog.String("reference", donation.Reference))
+	case donation.Status == models.DonationSucceeded:
+		// A renewal extends the current period; a first payment, or one
+		// after the membership lapsed, starts a new one.
+		start := subscription.CurrentPeriodEnd
+		if !subscription.Live() || subscription.Status == models.SubscriptionPending || start.IsZero() || now.After(start.Add(GracePeriod)) {
+			start = now
+		}
+		subscription.Status = models.SubscriptionActive
+		subscription.CurrentPeriodEnd = start.AddDate(0, 1, 0)
+		subscription.NextChargeAt = subscription.CurrentPeriodEnd
+		subscription.FailedAttempts = 0
+		subscription.EndedAt = time.Time{}
+		subscription.Gateway = donation.Gateway
+		if tx.Authorization != "" {
+			subscription.Authorization = tx.Authorization
+		}
+	case subscription.Status == models.SubscriptionPending:
+		s.end(subscription, models.SubscriptionIncomplete, now)
+	case subscription.Status == models.SubscriptionActive || subscription.Status == models.SubscriptionPastDue:
+		s.recordFailure(subscription, now)
+	}
+	return s.repo.UpdateSubscription(ctx, subscription)
+}
+
+// end closes subscription with status.
+func (s *service) end(subscription *models.Subscription, status models.SubscriptionStatus, now time.Time) {
+	subscription.Status = status
+	subscription.EndedAt = now
+	subscription.NextChargeAt = time.Time{}
+	subscription.CancelAtPeriodEnd = false
+}
+
+func NewService(repo Repository, paymentService payments.Service, creatorService creators.Service, users UserFinder) Service {
+	return &service{repo: repo, payments: paymentService, creators: creatorService, users: users}
+}
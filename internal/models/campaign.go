@@ -0,0 +1,49 @@
+package models
+
+import (
+	"fmj/internal/money"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// CampaignStatus is whether a campaign still takes donations.
+type CampaignStatus string
+
+const (
+	CampaignOpen   CampaignStatus = "open"
+	CampaignClosed CampaignStatus = "closed"
+)
+
+// Campaign is a creator raising for one specific thing by a deadline.
+type Campaign struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	CreatorID   primitive.ObjectID `bson:"creator_id"`
+	Title       string             `bson:"title"`
+	Description string             `bson:"description"`
+	Cover       string             `bson:"cover,omitempty"`
+	Target      money.Money        `bson:"target"`
+	Deadline    time.Time          `bson:"deadline"` // donations stop at this instant, the end of the last day
+	Status      CampaignStatus     `bson:"status"`
+	ClosedAt    time.Time          `bson:"closed_at,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at"`
+}
+
+// IsOpen reports whether the campaign takes donations at now. A campaign
+// past its deadline is closed even before the scheduler gets to it.
+func (c *Campaign) IsOpen(now time.Time) bool {
+	return c.Status == CampaignOpen && now.Before(c.Deadline)
+}
+
+// LastDay is the last day the campaign takes donations, in UTC.
+func (c *Campaign) LastDay() time.Time {
+	return c.Deadline.Add(-time.Nanosecond).UTC()
+}
+
+// CampaignUpdate is a post in a campaign's updates feed.
+type CampaignUpdate struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	CampaignID primitive.ObjectID `bson:"campaign_id"`
+	Body       string             `bson:"body"`
+	CreatedAt  time.Time          `bson:"created_at"`
+}
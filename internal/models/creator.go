@@ -0,0 +1,40 @@
+package models
+
+import (
+	"fmj/internal/money"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// Creator is a user's public page that supporters give to. A user has at
+// most one.
+type Creator struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	UserID      primitive.ObjectID `bson:"user_id"`
+	Slug        string             `bson:"slug"` // served at /{slug}
+	DisplayName string             `bson:"display_name"`
+	Bio         string             `bson:"bio"`
+	Avatar      string             `bson:"avatar,omitempty"`
+	Cover       string             `bson:"cover,omitempty"`
+	Category    string             `bson:"category"`
+	Links       []SocialLink       `bson:"links,omitempty"`
+	UnitPrice   money.Money        `bson:"unit_price"` // price of one jollof, in the creator's payout currency
+	CreatedAt   time.Time          `bson:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at"`
+}
+
+// SocialLink points to the creator elsewhere on the web.
+type SocialLink struct {
+	Platform string `bson:"platform"` // e.g. "instagram"
+	URL      string `bson:"url"`
+}
+
+// Link returns the creator's URL on platform, or "".
+func (c *Creator) Link(platform string) string {
+	for _, link := range c.Links {
+		if link.Platform == platform {
+			return link.URL
+		}
+	}
+	return ""
+}
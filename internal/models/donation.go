@@ -0,0 +1,98 @@
+package models
+
+import (
+	"fmj/internal/money"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// DonationStatus tracks a donation through checkout, and any refund or
+// chargeback after it.
+type DonationStatus string
+
+const (
+	DonationPending   DonationStatus = "pending"
+	DonationSucceeded DonationStatus = "succeeded"
+	DonationFailed    DonationStatus = "failed"
+	DonationRefunded  DonationStatus = "refunded"
+	// DonationRefunding is claimed by a refund the gateway hasn't answered
+	// yet, so two refunds can't both reach it.
+	DonationRefunding DonationStatus = "refunding"
+	// DonationDisputed has a chargeback open against it.
+	DonationDisputed DonationStatus = "disputed"
+	// DonationLost lost its chargeback; the supporter got their money back.
+	DonationLost DonationStatus = "lost"
+)
+
+// donationTransitions lists the statuses each status can move to. A won
+// chargeback moves a disputed donation back to succeeded, as does a refund
+// the gateway declined. Refunds made on the gateway's own dashboard skip
+// refunding.
+var donationTransitions = map[DonationStatus][]DonationStatus{
+	DonationPending:   {DonationSucceeded, DonationFailed},
+	DonationSucceeded: {DonationRefunding, DonationRefunded, DonationDisputed},
+	DonationRefunding: {DonationRefunded, DonationSucceeded},
+	DonationDisputed:  {DonationSucceeded, DonationLost},
+}
+
+// CanBecome reports whether a donation in status s may move to next.
+func (s DonationStatus) CanBecome(next DonationStatus) bool {
+	for _, status := range donationTransitions[s] {
+		if status == next {
+			return true
+		}
+	}
+	return false
+}
+
+// DonationDispute is a chargeback raised against a donation.
+type DonationDispute struct {
+	GatewayReference string    `bson:"gateway_reference"`
+	Reason           string    `bson:"reason,omitempty"`
+	OpenedAt         time.Time `bson:"opened_at"`
+	ResolvedAt       time.Time `bson:"resolved_at,omitempty"`
+}
+
+// Donation is a supporter buying a creator one or more jollofs, or paying
+// for a month of membership.
+type Donation struct {
+	ID               primitive.ObjectID  `bson:"_id,omitempty"`
+	CreatorID        primitive.ObjectID  `bson:"creator_id"`
+	SupporterID      *primitive.ObjectID `bson:"supporter_id,omitempty"`    // nil for guests
+	SubscriptionID   *primitive.ObjectID `bson:"subscription_id,omitempty"` // set for membership payments
+	CampaignID       *primitive.ObjectID `bson:"campaign_id,omitempty"`     // set when given towards a campaign
+	Units            int                 `bson:"units"`
+	UnitPrice        money.Money         `bson:"unit_price"` // copied from the creator at checkout
+	Amount           money.Money         `bson:"amount"`
+	Name             string              `bson:"name,omitempty"`
+	Message          string              `bson:"message,omitempty"`
+	Anonymous        bool                `bson:"anonymous,omitempty"` // keep the name off the public wall
+	Email            string              `bson:"email"`
+	Locale           string              `bson:"locale,omitempty"` // the supporter's language at checkout
+	Status           DonationStatus      `bson:"status"`
+	Gateway          string              `bson:"gateway"`
+	Reference        string              `bson:"reference"` // ours, sent to the gateway
+	GatewayReference string              `bson:"gateway_reference,omitempty"`
+	PaidAt           time.Time           `bson:"paid_at,omitempty"`
+	RefundReference  string              `bson:"refund_reference,omitempty"` // the gateway's
+	RefundReason     string              `bson:"refund_reason,omitempty"`
+	RefundedBy       *primitive.ObjectID `bson:"refunded_by,omitempty"`
+	RefundedAt       time.Time           `bson:"refunded_at,omitempty"`
+	Dispute          *DonationDispute    `bson:"dispute,omitempty"` // the latest chargeback, if any
+	Hidden           bool                `bson:"hidden,omitempty"`  // the creator took it off their wall
+	Pinned           bool                `bson:"pinned,omitempty"`
+	Reply            string              `bson:"reply,omitempty"` // the creator's
+	RepliedAt        time.Time           `bson:"replied_at,omitempty"`
+	CreatedAt        time.Time           `bson:"created_at"`
+	UpdatedAt        time.Time           `bson:"updated_at"`
+}
+
+// PublicName is the name shown on the creator's supporter wall, or "" when
+// the supporter stays anonymous and the wall says "Someone" in the reader's
+// language.
+func (d *Donation) PublicName() string {
+	if d.Anonymous {
+		return ""
+	}
+	return d.Name
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// EmailCategory sorts emails by whether people can opt out of them.
+type EmailCategory string
+
+const (
+	// EmailTransactional is mail about something the person did, like a
+	// sign-in link or a refund. It always goes.
+	EmailTransactional EmailCategory = "transactional"
+	// EmailReceipts are receipts for donations and membership payments.
+	EmailReceipts EmailCategory = "receipts"
+	// EmailUpdates is news about FundMyJollof and the creators people
+	// support.
+	EmailUpdates EmailCategory = "updates"
+)
+
+// Email is a rendered message waiting in the outbox, or given up on and
+// moved to the dead letters.
+type Email struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	To            string             `bson:"to"`
+	Template      string             `bson:"template"` // e.g. "verification"
+	Subject       string             `bson:"subject"`
+	HTML          string             `bson:"html"`
+	Text          string             `bson:"text"`
+	Category      EmailCategory      `bson:"category"`
+	Unsubscribe   string             `bson:"unsubscribe,omitempty"` // one-click unsubscribe URL, for List-Unsubscribe
+	Secret        bool               `bson:"secret,omitempty"`      // carries a sign-in or account link; its body isn't kept once it is given up on
+	Attempts      int                `bson:"attempts"`
+	LastError     string             `bson:"last_error,omitempty"`
+	NextAttemptAt time.Time          `bson:"next_attempt_at"` // pushed forward while a worker holds it
+	FailedAt      time.Time          `bson:"failed_at,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at"`
+}
+
+// SuppressionReason is why mail to an address is held back.
+type SuppressionReason string
+
+const (
+	SuppressionBounce      SuppressionReason = "bounce"
+	SuppressionComplaint   SuppressionReason = "complaint" // marked as spam
+	SuppressionUnsubscribe SuppressionReason = "unsubscribe"
+)
+
+// Suppression stops non-transactional mail to an address: all of it after a
+// bounce or complaint, one category after an unsubscribe.
+type Suppression struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Email     string             `bson:"email"`    // lower case
+	Category  EmailCategory      `bson:"category"` // empty for every category
+	Reason    SuppressionReason  `bson:"reason"`
+	Detail    string             `bson:"detail,omitempty"` // what the provider said
+	CreatedAt time.Time          `bson:"created_at"`
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"fmj/internal/money"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// LedgerKind is what a ledger transaction records.
+type LedgerKind string
+
+const (
+	LedgerDonation LedgerKind = "donation"
+	LedgerRefund   LedgerKind = "refund"
+	// LedgerPayout sets money aside for a payout the creator asked for.
+	LedgerPayout LedgerKind = "payout"
+	// LedgerPayoutSent records the gateway sending a payout.
+	LedgerPayoutSent LedgerKind = "payout_sent"
+	// LedgerPayoutReversal gives the creator back a payout that was
+	// rejected or failed.
+	LedgerPayoutReversal LedgerKind = "payout_reversal"
+	// LedgerChargeback takes a disputed donation back from the creator
+	// while the chargeback is open.
+	LedgerChargeback LedgerKind = "chargeback"
+	// LedgerChargebackReversal gives it back when the chargeback is won.
+	LedgerChargebackReversal LedgerKind = "chargeback_reversal"
+)
+
+// LedgerTransaction is one balanced entry in the double-entry ledger. Its
+// postings sum to zero in every currency.
+type LedgerTransaction struct {
+	ID         primitive.ObjectID  `bson:"_id,omitempty"`
+	Reference  string              `bson:"reference"` // unique, so recording the same thing twice is a no-op
+	Kind       LedgerKind          `bson:"kind"`
+	CreatorID  primitive.ObjectID  `bson:"creator_id"`
+	DonationID *primitive.ObjectID `bson:"donation_id,omitempty"`
+	Memo       string              `bson:"memo,omitempty"`
+	Postings   []Posting           `bson:"postings"`
+	CreatedAt  time.Time           `bson:"created_at"`
+}
+
+// Posting moves money in or out of one account. Debits are positive and
+// credits negative.
+type Posting struct {
+	Account     string      `bson:"account"`
+	Amount      money.Money `bson:"amount"`
+	AvailableAt time.Time   `bson:"available_at,omitempty"` // when it can be paid out; set on creator accounts only
+}
+
+// LedgerAccount keeps the running balance of an account in each currency,
+// in minor units. It is updated in the same database transaction as the
+// postings, and the invariant checker compares the two.
+type LedgerAccount struct {
+	ID        string           `bson:"_id"` // the account name
+	Balances  map[string]int64 `bson:"balances"`
+	UpdatedAt time.Time        `bson:"updated_at"`
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"fmj/internal/money"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// Tier is a monthly membership level a creator offers.
+type Tier struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	CreatorID   primitive.ObjectID `bson:"creator_id"`
+	Name        string             `bson:"name"`
+	Price       money.Money        `bson:"price"` // per month
+	Description string             `bson:"description"`
+	Benefits    []string           `bson:"benefits,omitempty"`
+	Archived    bool               `bson:"archived"` // hidden from new members; existing ones keep renewing
+	CreatedAt   time.Time          `bson:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at"`
+}
+
+// SubscriptionStatus tracks a membership through its life.
+type SubscriptionStatus string
+
+const (
+	// SubscriptionPending is waiting for its first payment.
+	SubscriptionPending SubscriptionStatus = "pending"
+	SubscriptionActive  SubscriptionStatus = "active"
+	// SubscriptionPastDue had a renewal fail and is being retried during
+	// the grace period.
+	SubscriptionPastDue SubscriptionStatus = "past_due"
+	// SubscriptionIncomplete never had its first payment go through.
+	SubscriptionIncomplete SubscriptionStatus = "incomplete"
+	// SubscriptionCancelled was ended by the supporter.
+	SubscriptionCancelled SubscriptionStatus = "cancelled"
+	// SubscriptionLapsed ended because renewals kept failing.
+	SubscriptionLapsed SubscriptionStatus = "lapsed"
+)
+
+// Subscription is a supporter's membership of one of a creator's tiers.
+type Subscription struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty"`
+	CreatorID         primitive.ObjectID `bson:"creator_id"`
+	TierID            primitive.ObjectID `bson:"tier_id"`
+	SupporterID       primitive.ObjectID `bson:"supporter_id"`
+	TierName          string             `bson:"tier_name"` // as it was when they joined
+	Price             money.Money        `bson:"price"`     // locked in when they joined
+	Email             string             `bson:"email"`
+	Status            SubscriptionStatus `bson:"status"`
+	Gateway           string             `bson:"gateway"`
+	Authorization     string             `bson:"authorization,omitempty"` // gateway token for charging renewals
+	CurrentPeriodEnd  time.Time          `bson:"current_period_end,omitempty"`
+	NextChargeAt      time.Time          `bson:"next_charge_at,omitempty"`
+	FailedAttempts    int                `bson:"failed_attempts"`
+	PendingCharge     string             `bson:"pending_charge,omitempty"` // reference of a renewal the gateway hasn't settled yet
+	CancelAtPeriodEnd bool               `bson:"cancel_at_period_end"`
+	EndedAt           time.Time          `bson:"ended_at,omitempty"`
+	CreatedAt         time.Time          `bson:"created_at"`
+	UpdatedAt         time.Time          `bson:"updated_at"`
+}
+
+// Live reports whether the subscription hasn't ended yet, including while
+// it waits for its first payment.
+func (s *Subscription) Live() bool {
+	switch s.Status {
+	case SubscriptionPending, SubscriptionActive, SubscriptionPastDue:
+		return true
+	}
+	return false
+}
+
+// Entitled reports whether the supporter should get the tier's benefits at
+// now. Members keep them through the grace period while a renewal is
+// retried.
+func (s *Subscription) Entitled(now time.Time, grace time.Duration) bool {
+	switch s.Status {
+	case SubscriptionActive:
+		return now.Before(s.CurrentPeriodEnd)
+	case SubscriptionPastDue:
+		return now.Before(s.CurrentPeriodEnd.Add(grace))
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"fmj/internal/money"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// PayoutMethod is a bank account or mobile money wallet a creator is paid
+// out to.
+type PayoutMethod struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	CreatorID     primitive.ObjectID `bson:"creator_id"`
+	Gateway       string             `bson:"gateway"` // bank codes are the gateway's own
+	Currency      string             `bson:"currency"`
+	BankCode      string             `bson:"bank_code"`
+	BankName      string             `bson:"bank_name"`
+	AccountNumber string             `bson:"account_number"` // the phone number for mobile money
+	AccountName   string             `bson:"account_name"`
+	MobileMoney   bool               `bson:"mobile_money"`
+	Verified      bool               `bson:"verified"` // the gateway confirmed the account name
+	CreatedAt     time.Time          `bson:"created_at"`
+}
+
+// MaskedNumber shows only the last four digits of the account number.
+func (m *PayoutMethod) MaskedNumber() string {
+	if len(m.AccountNumber) <= 4 {
+		return m.AccountNumber
+	}
+	return "••••" + m.AccountNumber[len(m.AccountNumber)-4:]
+}
+
+// PayoutStatus tracks a payout from request to the creator's account.
+type PayoutStatus string
+
+const (
+	// PayoutRequested is waiting for an admin to approve it.
+	PayoutRequested PayoutStatus = "requested"
+	// PayoutProcessing was approved and handed to the gateway.
+	PayoutProcessing PayoutStatus = "processing"
+	PayoutPaid       PayoutStatus = "paid"
+	PayoutFailed     PayoutStatus = "failed"
+	PayoutRejected   PayoutStatus = "rejected"
+)
+
+// Payout is a creator withdrawing their available balance.
+type Payout struct {
+	ID               primitive.ObjectID  `bson:"_id,omitempty"`
+	CreatorID        primitive.ObjectID  `bson:"creator_id"`
+	Method           PayoutMethod        `bson:"method"` // as it was when requested
+	Amount           money.Money         `bson:"amount"`
+	Status           PayoutStatus        `bson:"status"`
+	Reference        string              `bson:"reference"` // ours, sent to the gateway
+	GatewayReference string              `bson:"gateway_reference,omitempty"`
+	Note             string              `bson:"note,omitempty"`     // why it was rejected or failed, as the admin or gateway put it
+	NoteKey          string              `bson:"note_key,omitempty"` // message key for why it failed, when we say so ourselves
+	ReviewedBy       *primitive.ObjectID `bson:"reviewed_by,omitempty"`
+	ReviewedAt       time.Time           `bson:"reviewed_at,omitempty"`
+	PaidAt           time.Time           `bson:"paid_at,omitempty"`
+	CreatedAt        time.Time           `bson:"created_at"`
+	UpdatedAt        time.Time           `bson:"updated_at"`
+}
+
+// Open reports whether the payout hasn't reached a final status yet.
+func (p *Payout) Open() bool {
+	return p.Status == PayoutRequested || p.Status == PayoutProcessing
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// Session is a server-side login session. The browser only holds a signed
+// cookie with the ID; everything else lives in the sessions collection.
+type Session struct {
+	ID        string    `bson:"_id"`
+	UserID    string    `bson:"user_id,omitempty"`
+	Data      string    `bson:"data"`
+	IP        string    `bson:"ip"`
+	UserAgent string    `bson:"user_agent"`
+	CreatedAt time.Time `bson:"created_at"`
+	LastSeen  time.Time `bson:"last_seen"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
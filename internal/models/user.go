@@ -6,15 +6,84 @@ import (
 )
 
 type User struct {
-	ID               primitive.ObjectID `bson:"_id,omitempty"`
-	FullName         string             `bson:"full_name"`
-	Email            string             `bson:"email"`
-	Password         string             `bson:"password"`
-	Verified         bool               `bson:"verified"`
-	VerificationCode string             `bson:"verification_code,omitempty"`
-	GoogleID         string             `bson:"google_id,omitempty"`
-	Avatar           string             `bson:"avatar,omitempty"`
-	Provider         string             `bson:"provider,omitempty"` // "local" or "google"
-	CreatedAt        time.Time          `bson:"created_at"`
-	UpdatedAt        time.Time          `bson:"updated_at"`
+	ID                    primitive.ObjectID `bson:"_id,omitempty"`
+	FullName              string             `bson:"full_name"`
+	Email                 string             `bson:"email"`
+	Password              string             `bson:"password"`
+	Verified              bool               `bson:"verified"`
+	VerificationCode      string             `bson:"verification_code,omitempty"`
+	VerificationExpiresAt time.Time          `bson:"verification_expires_at,omitempty"`
+	VerificationSentAt    time.Time          `bson:"verification_sent_at,omitempty"`
+	Avatar                string             `bson:"avatar,omitempty"`
+	Identities            []LinkedIdentity   `bson:"identities,omitempty"`
+	TOTPSecret            string             `bson:"totp_secret,omitempty"`
+	TOTPEnabled           bool               `bson:"totp_enabled"`
+	RecoveryCodes         []string           `bson:"recovery_codes,omitempty"` // SHA-256 hashes
+	Roles                 []Role             `bson:"roles"`
+	Notifications         NotificationPrefs  `bson:"notifications"`
+	Locale                string             `bson:"locale,omitempty"` // for the site and emails, e.g. "fr"
+	CreatedAt             time.Time          `bson:"created_at"`
+	UpdatedAt             time.Time          `bson:"updated_at"`
+}
+
+// NotificationPrefs are the optional emails a user has turned off. The zero
+// value gets everything.
+type NotificationPrefs struct {
+	NoReceipts bool `bson:"no_receipts,omitempty"`
+	NoUpdates  bool `bson:"no_updates,omitempty"`
+}
+
+// Allows reports whether the user wants emails in category.
+func (p NotificationPrefs) Allows(category EmailCategory) bool {
+	switch category {
+	case EmailReceipts:
+		return !p.NoReceipts
+	case EmailUpdates:
+		return !p.NoUpdates
+	default:
+		return true
+	}
+}
+
+// Role grants a user access to a part of the site. A user can hold several.
+type Role string
+
+const (
+	// RoleSupporter is given to every account and lets it give to creators.
+	RoleSupporter Role = "supporter"
+	// RoleCreator can run a creator page and receive payouts.
+	RoleCreator Role = "creator"
+	// RoleAdmin can moderate content and approve payouts.
+	RoleAdmin Role = "admin"
+)
+
+// HasRole reports whether the user holds any of roles.
+func (u *User) HasRole(roles ...Role) bool {
+	for _, have := range u.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LinkedIdentity ties the user to an account at an external identity
+// provider. A user has at most one identity per provider.
+type LinkedIdentity struct {
+	Provider string    `bson:"provider"` // e.g. "google"
+	Subject  string    `bson:"subject"`  // the provider's stable user ID
+	Email    string    `bson:"email,omitempty"`
+	LinkedAt time.Time `bson:"linked_at"`
+}
+
+// Identity returns the user's linked identity for provider, if any.
+func (u *User) Identity(provider string) *LinkedIdentity {
+	for i := range u.Identities {
+		if u.Identities[i].Provider == provider {
+			return &u.Identities[i]
+		}
+	}
+	return nil
 }
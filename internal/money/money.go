@@ -0,0 +1,218 @@
+// Package money represents amounts as integer minor units of an ISO 4217
+// currency, so sums never pick up floating-point error.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"strconv"
+	"strings"
+)
+
+// ErrCurrencyMismatch is returned when combining amounts in different
+// currencies.
+var ErrCurrencyMismatch = errors.New("money: currency mismatch")
+
+// Currency describes how a supported currency is written.
+type Currency struct {
+	Code     string // ISO 4217
+	Symbol   string
+	Exponent int // digits after the decimal point
+}
+
+var currencies = map[string]Currency{
+	"NGN": {Code: "NGN", Symbol: "₦", Exponent: 2},
+	"GHS": {Code: "GHS", Symbol: "GH₵", Exponent: 2},
+	"KES": {Code: "KES", Symbol: "KSh", Exponent: 2},
+	"ZAR": {Code: "ZAR", Symbol: "R", Exponent: 2},
+	"USD": {Code: "USD", Symbol: "$", Exponent: 2},
+}
+
+// Codes lists the supported currencies in the order offered to users.
+var Codes = []string{"NGN", "GHS", "KES", "ZAR", "USD"}
+
+// Lookup returns the currency for code.
+func Lookup(code string) (Currency, bool) {
+	c, ok := currencies[code]
+	return c, ok
+}
+
+// Money is an amount in a currency's minor units, e.g. kobo for NGN.
+type Money struct {
+	Minor    int64
+	Currency string
+}
+
+// New returns minor units of currency.
+func New(minor int64, currency string) Money {
+	return Money{Minor: minor, Currency: currency}
+}
+
+// Parse reads a major-unit amount such as "1,500" or "2.50".
+func Parse(major, currency string) (Money, error) {
+	c, ok := Lookup(currency)
+	if !ok {
+		return Money{}, fmt.Errorf("money: unsupported currency %q", currency)
+	}
+
+	major = strings.ReplaceAll(strings.TrimSpace(major), ",", "")
+	whole, fraction, _ := strings.Cut(major, ".")
+	if whole == "" || len(fraction) > c.Exponent {
+		return Money{}, fmt.Errorf("money: invalid amount %q", major)
+	}
+	fraction += strings.Repeat("0", c.Exponent-len(fraction))
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units < 0 {
+		return Money{}, fmt.Errorf("money: invalid amount %q", major)
+	}
+	var minor int64
+	if fraction != "" {
+		if minor, err = strconv.ParseInt(fraction, 10, 64); err != nil || minor < 0 {
+			return Money{}, fmt.Errorf("money: invalid amount %q", major)
+		}
+	}
+	return New(units*pow10(c.Exponent)+minor, currency), nil
+}
+
+func (m Money) IsZero() bool {
+	return m.Minor == 0
+}
+
+// Add returns m + o. Both must be in the same currency.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return New(m.Minor+o.Minor, m.Currency), nil
+}
+
+// Mul returns m times n.
+func (m Money) Mul(n int64) Money {
+	return New(m.Minor*n, m.Currency)
+}
+
+// Neg returns -m.
+func (m Money) Neg() Money {
+	return New(-m.Minor, m.Currency)
+}
+
+// Major renders the amount without symbol or grouping, e.g. "1500.50", as
+// form inputs and gateway APIs expect.
+func (m Money) Major() string {
+	exp := m.exponent()
+	sign, minor := "", m.Minor
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	if exp == 0 {
+		return sign + strconv.FormatInt(minor, 10)
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, minor/pow10(exp), exp, minor%pow10(exp))
+}
+
+// String renders the amount with its ISO code, e.g. "NGN 1,500.00".
+func (m Money) String() string {
+	return m.Currency + " " + group(m.Major(), ",", ".")
+}
+
+// Format renders the amount the way readers of locale expect, e.g.
+// "₦1,500.00" in English or "1 500,00 ₦" in French.
+func (m Money) Format(locale string) string {
+	symbol := m.Currency
+	if c, ok := Lookup(m.Currency); ok {
+		symbol = c.Symbol
+	}
+
+	f := formatFor(locale)
+	number := group(m.Major(), f.group, f.decimal)
+	if f.symbolAfter {
+		return number + " " + symbol
+	}
+	if strings.HasPrefix(number, "-") {
+		return "-" + symbol + number[1:]
+	}
+	return symbol + number
+}
+
+func (m Money) exponent() int {
+	if c, ok := Lookup(m.Currency); ok {
+		return c.Exponent
+	}
+	return 2
+}
+
+// numberFormat is how a locale writes numbers and currency.
+type numberFormat struct {
+	group       string
+	decimal     string
+	symbolAfter bool
+}
+
+var numberFormats = map[string]numberFormat{
+	"en":  {group: ",", decimal: "."},
+	"fr":  {group: " ", decimal: ",", symbolAfter: true},
+	"sw":  {group: ",", decimal: "."},
+	"yo":  {group: ",", decimal: "."},
+	"pcm": {group: ",", decimal: "."},
+}
+
+// formatFor returns the number format for locale, falling back to its base
+// language and then English.
+func formatFor(locale string) numberFormat {
+	base, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	if f, ok := numberFormats[base]; ok {
+		return f
+	}
+	return numberFormats["en"]
+}
+
+// group inserts thousands separators into a plain decimal string and swaps
+// in the locale's decimal mark.
+func group(plain, sep, decimal string) string {
+	sign := ""
+	if strings.HasPrefix(plain, "-") {
+		sign, plain = "-", plain[1:]
+	}
+	whole, fraction, hasFraction := strings.Cut(plain, ".")
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + sep + whole[i:]
+	}
+	if hasFraction {
+		return sign + whole + decimal + fraction
+	}
+	return sign + whole
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// moneyDocument is how Money is stored: {minor: 150000, currency: "NGN"}.
+type moneyDocument struct {
+	Minor    int64  `bson:"minor"`
+	Currency string `bson:"currency"`
+}
+
+func (m Money) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(moneyDocument{Minor: m.Minor, Currency: m.Currency})
+}
+
+func (m *Money) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	if t == bson.TypeNull {
+		*m = Money{}
+		return nil
+	}
+	var doc moneyDocument
+	if err := bson.UnmarshalValue(t, data, &doc); err != nil {
+		return err
+	}
+	*m = Money{Minor: doc.Minor, Currency: doc.Currency}
+	return nil
+}
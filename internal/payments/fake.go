@@ -0,0 +1,316 @@
+package payments
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmj/internal/utils"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeGateway is an in-process gateway for development and end-to-end
+// testing. Its hosted checkout page lets you approve or decline a payment,
+// and no money moves. Transfers succeed at once, except to account numbers
+// ending in 0000, which fail. Refunds are processed at once too.
+type FakeGateway struct {
+	baseURL string
+
+	mu             sync.Mutex
+	transactions   map[string]*fakeTransaction
+	authorizations map[string]bool // token to whether charging it succeeds
+	transfers      map[string]*Transfer
+	refunds        map[string]*Refund // by the refunded payment's reference
+}
+
+type fakeTransaction struct {
+	Transaction
+	callbackURL string
+}
+
+func NewFakeGateway(baseURL string) *FakeGateway {
+	return &FakeGateway{
+		baseURL:        baseURL,
+		transactions:   make(map[string]*fakeTransaction),
+		authorizations: make(map[string]bool),
+		transfers:      make(map[string]*Transfer),
+		refunds:        make(map[string]*Refund),
+	}
+}
+
+func (g *FakeGateway) Name() string {
+	return "fake"
+}
+
+func (g *FakeGateway) InitializeTransaction(ctx context.Context, req InitializeRequest) (*Transaction, error) {
+	if req.Amount.Minor <= 0 {
+		return nil, errors.New("fake gateway: amount must be positive")
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.transactions[req.Reference]; ok {
+		return nil, errors.New("fake gateway: duplicate reference")
+	}
+	tx := &fakeTransaction{
+		Transaction: Transaction{
+			Reference:        req.Reference,
+			GatewayReference: "fake_" + hex.EncodeToString(id),
+			Status:           TransactionPending,
+			Amount:           req.Amount,
+			AuthorizationURL: fmt.Sprintf("%s/payments/fake/checkout?reference=%s", g.baseURL, url.QueryEscape(req.Reference)),
+		},
+		callbackURL: req.CallbackURL,
+	}
+	g.transactions[req.Reference] = tx
+
+	result := tx.Transaction
+	return &result, nil
+}
+
+func (g *FakeGateway) VerifyTransaction(ctx context.Context, reference string) (*Transaction, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	tx, ok := g.transactions[reference]
+	if !ok {
+		return nil, ErrTransactionNotFound
+	}
+	result := tx.Transaction
+	return &result, nil
+}
+
+// ChargeAuthorization settles at once: paid, or declined if the payer chose
+// to decline later charges on the checkout page.
+func (g *FakeGateway) ChargeAuthorization(ctx context.Context, req ChargeRequest) (*Transaction, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.transactions[req.Reference]; ok {
+		return nil, errors.New("fake gateway: duplicate reference")
+	}
+	tx := &fakeTransaction{
+		Transaction: Transaction{
+			Reference:        req.Reference,
+			GatewayReference: "fake_" + hex.EncodeToString(id),
+			Status:           TransactionFailed,
+			Amount:           req.Amount,
+			Authorization:    req.Authorization,
+		},
+	}
+	if g.authorizations[req.Authorization] {
+		tx.Status = TransactionSuccess
+		tx.PaidAt = time.Now()
+	}
+	g.transactions[req.Reference] = tx
+
+	result := tx.Transaction
+	return &result, nil
+}
+
+// ListBanks returns one bank and one mobile money provider in every
+// currency.
+func (g *FakeGateway) ListBanks(ctx context.Context, currency string) ([]Bank, error) {
+	return []Bank{
+		{Code: "001", Name: "Fake Bank"},
+		{Code: "FMM", Name: "Fake Mobile Money", MobileMoney: true},
+	}, nil
+}
+
+// ResolveAccount resolves any ten digit bank account number.
+func (g *FakeGateway) ResolveAccount(ctx context.Context, account PayoutAccount) (string, error) {
+	if account.MobileMoney {
+		return "", ErrCannotResolve
+	}
+	if len(account.AccountNumber) != 10 {
+		return "", errors.New("fake gateway: account not found")
+	}
+	return "FAKE ACCOUNT " + account.AccountNumber[6:], nil
+}
+
+func (g *FakeGateway) Transfer(ctx context.Context, req TransferRequest) (*Transfer, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.transfers[req.Reference]; ok {
+		return nil, errors.New("fake gateway: duplicate reference")
+	}
+	transfer := &Transfer{
+		Reference:        req.Reference,
+		GatewayReference: "fake_trf_" + hex.EncodeToString(id),
+		Status:           TransactionSuccess,
+		Amount:           req.Amount,
+	}
+	if strings.HasSuffix(req.Account.AccountNumber, "0000") {
+		transfer.Status = TransactionFailed
+		transfer.Failure = "the account can't receive transfers"
+	}
+	g.transfers[req.Reference] = transfer
+
+	result := *transfer
+	return &result, nil
+}
+
+func (g *FakeGateway) VerifyTransfer(ctx context.Context, reference, gatewayReference string) (*Transfer, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	transfer, ok := g.transfers[reference]
+	if !ok {
+		return nil, ErrTransactionNotFound
+	}
+	result := *transfer
+	return &result, nil
+}
+
+func (g *FakeGateway) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	tx, ok := g.transactions[req.Reference]
+	if !ok {
+		return nil, ErrTransactionNotFound
+	}
+	if tx.Status != TransactionSuccess {
+		return nil, errors.New("fake gateway: only successful payments can be refunded")
+	}
+	if req.Amount.Currency != tx.Amount.Currency || req.Amount.Minor <= 0 || req.Amount.Minor > tx.Amount.Minor {
+		return nil, errors.New("fake gateway: invalid refund amount")
+	}
+	if _, ok := g.refunds[req.Reference]; ok {
+		return nil, errors.New("fake gateway: payment already refunded")
+	}
+	refund := &Refund{
+		Reference:        req.Reference,
+		GatewayReference: "fake_rfd_" + hex.EncodeToString(id),
+		Status:           TransactionSuccess,
+		Amount:           req.Amount,
+	}
+	g.refunds[req.Reference] = refund
+
+	result := *refund
+	return &result, nil
+}
+
+// fakeDisputeStatuses maps the fake's dispute events to how the dispute
+// stands.
+var fakeDisputeStatuses = map[string]DisputeStatus{
+	"dispute.open": DisputeOpen,
+	"dispute.won":  DisputeWon,
+	"dispute.lost": DisputeLost,
+}
+
+// ParseWebhook accepts {"event": "...", "reference": "..."} bodies. The
+// transaction or transfer itself comes from the gateway's own records,
+// never the body. The dispute.open, dispute.won and dispute.lost events
+// raise and settle a chargeback against a successful payment.
+func (g *FakeGateway) ParseWebhook(r *http.Request) (*WebhookEvent, error) {
+	var body struct {
+		Event     string `json:"event"`
+		Reference string `json:"reference"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(body.Event, "transfer.") {
+		transfer, err := g.VerifyTransfer(r.Context(), body.Reference, "")
+		if err != nil {
+			return nil, err
+		}
+		return &WebhookEvent{Type: body.Event, Transfer: transfer}, nil
+	}
+	tx, err := g.VerifyTransaction(r.Context(), body.Reference)
+	if err != nil {
+		return nil, err
+	}
+	if status, ok := fakeDisputeStatuses[body.Event]; ok {
+		dispute := &Dispute{
+			Reference:        tx.Reference,
+			GatewayReference: "fake_dsp_" + strings.TrimPrefix(tx.GatewayReference, "fake_"),
+			Status:           status,
+			Amount:           tx.Amount,
+			Reason:           "fraudulent",
+		}
+		return &WebhookEvent{Type: body.Event, Dispute: dispute}, nil
+	}
+	return &WebhookEvent{Type: body.Event, Transaction: tx}, nil
+}
+
+// RegisterRoutes registers the fake hosted checkout page.
+func (g *FakeGateway) RegisterRoutes(r *gin.Engine) {
+	r.GET("/payments/fake/checkout", g.showCheckout)
+	r.POST("/payments/fake/checkout", g.completeCheckout)
+}
+
+func (g *FakeGateway) showCheckout(c *gin.Context) {
+	checkoutPage := filepath.Join("templates", "payments", "fake_checkout.html")
+
+	tx, err := g.VerifyTransaction(c, c.Query("reference"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Transaction": tx,
+	}
+	utils.Render(c, checkoutPage, data)
+}
+
+// completeCheckout settles the payment as the payer chose and sends them
+// back to the merchant, like a real hosted checkout would.
+func (g *FakeGateway) completeCheckout(c *gin.Context) {
+	reference := c.PostForm("reference")
+
+	g.mu.Lock()
+	tx, ok := g.transactions[reference]
+	if ok && tx.Status == TransactionPending {
+		switch outcome := c.PostForm("outcome"); outcome {
+		case "pay", "pay_once":
+			tx.Status = TransactionSuccess
+			tx.PaidAt = time.Now()
+			tx.Authorization = "fake_auth_" + tx.GatewayReference
+			g.authorizations[tx.Authorization] = outcome == "pay"
+		default:
+			tx.Status = TransactionFailed
+		}
+	}
+	g.mu.Unlock()
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	callback, err := url.Parse(tx.callbackURL)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	query := callback.Query()
+	query.Set("reference", reference)
+	callback.RawQuery = query.Encode()
+	c.Redirect(http.StatusSeeOther, callback.String())
+}
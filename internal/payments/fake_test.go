@@ -0,0 +1,120 @@
+package payments
+
+import (
+	"context"
+	"fmj/config"
+	"fmj/internal/money"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// withGinMode runs the test in mode, putting gin's mode back afterwards.
+func withGinMode(t *testing.T, mode string) {
+	previous := gin.Mode()
+	gin.SetMode(mode)
+	t.Cleanup(func() { gin.SetMode(previous) })
+}
+
+func TestNewGatewaysRequiresPaymentGateway(t *testing.T) {
+	withGinMode(t, gin.DebugMode)
+
+	if _, err := NewGateways(&config.Config{}); err == nil {
+		t.Fatal("NewGateways accepted an unset PAYMENT_GATEWAY")
+	}
+}
+
+func TestNewGatewaysFakeOnlyInDebugMode(t *testing.T) {
+	cfg := &config.Config{PaymentGateway: "fake", BaseURL: "http://localhost:7000"}
+
+	withGinMode(t, gin.ReleaseMode)
+	if _, err := NewGateways(cfg); err == nil {
+		t.Fatal("NewGateways allowed the fake gateway in release mode")
+	}
+
+	gin.SetMode(gin.DebugMode)
+	gateways, err := NewGateways(cfg)
+	if err != nil {
+		t.Fatalf("NewGateways: %v", err)
+	}
+	if name := gateways.Primary().Name(); name != "fake" {
+		t.Fatalf("primary gateway is %q, want fake", name)
+	}
+}
+
+// TestFakeCheckoutFlow pays through the fake hosted checkout the way a
+// supporter would: start the payment, approve it on the checkout page, get
+// sent back to the callback and verify it there.
+func TestFakeCheckoutFlow(t *testing.T) {
+	withGinMode(t, gin.TestMode)
+	ctx := context.Background()
+	gateway := NewFakeGateway("http://localhost:7000")
+	router := gin.New()
+	gateway.RegisterRoutes(router)
+
+	amount := money.New(150000, "NGN")
+	tx, err := gateway.InitializeTransaction(ctx, InitializeRequest{
+		Reference:   "fmj_test_1",
+		Amount:      amount,
+		Email:       "ada@example.com",
+		CallbackURL: "http://localhost:7000/payments/callback",
+	})
+	if err != nil {
+		t.Fatalf("InitializeTransaction: %v", err)
+	}
+	if tx.Status != TransactionPending {
+		t.Fatalf("new transaction is %s, want pending", tx.Status)
+	}
+	if !strings.Contains(tx.AuthorizationURL, "/payments/fake/checkout?reference=fmj_test_1") {
+		t.Fatalf("unexpected checkout URL %q", tx.AuthorizationURL)
+	}
+
+	form := url.Values{"reference": {"fmj_test_1"}, "outcome": {"pay"}}
+	req := httptest.NewRequest(http.MethodPost, "/payments/fake/checkout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout answered %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	callback, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parsing callback: %v", err)
+	}
+	if callback.Path != "/payments/callback" || callback.Query().Get("reference") != "fmj_test_1" {
+		t.Fatalf("redirected to %q, want the callback with the reference", callback)
+	}
+
+	verified, err := gateway.VerifyTransaction(ctx, callback.Query().Get("reference"))
+	if err != nil {
+		t.Fatalf("VerifyTransaction: %v", err)
+	}
+	if verified.Status != TransactionSuccess || verified.Amount != amount || verified.PaidAt.IsZero() {
+		t.Fatalf("verified %+v, want a paid transaction of %s", verified, amount)
+	}
+
+	// The payer agreed to later charges, so the authorization works.
+	charge, err := gateway.ChargeAuthorization(ctx, ChargeRequest{
+		Reference:     "fmj_test_2",
+		Authorization: verified.Authorization,
+		Amount:        amount,
+	})
+	if err != nil {
+		t.Fatalf("ChargeAuthorization: %v", err)
+	}
+	if charge.Status != TransactionSuccess {
+		t.Fatalf("charge is %s, want success", charge.Status)
+	}
+
+	refund, err := gateway.Refund(ctx, RefundRequest{Reference: "fmj_test_1", Amount: amount})
+	if err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if refund.Status != TransactionSuccess {
+		t.Fatalf("refund is %s, want success", refund.Status)
+	}
+}
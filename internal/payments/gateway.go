@@ -0,0 +1,230 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmj/config"
+	"fmj/internal/money"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ErrTransactionNotFound is returned by a gateway that has no record of a
+// reference.
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+// ErrUnknownGateway is returned for a gateway name that isn't configured.
+var ErrUnknownGateway = errors.New("unknown payment gateway")
+
+// ErrCannotResolve is returned by ResolveAccount when the gateway can't look
+// up who holds an account, as with most mobile money wallets.
+var ErrCannotResolve = errors.New("the account name can't be checked")
+
+// ErrInvalidSignature is returned by ParseWebhook when a request doesn't
+// carry the gateway's signature.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// TransactionStatus is a gateway's view of a payment.
+type TransactionStatus string
+
+const (
+	TransactionPending TransactionStatus = "pending"
+	TransactionSuccess TransactionStatus = "success"
+	TransactionFailed  TransactionStatus = "failed"
+)
+
+// InitializeRequest describes a payment to start with a gateway.
+type InitializeRequest struct {
+	Reference   string // ours, unique per payment
+	Email       string
+	Amount      money.Money
+	CallbackURL string // where the gateway sends the payer afterwards
+	Metadata    map[string]string
+}
+
+// Transaction is a payment as reported by a gateway.
+type Transaction struct {
+	Reference        string
+	GatewayReference string
+	Status           TransactionStatus
+	Amount           money.Money
+	Fee              money.Money // what the gateway kept, when it reports it
+	AuthorizationURL string      // hosted checkout page, set by InitializeTransaction
+	Authorization    string      // reusable token for charging the same payer again, if the gateway gave one
+	PaidAt           time.Time
+}
+
+// ChargeRequest charges a saved authorization without the payer present,
+// e.g. for a membership renewal.
+type ChargeRequest struct {
+	Reference     string
+	Email         string
+	Amount        money.Money
+	Authorization string
+	Metadata      map[string]string
+}
+
+// Bank is a bank, or a mobile money provider, that transfers can be sent to.
+// Codes are the gateway's own.
+type Bank struct {
+	Code        string
+	Name        string
+	MobileMoney bool
+}
+
+// PayoutAccount is a bank account or mobile money wallet to send money to.
+type PayoutAccount struct {
+	BankCode      string
+	AccountNumber string // the phone number for mobile money
+	AccountName   string
+	Currency      string
+	MobileMoney   bool
+}
+
+// TransferRequest sends money from the platform's gateway balance.
+type TransferRequest struct {
+	Reference string // ours, unique per transfer
+	Amount    money.Money
+	Account   PayoutAccount
+	Reason    string
+}
+
+// Transfer is a payout as reported by a gateway.
+type Transfer struct {
+	Reference        string
+	GatewayReference string
+	Status           TransactionStatus
+	Amount           money.Money
+	Failure          string // why it failed, when the gateway says
+}
+
+// RefundRequest gives a payer their money back.
+type RefundRequest struct {
+	Reference        string // the payment's, ours
+	GatewayReference string // the payment's, the gateway's
+	Amount           money.Money
+	Reason           string
+}
+
+// Refund is a refund as reported by a gateway.
+type Refund struct {
+	Reference        string // the refunded payment's, ours
+	GatewayReference string // the refund's own
+	Status           TransactionStatus
+	Amount           money.Money
+}
+
+// DisputeStatus is where a chargeback is with the card network.
+type DisputeStatus string
+
+const (
+	DisputeOpen DisputeStatus = "open"
+	DisputeWon  DisputeStatus = "won"  // the payment stands
+	DisputeLost DisputeStatus = "lost" // the payer got their money back
+)
+
+// Dispute is a chargeback a payer raised with their bank.
+type Dispute struct {
+	Reference        string // the disputed payment's, ours
+	GatewayReference string // the dispute's own
+	Status           DisputeStatus
+	Amount           money.Money
+	Reason           string
+}
+
+// WebhookEvent is a notification pushed by a gateway. Transaction is only
+// set for payment events, Transfer for transfer events, Refund for refund
+// events and Dispute for chargeback events.
+type WebhookEvent struct {
+	Type        string
+	Transaction *Transaction
+	Transfer    *Transfer
+	Refund      *Refund
+	Dispute     *Dispute
+}
+
+// Gateway is a payment provider. Implementations must not trust anything
+// they didn't get from the provider itself: ParseWebhook authenticates the
+// request, and VerifyTransaction asks the provider directly.
+type Gateway interface {
+	Name() string
+	InitializeTransaction(ctx context.Context, req InitializeRequest) (*Transaction, error)
+	VerifyTransaction(ctx context.Context, reference string) (*Transaction, error)
+	ChargeAuthorization(ctx context.Context, req ChargeRequest) (*Transaction, error)
+	ListBanks(ctx context.Context, currency string) ([]Bank, error)
+	ResolveAccount(ctx context.Context, account PayoutAccount) (string, error)
+	Transfer(ctx context.Context, req TransferRequest) (*Transfer, error)
+	VerifyTransfer(ctx context.Context, reference, gatewayReference string) (*Transfer, error)
+	Refund(ctx context.Context, req RefundRequest) (*Refund, error)
+	ParseWebhook(r *http.Request) (*WebhookEvent, error)
+}
+
+// Gateways is the registry of configured gateways. New checkouts go through
+// the primary one; existing payments are verified with whichever gateway
+// took them.
+type Gateways struct {
+	byName  map[string]Gateway
+	list    []Gateway
+	primary Gateway
+}
+
+// NewGateways sets up every gateway with credentials in cfg, plus the fake
+// gateway when it is selected, which is only allowed in gin's debug mode.
+// cfg.PaymentGateway picks the primary and must be set.
+func NewGateways(cfg *config.Config) (*Gateways, error) {
+	g := &Gateways{byName: make(map[string]Gateway)}
+
+	if cfg.PaystackSecretKey != "" {
+		g.add(NewPaystackGateway(cfg.PaystackBaseURL, cfg.PaystackSecretKey))
+	}
+	if cfg.FlutterwaveSecretKey != "" {
+		g.add(NewFlutterwaveGateway(cfg.FlutterwaveBaseURL, cfg.FlutterwaveSecretKey, cfg.FlutterwaveSecretHash))
+	}
+
+	primary := cfg.PaymentGateway
+	if primary == "" {
+		return nil, errors.New("PAYMENT_GATEWAY is not set")
+	}
+	if primary == "fake" {
+		// Anyone can approve payments on the fake checkout page.
+		if gin.Mode() != gin.DebugMode {
+			return nil, errors.New("the fake payment gateway only runs in gin's debug mode")
+		}
+		slog.Warn("Using the fake payment gateway, no real payments will be taken")
+		g.add(NewFakeGateway(cfg.BaseURL))
+	}
+
+	gateway, err := g.Get(primary)
+	if err != nil {
+		return nil, fmt.Errorf("payment gateway %q is not configured", primary)
+	}
+	g.primary = gateway
+	return g, nil
+}
+
+func (g *Gateways) add(gateway Gateway) {
+	g.byName[gateway.Name()] = gateway
+	g.list = append(g.list, gateway)
+}
+
+// Get returns the gateway registered under name.
+func (g *Gateways) Get(name string) (Gateway, error) {
+	gateway, ok := g.byName[name]
+	if !ok {
+		return nil, ErrUnknownGateway
+	}
+	return gateway, nil
+}
+
+// Primary returns the gateway new checkouts use.
+func (g *Gateways) Primary() Gateway {
+	return g.primary
+}
+
+// List returns every configured gateway.
+func (g *Gateways) List() []Gateway {
+	return g.list
+}
@@ -0,0 +1,291 @@
+package payments
+
+import (
+	"errors"
+	"fmj/internal/creators"
+	"fmj/internal/i18n"
+	"fmj/internal/utils"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+)
+
+// recentDonations is how many donations the creator's donations page shows.
+const recentDonations = 100
+
+type Handler struct {
+	service  Service
+	gateways *Gateways
+	creators creators.Service
+}
+
+func NewHandler(service Service, gateways *Gateways, creatorService creators.Service) *Handler {
+	return &Handler{service: service, gateways: gateways, creators: creatorService}
+}
+
+func (h *Handler) RegisterRoutes(r *gin.Engine) {
+	r.POST("/:slug/support", h.StartCheckout)
+	r.GET("/payments/callback", h.Callback)
+	r.POST("/payments/:gateway/webhook", h.Webhook)
+
+	for _, gateway := range h.gateways.List() {
+		if fake, ok := gateway.(*FakeGateway); ok {
+			fake.RegisterRoutes(r)
+		}
+	}
+}
+
+// RegisterDashboardRoutes registers the creator's earnings and donations
+// pages. r must already require authentication.
+func (h *Handler) RegisterDashboardRoutes(r *gin.RouterGroup) {
+	r.GET("/dashboard/earnings", h.ShowEarnings)
+	r.GET("/dashboard/donations", h.ShowDonations)
+	r.POST("/dashboard/donations/:reference/refund", h.RefundOwnDonation)
+}
+
+// RegisterAdminRoutes registers donation lookup, refunds and the open
+// chargebacks. r must already require the admin role.
+func (h *Handler) RegisterAdminRoutes(r *gin.RouterGroup) {
+	r.GET("/admin/donations", h.ShowAdminDonations)
+	r.POST("/admin/donations/:reference/refund", h.RefundDonation)
+}
+
+func (h *Handler) StartCheckout(c *gin.Context) {
+	var data map[string]interface{}
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	creator, err := h.creators.GetBySlug(c, c.Param("slug"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	units, _ := strconv.Atoi(c.PostForm("units"))
+	checkout := Checkout{
+		Units:     units,
+		Name:      c.PostForm("name"),
+		Message:   c.PostForm("message"),
+		Anonymous: c.PostForm("anonymous") != "",
+		Email:     c.PostForm("email"),
+		Locale:    c.GetString(utils.LocaleKey),
+	}
+
+	url, err := h.service.StartCheckout(c, creator, utils.CurrentUser(c), checkout)
+	if err != nil {
+		data = map[string]interface{}{
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
+		}
+		utils.Render(c, toastPage, data)
+		slog.Error("Error starting checkout", slog.String("creator", creator.Slug), slog.String("error", err.Error()))
+		return
+	}
+
+	// Send the supporter to the gateway's checkout page.
+	c.Header("HX-Redirect", url)
+}
+
+// Callback is where the gateway sends the supporter after paying.
+func (h *Handler) Callback(c *gin.Context) {
+	completePage := filepath.Join("templates", "payments", "donation_complete.html")
+
+	// Paystack sends our reference back as reference, Flutterwave as tx_ref.
+	reference := c.Query("reference")
+	if reference == "" {
+		reference = c.Query("tx_ref")
+	}
+	donation, err := h.service.ConfirmDonation(c, reference)
+	if errors.Is(err, ErrDonationNotFound) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Error confirming donation", slog.String("reference", reference), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+
+	if donation.SubscriptionID != nil {
+		// Memberships are managed from the supporter's dashboard.
+		c.Redirect(http.StatusSeeOther, "/dashboard/memberships")
+		return
+	}
+
+	creator, err := h.creators.GetByID(c, donation.CreatorID)
+	if err != nil {
+		slog.Error("Error loading creator", slog.String("creator_id", donation.CreatorID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Donation": donation,
+		"Creator":  creator,
+	}
+	utils.Render(c, completePage, data)
+}
+
+func (h *Handler) Webhook(c *gin.Context) {
+	gateway := c.Param("gateway")
+
+	err := h.service.HandleWebhook(c, gateway, c.Request)
+	switch {
+	case errors.Is(err, ErrUnknownGateway):
+		c.AbortWithStatus(http.StatusNotFound)
+	case errors.Is(err, ErrInvalidSignature):
+		slog.Warn("Rejected payment webhook with a bad signature", slog.String("gateway", gateway), slog.String("ip", c.ClientIP()))
+		c.AbortWithStatus(http.StatusUnauthorized)
+	case err != nil:
+		// Anything else is worth the gateway retrying.
+		slog.Error("Error handling payment webhook", slog.String("gateway", gateway), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+	default:
+		c.Status(http.StatusOK)
+	}
+}
+
+func (h *Handler) ShowEarnings(c *gin.Context) {
+	earningsPage := filepath.Join("templates", "pages", "dashboard_earnings.html")
+	user := utils.CurrentUser(c)
+
+	creator, err := h.creators.GetByUser(c, user.ID)
+	if errors.Is(err, creators.ErrCreatorNotFound) {
+		utils.RenderDashboard(c, earningsPage, nil)
+		return
+	}
+	if err != nil {
+		slog.Error("Error loading creator", slog.String("user_id", user.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	earnings, err := h.service.GetEarnings(c, creator)
+	if err != nil {
+		slog.Error("Error loading earnings", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Creator":  creator,
+		"Earnings": earnings,
+	}
+	utils.RenderDashboard(c, earningsPage, data)
+}
+
+func (h *Handler) ShowDonations(c *gin.Context) {
+	h.renderDonations(c, "")
+}
+
+// RefundOwnDonation lets a creator refund a donation made to them.
+func (h *Handler) RefundOwnDonation(c *gin.Context) {
+	user := utils.CurrentUser(c)
+
+	creator, err := h.creators.GetByUser(c, user.ID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	donation, err := h.service.GetDonation(c, c.Param("reference"))
+	if err != nil || donation.CreatorID != creator.ID {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := h.service.RefundDonation(c, donation, user, c.PostForm("reason")); err != nil {
+		slog.Error("Error refunding donation", slog.String("reference", donation.Reference), slog.String("error", err.Error()))
+		h.renderDonations(c, i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/donations?refunded=1")
+}
+
+func (h *Handler) renderDonations(c *gin.Context, errMsg string) {
+	donationsPage := filepath.Join("templates", "pages", "dashboard_donations.html")
+	user := utils.CurrentUser(c)
+
+	creator, err := h.creators.GetByUser(c, user.ID)
+	if errors.Is(err, creators.ErrCreatorNotFound) {
+		utils.RenderDashboard(c, donationsPage, nil)
+		return
+	}
+	if err != nil {
+		slog.Error("Error loading creator", slog.String("user_id", user.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	donations, err := h.service.RecentDonations(c, creator.ID, recentDonations)
+	if err != nil {
+		slog.Error("Error loading donations", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Creator":   creator,
+		"Donations": donations,
+		"Refunded":  c.Query("refunded") != "",
+		"Error":     errMsg,
+	}
+	utils.RenderDashboard(c, donationsPage, data)
+}
+
+func (h *Handler) ShowAdminDonations(c *gin.Context) {
+	h.renderAdminDonations(c, c.Query("reference"), "")
+}
+
+func (h *Handler) RefundDonation(c *gin.Context) {
+	reference := c.Param("reference")
+
+	donation, err := h.service.GetDonation(c, reference)
+	if errors.Is(err, ErrDonationNotFound) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Error loading donation", slog.String("reference", reference), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.service.RefundDonation(c, donation, utils.CurrentUser(c), c.PostForm("reason")); err != nil {
+		slog.Error("Error refunding donation", slog.String("reference", reference), slog.String("error", err.Error()))
+		h.renderAdminDonations(c, reference, i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/admin/donations?reference="+url.QueryEscape(reference))
+}
+
+// renderAdminDonations shows the donation with reference, if any, and the
+// open chargebacks.
+func (h *Handler) renderAdminDonations(c *gin.Context, reference, errMsg string) {
+	donationsPage := filepath.Join("templates", "pages", "admin_donations.html")
+
+	data := map[string]interface{}{
+		"Reference": reference,
+		"Error":     errMsg,
+	}
+	if reference != "" {
+		donation, err := h.service.GetDonation(c, reference)
+		if err != nil && !errors.Is(err, ErrDonationNotFound) {
+			slog.Error("Error loading donation", slog.String("reference", reference), slog.String("error", err.Error()))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		data["Donation"] = donation
+	}
+
+	disputed, err := h.service.DisputedDonations(c)
+	if err != nil {
+		slog.Error("Error loading disputed donations", slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	data["Disputed"] = disputed
+	utils.RenderDashboard(c, donationsPage, data)
+}
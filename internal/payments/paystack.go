@@ -0,0 +1,451 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmj/internal/money"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// maxWebhookBody caps how much of a webhook request is read.
+const maxWebhookBody = 1 << 20
+
+// gatewayHTTPTimeout bounds every call to a gateway API.
+const gatewayHTTPTimeout = 15 * time.Second
+
+// PaystackGateway takes payments through Paystack. Amounts are sent in the
+// currency's subunit, which matches our minor units.
+type PaystackGateway struct {
+	baseURL   string
+	secretKey string
+	client    *http.Client
+}
+
+func NewPaystackGateway(baseURL, secretKey string) *PaystackGateway {
+	return &PaystackGateway{
+		baseURL:   baseURL,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: gatewayHTTPTimeout},
+	}
+}
+
+func (g *PaystackGateway) Name() string {
+	return "paystack"
+}
+
+// paystackTransaction is the transaction object in verify responses and
+// charge webhooks.
+type paystackTransaction struct {
+	ID        int64  `json:"id"`
+	Status    string `json:"status"`
+	Reference string `json:"reference"`
+	Amount    int64  `json:"amount"`
+	Fees      int64  `json:"fees"`
+	Currency  string `json:"currency"`
+	PaidAt    string `json:"paid_at"`
+
+	Authorization struct {
+		Code     string `json:"authorization_code"`
+		Reusable bool   `json:"reusable"`
+	} `json:"authorization"`
+}
+
+func (t paystackTransaction) toTransaction() *Transaction {
+	tx := &Transaction{
+		Reference:        t.Reference,
+		GatewayReference: strconv.FormatInt(t.ID, 10),
+		Amount:           money.New(t.Amount, t.Currency),
+		Fee:              money.New(t.Fees, t.Currency),
+	}
+	switch t.Status {
+	case "success":
+		tx.Status = TransactionSuccess
+	case "failed", "abandoned", "reversed":
+		tx.Status = TransactionFailed
+	default:
+		tx.Status = TransactionPending
+	}
+	tx.PaidAt, _ = time.Parse(time.RFC3339, t.PaidAt)
+	if t.Authorization.Reusable {
+		tx.Authorization = t.Authorization.Code
+	}
+	return tx
+}
+
+func (g *PaystackGateway) InitializeTransaction(ctx context.Context, req InitializeRequest) (*Transaction, error) {
+	body := map[string]interface{}{
+		"reference":    req.Reference,
+		"email":        req.Email,
+		"amount":       req.Amount.Minor,
+		"currency":     req.Amount.Currency,
+		"callback_url": req.CallbackURL,
+		"metadata":     req.Metadata,
+	}
+	var data struct {
+		AuthorizationURL string `json:"authorization_url"`
+		Reference        string `json:"reference"`
+	}
+	if err := g.do(ctx, http.MethodPost, "/transaction/initialize", body, &data); err != nil {
+		return nil, err
+	}
+
+	return &Transaction{
+		Reference:        req.Reference,
+		Status:           TransactionPending,
+		Amount:           req.Amount,
+		AuthorizationURL: data.AuthorizationURL,
+	}, nil
+}
+
+func (g *PaystackGateway) VerifyTransaction(ctx context.Context, reference string) (*Transaction, error) {
+	var data paystackTransaction
+	if err := g.do(ctx, http.MethodGet, "/transaction/verify/"+url.PathEscape(reference), nil, &data); err != nil {
+		return nil, err
+	}
+	return data.toTransaction(), nil
+}
+
+func (g *PaystackGateway) ChargeAuthorization(ctx context.Context, req ChargeRequest) (*Transaction, error) {
+	body := map[string]interface{}{
+		"reference":          req.Reference,
+		"email":              req.Email,
+		"amount":             req.Amount.Minor,
+		"currency":           req.Amount.Currency,
+		"authorization_code": req.Authorization,
+		"metadata":           req.Metadata,
+	}
+	var data paystackTransaction
+	if err := g.do(ctx, http.MethodPost, "/transaction/charge_authorization", body, &data); err != nil {
+		return nil, err
+	}
+	return data.toTransaction(), nil
+}
+
+// ListBanks lists the banks and, where Paystack supports them, mobile money
+// providers that take transfers in currency.
+func (g *PaystackGateway) ListBanks(ctx context.Context, currency string) ([]Bank, error) {
+	var data []struct {
+		Name   string `json:"name"`
+		Code   string `json:"code"`
+		Type   string `json:"type"`
+		Active bool   `json:"active"`
+	}
+	if err := g.do(ctx, http.MethodGet, "/bank?currency="+url.QueryEscape(currency), nil, &data); err != nil {
+		return nil, err
+	}
+
+	banks := make([]Bank, 0, len(data))
+	for _, bank := range data {
+		if !bank.Active {
+			continue
+		}
+		banks = append(banks, Bank{Code: bank.Code, Name: bank.Name, MobileMoney: bank.Type == "mobile_money"})
+	}
+	return banks, nil
+}
+
+// ResolveAccount looks up the holder of a Nigerian or Ghanaian bank
+// account. Paystack can't resolve anything else.
+func (g *PaystackGateway) ResolveAccount(ctx context.Context, account PayoutAccount) (string, error) {
+	if account.MobileMoney || (account.Currency != "NGN" && account.Currency != "GHS") {
+		return "", ErrCannotResolve
+	}
+
+	var data struct {
+		AccountName string `json:"account_name"`
+	}
+	path := "/bank/resolve?account_number=" + url.QueryEscape(account.AccountNumber) + "&bank_code=" + url.QueryEscape(account.BankCode)
+	if err := g.do(ctx, http.MethodGet, path, nil, &data); err != nil {
+		return "", err
+	}
+	return data.AccountName, nil
+}
+
+// paystackRecipientTypes are Paystack's transfer recipient types for bank
+// accounts in each currency.
+var paystackRecipientTypes = map[string]string{
+	"NGN": "nuban",
+	"GHS": "ghipss",
+	"KES": "kepss",
+	"ZAR": "basa",
+}
+
+// paystackTransfer is the transfer object in transfer responses and
+// webhooks.
+type paystackTransfer struct {
+	Reference    string `json:"reference"`
+	TransferCode string `json:"transfer_code"`
+	Status       string `json:"status"`
+	Amount       int64  `json:"amount"`
+	Currency     string `json:"currency"`
+}
+
+func (t paystackTransfer) toTransfer() *Transfer {
+	transfer := &Transfer{
+		Reference:        t.Reference,
+		GatewayReference: t.TransferCode,
+		Amount:           money.New(t.Amount, t.Currency),
+	}
+	switch t.Status {
+	case "success":
+		transfer.Status = TransactionSuccess
+	case "failed", "abandoned", "blocked", "rejected":
+		transfer.Status = TransactionFailed
+		transfer.Failure = "the transfer was " + t.Status
+	case "reversed":
+		transfer.Status = TransactionFailed
+		transfer.Failure = "the bank sent the transfer back"
+	default:
+		transfer.Status = TransactionPending
+	}
+	return transfer
+}
+
+// Transfer creates a transfer recipient for the account and sends the
+// money to it from the Paystack balance.
+func (g *PaystackGateway) Transfer(ctx context.Context, req TransferRequest) (*Transfer, error) {
+	recipientType := paystackRecipientTypes[req.Account.Currency]
+	if req.Account.MobileMoney {
+		recipientType = "mobile_money"
+	}
+	if recipientType == "" {
+		return nil, fmt.Errorf("paystack: transfers in %s aren't supported", req.Account.Currency)
+	}
+
+	var recipient struct {
+		RecipientCode string `json:"recipient_code"`
+	}
+	err := g.do(ctx, http.MethodPost, "/transferrecipient", map[string]interface{}{
+		"type":           recipientType,
+		"name":           req.Account.AccountName,
+		"account_number": req.Account.AccountNumber,
+		"bank_code":      req.Account.BankCode,
+		"currency":       req.Account.Currency,
+	}, &recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	var data paystackTransfer
+	err = g.do(ctx, http.MethodPost, "/transfer", map[string]interface{}{
+		"source":    "balance",
+		"amount":    req.Amount.Minor,
+		"currency":  req.Amount.Currency,
+		"recipient": recipient.RecipientCode,
+		"reference": req.Reference,
+		"reason":    req.Reason,
+	}, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.toTransfer(), nil
+}
+
+func (g *PaystackGateway) VerifyTransfer(ctx context.Context, reference, gatewayReference string) (*Transfer, error) {
+	var data paystackTransfer
+	if err := g.do(ctx, http.MethodGet, "/transfer/verify/"+url.PathEscape(reference), nil, &data); err != nil {
+		return nil, err
+	}
+	return data.toTransfer(), nil
+}
+
+// paystackRefund is the refund object in refund responses and webhooks.
+// Responses nest the refunded transaction; webhooks only carry its
+// reference.
+type paystackRefund struct {
+	ID                   int64  `json:"id"`
+	RefundReference      string `json:"refund_reference"`
+	TransactionReference string `json:"transaction_reference"`
+	Status               string `json:"status"`
+	Amount               int64  `json:"amount"`
+	Currency             string `json:"currency"`
+
+	Transaction *struct {
+		Reference string `json:"reference"`
+	} `json:"transaction"`
+}
+
+func (r paystackRefund) toRefund() *Refund {
+	refund := &Refund{
+		Reference:        r.TransactionReference,
+		GatewayReference: r.RefundReference,
+		Amount:           money.New(r.Amount, r.Currency),
+	}
+	if r.Transaction != nil {
+		refund.Reference = r.Transaction.Reference
+	}
+	if refund.GatewayReference == "" {
+		refund.GatewayReference = strconv.FormatInt(r.ID, 10)
+	}
+	switch r.Status {
+	case "processed":
+		refund.Status = TransactionSuccess
+	case "failed":
+		refund.Status = TransactionFailed
+	default:
+		refund.Status = TransactionPending
+	}
+	return refund
+}
+
+func (g *PaystackGateway) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	var data paystackRefund
+	err := g.do(ctx, http.MethodPost, "/refund", map[string]interface{}{
+		"transaction":   req.Reference,
+		"amount":        req.Amount.Minor,
+		"currency":      req.Amount.Currency,
+		"merchant_note": req.Reason,
+	}, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.toRefund(), nil
+}
+
+// paystackDispute is the dispute object in chargeback webhooks.
+type paystackDispute struct {
+	ID           int64  `json:"id"`
+	RefundAmount int64  `json:"refund_amount"`
+	Currency     string `json:"currency"`
+	Status       string `json:"status"`
+	Resolution   string `json:"resolution"`
+	Category     string `json:"category"`
+
+	Transaction struct {
+		Reference string `json:"reference"`
+		Amount    int64  `json:"amount"`
+	} `json:"transaction"`
+}
+
+func (d paystackDispute) toDispute() *Dispute {
+	dispute := &Dispute{
+		Reference:        d.Transaction.Reference,
+		GatewayReference: strconv.FormatInt(d.ID, 10),
+		Status:           DisputeOpen,
+		Amount:           money.New(d.RefundAmount, d.Currency),
+		Reason:           d.Category,
+	}
+	if d.RefundAmount == 0 {
+		dispute.Amount = money.New(d.Transaction.Amount, d.Currency)
+	}
+	if d.Status == "resolved" {
+		// The merchant accepting the dispute means the payer wins it.
+		if d.Resolution == "declined" {
+			dispute.Status = DisputeWon
+		} else {
+			dispute.Status = DisputeLost
+		}
+	}
+	return dispute
+}
+
+// ParseWebhook checks the x-paystack-signature header, an HMAC-SHA512 of the
+// raw body keyed with the secret key.
+func (g *PaystackGateway) ParseWebhook(r *http.Request) (*WebhookEvent, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha512.New, []byte(g.secretKey))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("x-paystack-signature"))) {
+		return nil, ErrInvalidSignature
+	}
+
+	var payload struct {
+		Event string          `json:"event"`
+		Data  json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	event := &WebhookEvent{Type: payload.Event}
+	switch payload.Event {
+	case "charge.success":
+		var data paystackTransaction
+		if err := json.Unmarshal(payload.Data, &data); err != nil {
+			return nil, err
+		}
+		event.Transaction = data.toTransaction()
+	case "transfer.success", "transfer.failed", "transfer.reversed":
+		var data paystackTransfer
+		if err := json.Unmarshal(payload.Data, &data); err != nil {
+			return nil, err
+		}
+		event.Transfer = data.toTransfer()
+	case "refund.processed", "refund.failed":
+		var data paystackRefund
+		if err := json.Unmarshal(payload.Data, &data); err != nil {
+			return nil, err
+		}
+		event.Refund = data.toRefund()
+	case "charge.dispute.create", "charge.dispute.resolve":
+		var data paystackDispute
+		if err := json.Unmarshal(payload.Data, &data); err != nil {
+			return nil, err
+		}
+		event.Dispute = data.toDispute()
+	}
+	return event, nil
+}
+
+// do calls the Paystack API and decodes the data field of its response
+// envelope into out.
+func (g *PaystackGateway) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, g.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.secretKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var envelope struct {
+		Status  bool            `json:"status"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxWebhookBody)).Decode(&envelope); err != nil {
+		return fmt.Errorf("paystack: %s %s: %s", method, path, res.Status)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return ErrTransactionNotFound
+	}
+	if res.StatusCode >= 300 || !envelope.Status {
+		return fmt.Errorf("paystack: %s %s: %s: %s", method, path, res.Status, envelope.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	if len(envelope.Data) == 0 {
+		return errors.New("paystack: empty response data")
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
@@ -0,0 +1,279 @@
+package payments
+
+import (
+	"context"
+	"fmj/internal/models"
+	"fmj/internal/money"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Repository interface {
+	CreateDonation(ctx context.Context, donation *models.Donation) error
+	FindDonationByReference(ctx context.Context, reference string) (*models.Donation, error)
+	SetGatewayReference(ctx context.Context, reference, gatewayReference string) error
+	SettleDonation(ctx context.Context, reference, gatewayReference string, status models.DonationStatus, paidAt time.Time) (bool, error)
+	TransitionDonation(ctx context.Context, donation *models.Donation, from models.DonationStatus) (bool, error)
+	FindDonationsByCreator(ctx context.Context, creatorID primitive.ObjectID, limit int64) ([]*models.Donation, error)
+	FindDonationsByStatus(ctx context.Context, status models.DonationStatus) ([]*models.Donation, error)
+	EventProcessed(ctx context.Context, gateway, key string) (bool, error)
+	RecordEvent(ctx context.Context, gateway, key string) error
+	EarningsByCurrency(ctx context.Context, creatorID primitive.ObjectID) ([]money.Money, error)
+	EachSettledDonation(ctx context.Context, fn func(*models.Donation) error) error
+	CampaignRaised(ctx context.Context, campaignID primitive.ObjectID) ([]money.Money, int, error)
+	EnsureIndexes(ctx context.Context) error
+	MigrateMoneyFields(ctx context.Context) error
+}
+
+type repository struct {
+	db *mongo.Database
+}
+
+func (r repository) CreateDonation(ctx context.Context, donation *models.Donation) error {
+	donation.CreatedAt = time.Now()
+	donation.UpdatedAt = time.Now()
+
+	result, err := r.db.Collection("donations").InsertOne(ctx, donation)
+	if err != nil {
+		return err
+	}
+	donation.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (r repository) FindDonationByReference(ctx context.Context, reference string) (*models.Donation, error) {
+	var donation models.Donation
+	err := r.db.Collection("donations").FindOne(ctx, bson.M{"reference": reference}).Decode(&donation)
+	if err != nil {
+		return nil, err
+	}
+	return &donation, nil
+}
+
+func (r repository) SetGatewayReference(ctx context.Context, reference, gatewayReference string) error {
+	_, err := r.db.Collection("donations").UpdateOne(
+		ctx,
+		bson.M{"reference": reference},
+		bson.M{"$set": bson.M{"gateway_reference": gatewayReference, "updated_at": time.Now()}},
+	)
+	return err
+}
+
+// SettleDonation moves a pending donation to status. It reports false when
+// the donation was already settled, so callbacks and webhooks racing each
+// other only settle it once.
+func (r repository) SettleDonation(ctx context.Context, reference, gatewayReference string, status models.DonationStatus, paidAt time.Time) (bool, error) {
+	set := bson.M{"status": status, "updated_at": time.Now()}
+	if gatewayReference != "" {
+		set["gateway_reference"] = gatewayReference
+	}
+	if !paidAt.IsZero() {
+		set["paid_at"] = paidAt
+	}
+	res, err := r.db.Collection("donations").UpdateOne(
+		ctx,
+		bson.M{"reference": reference, "status": models.DonationPending},
+		bson.M{"$set": set},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// TransitionDonation saves donation if it is still in status from. It
+// reports false when something else moved it on first. A donation that is
+// no longer paid comes off the wall, so it is unpinned too.
+func (r repository) TransitionDonation(ctx context.Context, donation *models.Donation, from models.DonationStatus) (bool, error) {
+	donation.UpdatedAt = time.Now()
+	if donation.Status != models.DonationSucceeded {
+		donation.Pinned = false
+	}
+	res, err := r.db.Collection("donations").ReplaceOne(
+		ctx,
+		bson.M{"_id": donation.ID, "status": from},
+		donation,
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// FindDonationsByCreator returns the creator's settled donations, newest
+// first.
+func (r repository) FindDonationsByCreator(ctx context.Context, creatorID primitive.ObjectID, limit int64) ([]*models.Donation, error) {
+	return r.findDonations(ctx, bson.M{
+		"creator_id": creatorID,
+		"status":     bson.M{"$nin": bson.A{models.DonationPending, models.DonationFailed}},
+	}, limit)
+}
+
+// FindDonationsByStatus returns the donations in status, newest first.
+func (r repository) FindDonationsByStatus(ctx context.Context, status models.DonationStatus) ([]*models.Donation, error) {
+	return r.findDonations(ctx, bson.M{"status": status}, 0)
+}
+
+func (r repository) findDonations(ctx context.Context, filter bson.M, limit int64) ([]*models.Donation, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cursor, err := r.db.Collection("donations").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var donations []*models.Donation
+	if err := cursor.All(ctx, &donations); err != nil {
+		return nil, err
+	}
+	return donations, nil
+}
+
+// EventProcessed reports whether a webhook event was already handled.
+func (r repository) EventProcessed(ctx context.Context, gateway, key string) (bool, error) {
+	count, err := r.db.Collection("payment_events").CountDocuments(ctx, bson.M{"gateway": gateway, "key": key})
+	return count > 0, err
+}
+
+// RecordEvent remembers that a webhook event has been handled. Recording
+// the same event twice is not an error.
+func (r repository) RecordEvent(ctx context.Context, gateway, key string) error {
+	_, err := r.db.Collection("payment_events").InsertOne(ctx, bson.M{
+		"gateway":      gateway,
+		"key":          key,
+		"processed_at": time.Now(),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// EarningsByCurrency totals a creator's succeeded donations in each
+// currency they were paid in.
+func (r repository) EarningsByCurrency(ctx context.Context, creatorID primitive.ObjectID) ([]money.Money, error) {
+	cursor, err := r.db.Collection("donations").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"creator_id": creatorID, "status": models.DonationSucceeded}}},
+		{{Key: "$group", Value: bson.M{"_id": "$amount.currency", "minor": bson.M{"$sum": "$amount.minor"}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var totals []money.Money
+	for cursor.Next(ctx) {
+		var row struct {
+			Currency string `bson:"_id"`
+			Minor    int64  `bson:"minor"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, err
+		}
+		totals = append(totals, money.New(row.Minor, row.Currency))
+	}
+	return totals, cursor.Err()
+}
+
+// EachSettledDonation calls fn with every donation that got past
+// checkout, oldest first, stopping at the first error.
+func (r repository) EachSettledDonation(ctx context.Context, fn func(*models.Donation) error) error {
+	cursor, err := r.db.Collection("donations").Find(
+		ctx,
+		bson.M{"status": bson.M{"$nin": bson.A{models.DonationPending, models.DonationFailed}}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var donation models.Donation
+		if err := cursor.Decode(&donation); err != nil {
+			return err
+		}
+		if err := fn(&donation); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// CampaignRaised totals a campaign's succeeded donations in each currency
+// they were paid in, and counts them.
+func (r repository) CampaignRaised(ctx context.Context, campaignID primitive.ObjectID) ([]money.Money, int, error) {
+	cursor, err := r.db.Collection("donations").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"campaign_id": campaignID, "status": models.DonationSucceeded}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$amount.currency",
+			"minor": bson.M{"$sum": "$amount.minor"},
+			"count": bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var totals []money.Money
+	count := 0
+	for cursor.Next(ctx) {
+		var row struct {
+			Currency string `bson:"_id"`
+			Minor    int64  `bson:"minor"`
+			Count    int    `bson:"count"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, 0, err
+		}
+		totals = append(totals, money.New(row.Minor, row.Currency))
+		count += row.Count
+	}
+	return totals, count, cursor.Err()
+}
+
+func (r repository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.db.Collection("donations").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "reference", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "creator_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "campaign_id", Value: 1}, {Key: "status", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Gateways stop retrying long before processed events expire.
+	_, err = r.db.Collection("payment_events").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "gateway", Value: 1}, {Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "processed_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(90 * 24 * 60 * 60)},
+	})
+	return err
+}
+
+// MigrateMoneyFields moves donations saved with bare minor-unit amounts and
+// a separate currency to the money document shape.
+func (r repository) MigrateMoneyFields(ctx context.Context) error {
+	_, err := r.db.Collection("donations").UpdateMany(
+		ctx,
+		bson.M{"amount": bson.M{"$type": "number"}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"unit_price": bson.M{"minor": bson.M{"$toLong": "$unit_price"}, "currency": "$currency"},
+				"amount":     bson.M{"minor": bson.M{"$toLong": "$amount"}, "currency": "$currency"},
+			}}},
+			{{Key: "$unset", Value: "currency"}},
+		},
+	)
+	return err
+}
+
+func NewRepository(db *mongo.Database) Repository {
+	return &repository{db}
+}
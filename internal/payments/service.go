@@ -0,0 +1,813 @@
+package payments
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmj/config"
+	"fmj/internal/creators"
+	"fmj/internal/email"
+	"fmj/internal/fx"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmj/internal/money"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// ErrDonationNotFound is returned for an unknown payment reference.
+var ErrDonationNotFound = i18n.NewError("payments.error.donation_not_found")
+
+// ErrNoAuthorization is returned when charging a subscription that has no
+// saved payment authorization to charge.
+var ErrNoAuthorization = errors.New("no saved payment authorization")
+
+// ErrInvalidTransition is returned for a status change the donation status
+// machine doesn't allow, e.g. refunding a donation that was never paid.
+var ErrInvalidTransition = i18n.NewError("payments.error.invalid_transition")
+
+const (
+	// maxUnits caps how many jollofs fit in one donation.
+	maxUnits = 100
+
+	maxNameLength    = 60
+	maxMessageLength = 500
+)
+
+// Checkout is what a supporter fills in on a creator's page.
+type Checkout struct {
+	Units      int
+	Name       string
+	Message    string
+	Email      string
+	Anonymous  bool                // keep the name off the supporter wall
+	CampaignID *primitive.ObjectID // the campaign given towards, if any
+	Locale     string              // the language the supporter gave in, for their emails
+}
+
+// Earnings sums up what a creator has been paid.
+type Earnings struct {
+	ByCurrency []money.Money // as paid, one entry per currency
+	Total      money.Money   // converted to the creator's payout currency
+	Converted  bool          // false when exchange rates weren't available
+}
+
+// SettlementListener hears about each donation once, when it settles, along
+// with the gateway's view of the payment.
+type SettlementListener interface {
+	DonationSettled(ctx context.Context, donation *models.Donation, tx *Transaction) error
+}
+
+// StatusListener hears about settled donations changing status, when they
+// are refunded or a chargeback is raised or settled against them. from is
+// the status the donation had before.
+type StatusListener interface {
+	DonationStatusChanged(ctx context.Context, donation *models.Donation, from models.DonationStatus) error
+}
+
+// UserFinder looks up users. auth.Repository satisfies it.
+type UserFinder interface {
+	FindUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error)
+}
+
+// TransferListener hears about transfers a gateway reports on through its
+// webhook, after they have been verified with the gateway.
+type TransferListener interface {
+	TransferUpdated(ctx context.Context, gateway string, transfer *Transfer) error
+}
+
+type Service interface {
+	StartCheckout(ctx context.Context, creator *models.Creator, supporter *models.User, checkout Checkout) (string, error)
+	StartSubscriptionCheckout(ctx context.Context, creator *models.Creator, subscription *models.Subscription) (string, error)
+	ChargeSubscription(ctx context.Context, subscription *models.Subscription) (*models.Donation, error)
+	ConfirmDonation(ctx context.Context, reference string) (*models.Donation, error)
+	HandleWebhook(ctx context.Context, gateway string, r *http.Request) error
+	GetDonation(ctx context.Context, reference string) (*models.Donation, error)
+	RefundDonation(ctx context.Context, donation *models.Donation, by *models.User, reason string) error
+	RecentDonations(ctx context.Context, creatorID primitive.ObjectID, limit int64) ([]*models.Donation, error)
+	DisputedDonations(ctx context.Context) ([]*models.Donation, error)
+	GetEarnings(ctx context.Context, creator *models.Creator) (*Earnings, error)
+	CampaignRaised(ctx context.Context, campaignID primitive.ObjectID, currency string) (money.Money, int, error)
+	EachSettledDonation(ctx context.Context, fn func(*models.Donation) error) error
+	OnSettled(listener SettlementListener)
+	OnTransfer(listener TransferListener)
+	OnStatusChanged(listener StatusListener)
+}
+
+type service struct {
+	repo     Repository
+	gateways *Gateways
+	rates    fx.Service
+	email    email.Service
+	creators creators.Service
+	users    UserFinder
+	config   *config.Config
+
+	listeners         []SettlementListener
+	transferListeners []TransferListener
+	statusListeners   []StatusListener
+}
+
+// StartCheckout records a pending donation and returns the gateway page the
+// supporter should be sent to. supporter is nil for guests.
+func (s *service) StartCheckout(ctx context.Context, creator *models.Creator, supporter *models.User, checkout Checkout) (string, error) {
+	if creator.UnitPrice.Minor <= 0 {
+		return "", i18n.NewError("payments.error.not_accepting")
+	}
+	if checkout.Units < 1 || checkout.Units > maxUnits {
+		return "", i18n.NewError("payments.error.units", "count", maxUnits)
+	}
+
+	name := strings.TrimSpace(checkout.Name)
+	if len([]rune(name)) > maxNameLength {
+		return "", i18n.NewError("payments.error.name_too_long", "count", maxNameLength)
+	}
+	message := strings.TrimSpace(checkout.Message)
+	if len([]rune(message)) > maxMessageLength {
+		return "", i18n.NewError("payments.error.message_too_long", "count", maxMessageLength)
+	}
+
+	email := strings.TrimSpace(checkout.Email)
+	if supporter != nil {
+		email = supporter.Email
+	}
+	if _, err := mail.ParseAddress(email); err != nil {
+		return "", i18n.NewError("payments.error.email")
+	}
+
+	donation := &models.Donation{
+		CreatorID:  creator.ID,
+		Units:      checkout.Units,
+		UnitPrice:  creator.UnitPrice,
+		Amount:     creator.UnitPrice.Mul(int64(checkout.Units)),
+		Name:       name,
+		Message:    message,
+		Email:      email,
+		Anonymous:  checkout.Anonymous,
+		Locale:     checkout.Locale,
+		CampaignID: checkout.CampaignID,
+	}
+	if supporter != nil {
+		donation.SupporterID = &supporter.ID
+	}
+	metadata := map[string]string{
+		"creator_id": creator.ID.Hex(),
+		"units":      fmt.Sprint(checkout.Units),
+	}
+	if checkout.CampaignID != nil {
+		metadata["campaign_id"] = checkout.CampaignID.Hex()
+	}
+	return s.startHostedCheckout(ctx, donation, metadata)
+}
+
+// StartSubscriptionCheckout takes the first month's payment for a
+// membership through the gateway's hosted checkout, which also gives us the
+// authorization to charge renewals with.
+func (s *service) StartSubscriptionCheckout(ctx context.Context, creator *models.Creator, subscription *models.Subscription) (string, error) {
+	donation := &models.Donation{
+		CreatorID:      creator.ID,
+		SupporterID:    &subscription.SupporterID,
+		SubscriptionID: &subscription.ID,
+		Units:          1,
+		UnitPrice:      subscription.Price,
+		Amount:         subscription.Price,
+		Email:          subscription.Email,
+	}
+	return s.startHostedCheckout(ctx, donation, map[string]string{
+		"creator_id":      creator.ID.Hex(),
+		"subscription_id": subscription.ID.Hex(),
+	})
+}
+
+// startHostedCheckout records donation as pending with the primary gateway
+// and returns the gateway page the payer should be sent to.
+func (s *service) startHostedCheckout(ctx context.Context, donation *models.Donation, metadata map[string]string) (string, error) {
+	reference, err := generateReference()
+	if err != nil {
+		return "", err
+	}
+	gateway := s.gateways.Primary()
+
+	donation.Status = models.DonationPending
+	donation.Gateway = gateway.Name()
+	donation.Reference = reference
+	if err := s.repo.CreateDonation(ctx, donation); err != nil {
+		return "", err
+	}
+
+	tx, err := gateway.InitializeTransaction(ctx, InitializeRequest{
+		Reference:   reference,
+		Email:       donation.Email,
+		Amount:      donation.Amount,
+		CallbackURL: s.config.BaseURL + "/payments/callback",
+		Metadata:    metadata,
+	})
+	if err != nil {
+		if _, settleErr := s.repo.SettleDonation(ctx, reference, "", models.DonationFailed, time.Time{}); settleErr != nil {
+			slog.Error("Error failing donation", slog.String("reference", reference), slog.String("error", settleErr.Error()))
+		}
+		return "", err
+	}
+
+	if tx.GatewayReference != "" {
+		if err := s.repo.SetGatewayReference(ctx, reference, tx.GatewayReference); err != nil {
+			slog.Error("Error saving gateway reference", slog.String("reference", reference), slog.String("error", err.Error()))
+		}
+	}
+	return tx.AuthorizationURL, nil
+}
+
+// ChargeSubscription charges a membership renewal to the subscription's
+// saved authorization. The donation settles like any other, at once or
+// when the gateway's webhook arrives, and listeners hear about it then. If
+// the gateway call fails the donation is returned along with the error,
+// still pending, as the charge may have gone through anyway.
+func (s *service) ChargeSubscription(ctx context.Context, subscription *models.Subscription) (*models.Donation, error) {
+	if subscription.Authorization == "" {
+		return nil, ErrNoAuthorization
+	}
+	gateway, err := s.gateways.Get(subscription.Gateway)
+	if err != nil {
+		return nil, fmt.Errorf("subscription %s: %w", subscription.ID.Hex(), err)
+	}
+	reference, err := generateReference()
+	if err != nil {
+		return nil, err
+	}
+
+	donation := &models.Donation{
+		CreatorID:      subscription.CreatorID,
+		SupporterID:    &subscription.SupporterID,
+		SubscriptionID: &subscription.ID,
+		Units:          1,
+		UnitPrice:      subscription.Price,
+		Amount:         subscription.Price,
+		Email:          subscription.Email,
+		Status:         models.DonationPending,
+		Gateway:        gateway.Name(),
+		Reference:      reference,
+	}
+	if err := s.repo.CreateDonation(ctx, donation); err != nil {
+		return nil, err
+	}
+
+	tx, err := gateway.ChargeAuthorization(ctx, ChargeRequest{
+		Reference:     reference,
+		Email:         donation.Email,
+		Amount:        donation.Amount,
+		Authorization: subscription.Authorization,
+		Metadata: map[string]string{
+			"creator_id":      subscription.CreatorID.Hex(),
+			"subscription_id": subscription.ID.Hex(),
+		},
+	})
+	if err != nil {
+		// We can't tell whether the gateway took the charge, so leave the
+		// donation pending for its webhook rather than charging again.
+		return donation, fmt.Errorf("charging subscription %s: %w", subscription.ID.Hex(), err)
+	}
+	if err := s.settle(ctx, donation, tx); err != nil {
+		return nil, err
+	}
+	return s.GetDonation(ctx, reference)
+}
+
+// ConfirmDonation asks the gateway how a payment went and settles the
+// donation accordingly. It is safe to call any number of times.
+func (s *service) ConfirmDonation(ctx context.Context, reference string) (*models.Donation, error) {
+	donation, err := s.GetDonation(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	if donation.Status != models.DonationPending {
+		return donation, nil
+	}
+
+	gateway, err := s.gateways.Get(donation.Gateway)
+	if err != nil {
+		return nil, fmt.Errorf("donation %s: %w", reference, err)
+	}
+	tx, err := gateway.VerifyTransaction(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.settle(ctx, donation, tx); err != nil {
+		return nil, err
+	}
+	// Re-read in case a concurrent webhook settled it first.
+	return s.GetDonation(ctx, reference)
+}
+
+// settle moves a pending donation to the outcome of tx, unless tx is still
+// pending, and tells the listeners if this call was the one to settle it.
+func (s *service) settle(ctx context.Context, donation *models.Donation, tx *Transaction) error {
+	switch {
+	case tx.Status == TransactionPending:
+		return nil
+	case tx.Status == TransactionSuccess && tx.Amount == donation.Amount:
+		donation.Status = models.DonationSucceeded
+		donation.PaidAt = tx.PaidAt
+	default:
+		if tx.Status == TransactionSuccess {
+			slog.Error("Gateway amount doesn't match donation",
+				slog.String("reference", donation.Reference),
+				slog.String("expected", donation.Amount.String()),
+				slog.String("got", tx.Amount.String()))
+		}
+		donation.Status = models.DonationFailed
+	}
+
+	settled, err := s.repo.SettleDonation(ctx, donation.Reference, tx.GatewayReference, donation.Status, donation.PaidAt)
+	if err != nil || !settled {
+		return err
+	}
+	for _, listener := range s.listeners {
+		if err := listener.DonationSettled(ctx, donation, tx); err != nil {
+			// The donation is settled either way; the listener has to
+			// catch up on its own.
+			slog.Error("Error handling settled donation", slog.String("reference", donation.Reference), slog.String("error", err.Error()))
+		}
+	}
+	if donation.Status == models.DonationSucceeded {
+		s.sendReceipt(donation)
+	}
+	return nil
+}
+
+// HandleWebhook settles the donation a gateway notification is about. The
+// payment is always re-verified with the gateway rather than trusted from
+// the notification, and each event is only processed once.
+func (s *service) HandleWebhook(ctx context.Context, gatewayName string, r *http.Request) error {
+	gateway, err := s.gateways.Get(gatewayName)
+	if err != nil {
+		return err
+	}
+	event, err := gateway.ParseWebhook(r)
+	if err != nil {
+		return err
+	}
+	if event.Transfer != nil {
+		return s.handleTransferEvent(ctx, gateway, event)
+	}
+	if event.Refund != nil {
+		return s.handleRefundEvent(ctx, gateway, event)
+	}
+	if event.Dispute != nil {
+		return s.handleDisputeEvent(ctx, gateway, event)
+	}
+	if event.Transaction == nil || event.Transaction.Reference == "" {
+		return nil
+	}
+
+	key := event.Type + ":" + event.Transaction.GatewayReference
+	processed, err := s.repo.EventProcessed(ctx, gateway.Name(), key)
+	if err != nil {
+		return err
+	}
+	if processed {
+		return nil
+	}
+
+	donation, err := s.ConfirmDonation(ctx, event.Transaction.Reference)
+	if errors.Is(err, ErrDonationNotFound) {
+		// Not one of ours, e.g. a payment made outside the site.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if donation.Gateway != gateway.Name() {
+		slog.Warn("Webhook from a different gateway than the donation's",
+			slog.String("reference", donation.Reference), slog.String("gateway", gateway.Name()))
+	}
+
+	return s.repo.RecordEvent(ctx, gateway.Name(), key)
+}
+
+// handleTransferEvent verifies the transfer an event is about with the
+// gateway and passes it on to the transfer listeners, once per event.
+func (s *service) handleTransferEvent(ctx context.Context, gateway Gateway, event *WebhookEvent) error {
+	if event.Transfer.Reference == "" {
+		return nil
+	}
+
+	key := event.Type + ":" + event.Transfer.Reference + ":" + event.Transfer.GatewayReference
+	processed, err := s.repo.EventProcessed(ctx, gateway.Name(), key)
+	if err != nil {
+		return err
+	}
+	if processed {
+		return nil
+	}
+
+	transfer, err := gateway.VerifyTransfer(ctx, event.Transfer.Reference, event.Transfer.GatewayReference)
+	if errors.Is(err, ErrTransactionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, listener := range s.transferListeners {
+		if err := listener.TransferUpdated(ctx, gateway.Name(), transfer); err != nil {
+			// Leave the event unprocessed so the gateway's retry gets
+			// another go.
+			return err
+		}
+	}
+
+	return s.repo.RecordEvent(ctx, gateway.Name(), key)
+}
+
+// handleRefundEvent catches up with refunds made from the gateway's own
+// dashboard, and flags refunds that failed after we counted them.
+func (s *service) handleRefundEvent(ctx context.Context, gateway Gateway, event *WebhookEvent) error {
+	refund := event.Refund
+	key := event.Type + ":" + refund.GatewayReference
+	processed, err := s.repo.EventProcessed(ctx, gateway.Name(), key)
+	if err != nil || processed {
+		return err
+	}
+
+	donation, err := s.GetDonation(ctx, refund.Reference)
+	if errors.Is(err, ErrDonationNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case refund.Status == TransactionFailed && donation.Status == models.DonationRefunded:
+		// The supporter didn't get their money back, but the creator's
+		// balance already paid for it. Someone has to sort it out by hand.
+		slog.Error("Refund failed at the gateway", slog.String("reference", donation.Reference), slog.String("refund", refund.GatewayReference))
+	case refund.Status == TransactionSuccess && (donation.Status == models.DonationSucceeded || donation.Status == models.DonationRefunding):
+		// A refunding donation is one of ours that didn't hear back from
+		// the gateway, or hasn't yet.
+		if refund.Amount != donation.Amount {
+			// Partial refunds aren't supported; leave the donation for
+			// someone to look at.
+			slog.Error("Partial refund made at the gateway",
+				slog.String("reference", donation.Reference), slog.String("amount", refund.Amount.String()))
+			break
+		}
+		changed, err := s.transition(ctx, donation, models.DonationRefunded, func(d *models.Donation) {
+			d.RefundReference = refund.GatewayReference
+			if d.RefundReason == "" {
+				d.RefundReason = "Refunded on " + gateway.Name()
+			}
+			d.RefundedAt = time.Now()
+		})
+		if err != nil {
+			return err
+		}
+		if changed {
+			s.notifyRefund(donation)
+		}
+	}
+	return s.repo.RecordEvent(ctx, gateway.Name(), key)
+}
+
+// handleDisputeEvent moves a donation through a chargeback. Events the
+// status machine can't follow, e.g. a dispute on a refunded donation, are
+// logged and dropped rather than retried.
+func (s *service) handleDisputeEvent(ctx context.Context, gateway Gateway, event *WebhookEvent) error {
+	dispute := event.Dispute
+	key := event.Type + ":" + dispute.GatewayReference + ":" + string(dispute.Status)
+	processed, err := s.repo.EventProcessed(ctx, gateway.Name(), key)
+	if err != nil || processed {
+		return err
+	}
+
+	donation, err := s.GetDonation(ctx, dispute.Reference)
+	if errors.Is(err, ErrDonationNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.applyDispute(ctx, donation, dispute); err != nil {
+		if !errors.Is(err, ErrInvalidTransition) {
+			return err
+		}
+		slog.Warn("Ignored chargeback event", slog.String("reference", donation.Reference),
+			slog.String("event", event.Type), slog.String("error", err.Error()))
+	}
+	return s.repo.RecordEvent(ctx, gateway.Name(), key)
+}
+
+func (s *service) applyDispute(ctx context.Context, donation *models.Donation, dispute *Dispute) error {
+	open := func(d *models.Donation) {
+		d.Dispute = &models.DonationDispute{
+			GatewayReference: dispute.GatewayReference,
+			Reason:           dispute.Reason,
+			OpenedAt:         time.Now(),
+		}
+	}
+	resolve := func(d *models.Donation) {
+		d.Dispute.ResolvedAt = time.Now()
+	}
+
+	if dispute.Status != DisputeOpen && donation.Status == models.DonationSucceeded {
+		if dispute.Status == DisputeWon {
+			// We never heard it was opened, and nothing has changed.
+			return nil
+		}
+		// Open it first so the money comes back out of the balance.
+		if _, err := s.transition(ctx, donation, models.DonationDisputed, open); err != nil {
+			return err
+		}
+	}
+
+	var next models.DonationStatus
+	var change func(*models.Donation)
+	switch dispute.Status {
+	case DisputeOpen:
+		if donation.Status == models.DonationDisputed {
+			return nil
+		}
+		next, change = models.DonationDisputed, open
+	case DisputeWon:
+		next, change = models.DonationSucceeded, resolve
+	default:
+		next, change = models.DonationLost, resolve
+	}
+
+	changed, err := s.transition(ctx, donation, next, change)
+	if err != nil || !changed {
+		return err
+	}
+	s.notifyDispute(donation, dispute.Status)
+	return nil
+}
+
+// RefundDonation gives the supporter their money back through the gateway
+// and takes it back from the creator. by is who asked for it. The donation
+// is claimed as refunding before the gateway is asked, and put back if the
+// gateway says no.
+func (s *service) RefundDonation(ctx context.Context, donation *models.Donation, by *models.User, reason string) error {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return i18n.NewError("payments.error.refund_reason")
+	}
+	if !donation.Status.CanBecome(models.DonationRefunding) {
+		return fmt.Errorf("%w: a %s donation can't be refunded", ErrInvalidTransition, donation.Status)
+	}
+
+	gateway, err := s.gateways.Get(donation.Gateway)
+	if err != nil {
+		return fmt.Errorf("donation %s: %w", donation.Reference, err)
+	}
+
+	claimed, err := s.transition(ctx, donation, models.DonationRefunding, func(d *models.Donation) {
+		d.RefundReason = reason
+		d.RefundedBy = &by.ID
+	})
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return i18n.NewError("payments.error.refund_changed")
+	}
+
+	refund, err := gateway.Refund(ctx, RefundRequest{
+		Reference:        donation.Reference,
+		GatewayReference: donation.GatewayReference,
+		Amount:           donation.Amount,
+		Reason:           reason,
+	})
+	if err == nil && refund.Status == TransactionFailed {
+		err = i18n.NewError("payments.error.refund_declined")
+	}
+	if err != nil {
+		// If the gateway did refund after all, its webhook refunds the
+		// donation once it is back to succeeded.
+		if _, rollbackErr := s.transition(ctx, donation, models.DonationSucceeded, func(d *models.Donation) {
+			d.RefundReason = ""
+			d.RefundedBy = nil
+		}); rollbackErr != nil {
+			slog.Error("Error releasing donation after a failed refund", slog.String("reference", donation.Reference), slog.String("error", rollbackErr.Error()))
+		}
+		return err
+	}
+
+	changed, err := s.transition(ctx, donation, models.DonationRefunded, func(d *models.Donation) {
+		d.RefundReference = refund.GatewayReference
+		d.RefundedAt = time.Now()
+	})
+	if err == nil && !changed {
+		// The gateway's webhook may have beaten us to it.
+		current, findErr := s.GetDonation(ctx, donation.Reference)
+		if findErr == nil && current.Status == models.DonationRefunded {
+			*donation = *current
+			return nil
+		}
+		err = i18n.NewError("payments.error.refund_changed")
+	}
+	if err != nil {
+		// The gateway has the refund either way.
+		slog.Error("Refunded donation not marked refunded", slog.String("reference", donation.Reference), slog.String("error", err.Error()))
+		return err
+	}
+	s.notifyRefund(donation)
+	return nil
+}
+
+// transition moves donation on to next with change applied, and tells the
+// status listeners. It reports false if the donation's status changed under
+// it, and returns ErrInvalidTransition if the move isn't allowed.
+func (s *service) transition(ctx context.Context, donation *models.Donation, next models.DonationStatus, change func(*models.Donation)) (bool, error) {
+	from := donation.Status
+	if !from.CanBecome(next) {
+		return false, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, next)
+	}
+
+	updated := *donation
+	updated.Status = next
+	change(&updated)
+	changed, err := s.repo.TransitionDonation(ctx, &updated, from)
+	if err != nil || !changed {
+		return false, err
+	}
+	*donation = updated
+
+	for _, listener := range s.statusListeners {
+		if err := listener.DonationStatusChanged(ctx, donation, from); err != nil {
+			// As with settling, the status has changed either way and the
+			// listener has to catch up on its own.
+			slog.Error("Error handling donation status change", slog.String("reference", donation.Reference), slog.String("error", err.Error()))
+		}
+	}
+	return true, nil
+}
+
+// notifyRefund emails the supporter and the creator about a refund, in the
+// background so webhooks answer quickly.
+func (s *service) notifyRefund(donation *models.Donation) {
+	go func() {
+		ctx := context.Background()
+		creator, owner, err := s.creatorOwner(ctx, donation.CreatorID)
+		if err != nil {
+			slog.Error("Error loading creator for refund email", slog.String("reference", donation.Reference), slog.String("error", err.Error()))
+			return
+		}
+
+		amount := donation.Amount.Format(donation.Locale)
+		if err := s.email.SendRefundEmail(donation.Email, donation.Locale, donation.Name, creator.DisplayName, amount); err != nil {
+			slog.Error("Error sending refund email", slog.String("reference", donation.Reference), slog.String("error", err.Error()))
+		}
+		if err := s.email.SendRefundNoticeEmail(owner.Email, owner.FullName, donation.Amount.Format(owner.Locale), donation.Reference); err != nil {
+			slog.Error("Error sending refund notice email", slog.String("reference", donation.Reference), slog.String("error", err.Error()))
+		}
+	}()
+}
+
+// sendReceipt emails the supporter a receipt, in the background, unless
+// they've opted out of receipts.
+func (s *service) sendReceipt(donation *models.Donation) {
+	go func() {
+		creator, err := s.creators.GetByID(context.Background(), donation.CreatorID)
+		if err != nil {
+			slog.Error("Error loading creator for receipt", slog.String("reference", donation.Reference), slog.String("error", err.Error()))
+			return
+		}
+
+		amount := donation.Amount.Format(donation.Locale)
+		err = s.email.SendDonationReceiptEmail(donation.Email, donation.Locale, donation.Name, creator.DisplayName, amount, donation.Reference)
+		if err != nil && !errors.Is(err, email.ErrSuppressed) {
+			slog.Error("Error sending receipt", slog.String("reference", donation.Reference), slog.String("error", err.Error()))
+		}
+	}()
+}
+
+// notifyDispute emails the creator about a chargeback, in the background.
+func (s *service) notifyDispute(donation *models.Donation, status DisputeStatus) {
+	go func() {
+		_, owner, err := s.creatorOwner(context.Background(), donation.CreatorID)
+		if err != nil {
+			slog.Error("Error loading creator for dispute email", slog.String("reference", donation.Reference), slog.String("error", err.Error()))
+			return
+		}
+		if err := s.email.SendDisputeEmail(owner.Email, owner.FullName, donation.Amount.Format(owner.Locale), donation.Reference, string(status)); err != nil {
+			slog.Error("Error sending dispute email", slog.String("reference", donation.Reference), slog.String("error", err.Error()))
+		}
+	}()
+}
+
+// creatorOwner returns a creator and the user whose page it is.
+func (s *service) creatorOwner(ctx context.Context, creatorID primitive.ObjectID) (*models.Creator, *models.User, error) {
+	creator, err := s.creators.GetByID(ctx, creatorID)
+	if err != nil {
+		return nil, nil, err
+	}
+	owner, err := s.users.FindUserByID(ctx, creator.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return creator, owner, nil
+}
+
+func (s *service) GetDonation(ctx context.Context, reference string) (*models.Donation, error) {
+	donation, err := s.repo.FindDonationByReference(ctx, reference)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrDonationNotFound
+	}
+	return donation, err
+}
+
+// GetEarnings totals a creator's succeeded donations, normalised to their
+// payout currency for display.
+func (s *service) GetEarnings(ctx context.Context, creator *models.Creator) (*Earnings, error) {
+	byCurrency, err := s.repo.EarningsByCurrency(ctx, creator.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	earnings := &Earnings{ByCurrency: byCurrency}
+	total, err := s.rates.Sum(ctx, byCurrency, creator.UnitPrice.Currency)
+	if err != nil {
+		slog.Error("Error converting earnings", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		return earnings, nil
+	}
+	earnings.Total, earnings.Converted = total, true
+	return earnings, nil
+}
+
+// CampaignRaised returns how much a campaign has raised, converted to
+// currency, and from how many donations.
+func (s *service) CampaignRaised(ctx context.Context, campaignID primitive.ObjectID, currency string) (money.Money, int, error) {
+	byCurrency, count, err := s.repo.CampaignRaised(ctx, campaignID)
+	if err != nil {
+		return money.Money{}, 0, err
+	}
+	raised, err := s.rates.Sum(ctx, byCurrency, currency)
+	if err != nil {
+		return money.Money{}, 0, err
+	}
+	return raised, count, nil
+}
+
+// RecentDonations returns a creator's latest settled donations, newest
+// first.
+func (s *service) RecentDonations(ctx context.Context, creatorID primitive.ObjectID, limit int64) ([]*models.Donation, error) {
+	return s.repo.FindDonationsByCreator(ctx, creatorID, limit)
+}
+
+// DisputedDonations returns the donations with a chargeback open.
+func (s *service) DisputedDonations(ctx context.Context) ([]*models.Donation, error) {
+	return s.repo.FindDonationsByStatus(ctx, models.DonationDisputed)
+}
+
+// EachSettledDonation calls fn with every donation that got past checkout.
+func (s *service) EachSettledDonation(ctx context.Context, fn func(*models.Donation) error) error {
+	return s.repo.EachSettledDonation(ctx, fn)
+}
+
+// OnSettled registers listener to hear about donations as they settle. It
+// must be called before the server starts.
+func (s *service) OnSettled(listener SettlementListener) {
+	s.listeners = append(s.listeners, listener)
+}
+
+// OnTransfer registers listener to hear about transfers gateways report on.
+// It must be called before the server starts.
+func (s *service) OnTransfer(listener TransferListener) {
+	s.transferListeners = append(s.transferListeners, listener)
+}
+
+// OnStatusChanged registers listener to hear about refunds and chargebacks.
+// It must be called before the server starts.
+func (s *service) OnStatusChanged(listener StatusListener) {
+	s.statusListeners = append(s.statusListeners, listener)
+}
+
+// generateReference returns a unique payment reference to share with the
+// gateway.
+func generateReference() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "fmj_" + hex.EncodeToString(b), nil
+}
+
+func NewService(repo Repository, gateways *Gateways, rates fx.Service, emailService email.Service, creatorService creators.Service, users UserFinder, cfg *config.Config) Service {
+	return &service{
+		repo:     repo,
+		gateways: gateways,
+		rates:    rates,
+		email:    emailService,
+		creators: creatorService,
+		users:    users,
+		config:   cfg,
+	}
+}
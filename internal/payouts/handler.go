@@ -0,0 +1,242 @@
+package payouts
+
+import (
+	"errors"
+	"fmj/internal/creators"
+	"fmj/internal/i18n"
+	"fmj/internal/ledger"
+	"fmj/internal/models"
+	"fmj/internal/money"
+	"fmj/internal/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+)
+
+type Handler struct {
+	service  Service
+	ledger   ledger.Service
+	creators creators.Service
+}
+
+func NewHandler(service Service, ledgerService ledger.Service, creatorService creators.Service) *Handler {
+	return &Handler{service: service, ledger: ledgerService, creators: creatorService}
+}
+
+// RegisterDashboardRoutes registers the creator's payout page. r must
+// already require authentication.
+func (h *Handler) RegisterDashboardRoutes(r *gin.RouterGroup) {
+	r.GET("/dashboard/payouts", h.ShowPayouts)
+	r.POST("/dashboard/payouts", h.RequestPayout)
+	r.POST("/dashboard/payouts/methods", h.AddMethod)
+	r.POST("/dashboard/payouts/methods/:id/remove", h.RemoveMethod)
+}
+
+// RegisterAdminRoutes registers the payout approval queue. r must already
+// require the admin role.
+func (h *Handler) RegisterAdminRoutes(r *gin.RouterGroup) {
+	r.GET("/admin/payouts", h.ShowQueue)
+	r.POST("/admin/payouts/:id/approve", h.Approve)
+	r.POST("/admin/payouts/:id/reject", h.Reject)
+}
+
+func (h *Handler) ShowPayouts(c *gin.Context) {
+	payoutsPage := filepath.Join("templates", "pages", "dashboard_payouts.html")
+
+	creator, ok := creators.Current(c, h.creators, payoutsPage)
+	if !ok {
+		return
+	}
+	h.renderPayouts(c, creator, MethodForm{}, "", "")
+}
+
+func (h *Handler) AddMethod(c *gin.Context) {
+	payoutsPage := filepath.Join("templates", "pages", "dashboard_payouts.html")
+
+	creator, ok := creators.Current(c, h.creators, payoutsPage)
+	if !ok {
+		return
+	}
+
+	form := MethodForm{
+		BankCode:      c.PostForm("bank_code"),
+		AccountNumber: c.PostForm("account_number"),
+		AccountName:   c.PostForm("account_name"),
+	}
+	if _, err := h.service.AddMethod(c, creator, form); err != nil {
+		slog.Error("Error adding payout method", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		h.renderPayouts(c, creator, form, "", i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/payouts?saved=1")
+}
+
+func (h *Handler) RemoveMethod(c *gin.Context) {
+	payoutsPage := filepath.Join("templates", "pages", "dashboard_payouts.html")
+
+	creator, ok := creators.Current(c, h.creators, payoutsPage)
+	if !ok {
+		return
+	}
+	methodID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := h.service.RemoveMethod(c, creator, methodID); err != nil {
+		if errors.Is(err, ErrMethodNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		slog.Error("Error removing payout method", slog.String("method_id", methodID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/payouts")
+}
+
+func (h *Handler) RequestPayout(c *gin.Context) {
+	payoutsPage := filepath.Join("templates", "pages", "dashboard_payouts.html")
+
+	creator, ok := creators.Current(c, h.creators, payoutsPage)
+	if !ok {
+		return
+	}
+
+	amount := c.PostForm("amount")
+	methodID, _ := primitive.ObjectIDFromHex(c.PostForm("method"))
+	if _, err := h.service.RequestPayout(c, creator, methodID, amount); err != nil {
+		if errors.Is(err, ErrMethodNotFound) {
+			err = i18n.NewError("payouts.error.choose_method")
+		}
+		slog.Error("Error requesting payout", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		h.renderPayouts(c, creator, MethodForm{}, amount, i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/payouts?requested=1")
+}
+
+// renderPayouts shows the payout page, with form and amount filled in
+// after a failed submit.
+func (h *Handler) renderPayouts(c *gin.Context, creator *models.Creator, form MethodForm, amount, errMsg string) {
+	payoutsPage := filepath.Join("templates", "pages", "dashboard_payouts.html")
+	currency := creator.UnitPrice.Currency
+
+	balances, err := h.ledger.Balances(c, creator.ID)
+	if err != nil {
+		slog.Error("Error loading balance", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	available := money.New(0, currency)
+	for _, balance := range balances {
+		if balance.Currency == currency {
+			available = balance.Available
+		}
+	}
+
+	methods, err := h.service.ListMethods(c, creator.ID)
+	if err != nil {
+		slog.Error("Error loading payout methods", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	payouts, err := h.service.ListPayouts(c, creator.ID)
+	if err != nil {
+		slog.Error("Error loading payouts", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	minimum, supported := h.service.Minimum(currency)
+	data := map[string]interface{}{
+		"Creator":   creator,
+		"Available": available,
+		"Minimum":   minimum,
+		"Supported": supported,
+		"Methods":   methods,
+		"CanAdd":    len(methods) < maxMethods,
+		"Payouts":   payouts,
+		"Form":      form,
+		"Amount":    amount,
+		"Saved":     c.Query("saved") != "",
+		"Requested": c.Query("requested") != "",
+		"Error":     errMsg,
+	}
+	if supported {
+		// Without the bank list the rest of the page still works.
+		banks, err := h.service.Banks(c, currency)
+		if err != nil {
+			slog.Error("Error loading banks", slog.String("currency", currency), slog.String("error", err.Error()))
+		}
+		data["Banks"] = banks
+	}
+	utils.RenderDashboard(c, payoutsPage, data)
+}
+
+func (h *Handler) ShowQueue(c *gin.Context) {
+	h.renderQueue(c, "")
+}
+
+func (h *Handler) Approve(c *gin.Context) {
+	payoutID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := h.service.Approve(c, utils.CurrentUser(c), payoutID); err != nil {
+		if errors.Is(err, ErrPayoutNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		slog.Error("Error approving payout", slog.String("payout_id", payoutID.Hex()), slog.String("error", err.Error()))
+		h.renderQueue(c, i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/admin/payouts")
+}
+
+func (h *Handler) Reject(c *gin.Context) {
+	payoutID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := h.service.Reject(c, utils.CurrentUser(c), payoutID, c.PostForm("reason")); err != nil {
+		if errors.Is(err, ErrPayoutNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		slog.Error("Error rejecting payout", slog.String("payout_id", payoutID.Hex()), slog.String("error", err.Error()))
+		h.renderQueue(c, i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/admin/payouts")
+}
+
+func (h *Handler) renderQueue(c *gin.Context, errMsg string) {
+	queuePage := filepath.Join("templates", "pages", "admin_payouts.html")
+
+	reviews, err := h.service.Queue(c)
+	if err != nil {
+		slog.Error("Error loading payout queue", slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Reviews": reviews,
+		"Error":   errMsg,
+	}
+	utils.RenderDashboard(c, queuePage, data)
+}
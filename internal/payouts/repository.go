@@ -0,0 +1,184 @@
+package payouts
+
+import (
+	"context"
+	"fmj/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Repository interface {
+	CreateMethod(ctx context.Context, method *models.PayoutMethod) error
+	DeleteMethod(ctx context.Context, id primitive.ObjectID) error
+	FindMethodByID(ctx context.Context, id primitive.ObjectID) (*models.PayoutMethod, error)
+	FindMethodsByCreator(ctx context.Context, creatorID primitive.ObjectID) ([]*models.PayoutMethod, error)
+	CreatePayout(ctx context.Context, payout *models.Payout) error
+	UpdatePayout(ctx context.Context, payout *models.Payout, from models.PayoutStatus) (bool, error)
+	FindPayoutByID(ctx context.Context, id primitive.ObjectID) (*models.Payout, error)
+	FindPayoutByReference(ctx context.Context, reference string) (*models.Payout, error)
+	FindOpenPayout(ctx context.Context, creatorID primitive.ObjectID) (*models.Payout, error)
+	FindPayoutsByCreator(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Payout, error)
+	FindPayoutsByStatus(ctx context.Context, status models.PayoutStatus, updatedBefore time.Time) ([]*models.Payout, error)
+	EnsureIndexes(ctx context.Context) error
+}
+
+type repository struct {
+	db *mongo.Database
+}
+
+func (r repository) CreateMethod(ctx context.Context, method *models.PayoutMethod) error {
+	method.CreatedAt = time.Now()
+
+	result, err := r.db.Collection("payout_methods").InsertOne(ctx, method)
+	if err != nil {
+		return err
+	}
+	method.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (r repository) DeleteMethod(ctx context.Context, id primitive.ObjectID) error {
+	_, err := r.db.Collection("payout_methods").DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (r repository) FindMethodByID(ctx context.Context, id primitive.ObjectID) (*models.PayoutMethod, error) {
+	var method models.PayoutMethod
+	err := r.db.Collection("payout_methods").FindOne(ctx, bson.M{"_id": id}).Decode(&method)
+	if err != nil {
+		return nil, err
+	}
+	return &method, nil
+}
+
+func (r repository) FindMethodsByCreator(ctx context.Context, creatorID primitive.ObjectID) ([]*models.PayoutMethod, error) {
+	cursor, err := r.db.Collection("payout_methods").Find(
+		ctx,
+		bson.M{"creator_id": creatorID},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var methods []*models.PayoutMethod
+	if err := cursor.All(ctx, &methods); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+func (r repository) CreatePayout(ctx context.Context, payout *models.Payout) error {
+	payout.CreatedAt = time.Now()
+	payout.UpdatedAt = time.Now()
+
+	result, err := r.db.Collection("payouts").InsertOne(ctx, payout)
+	if err != nil {
+		return err
+	}
+	payout.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// UpdatePayout saves payout if it is still in status from. It reports false
+// when someone else moved it on first, so each step only happens once.
+func (r repository) UpdatePayout(ctx context.Context, payout *models.Payout, from models.PayoutStatus) (bool, error) {
+	payout.UpdatedAt = time.Now()
+	res, err := r.db.Collection("payouts").ReplaceOne(
+		ctx,
+		bson.M{"_id": payout.ID, "status": from},
+		payout,
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+func (r repository) FindPayoutByID(ctx context.Context, id primitive.ObjectID) (*models.Payout, error) {
+	var payout models.Payout
+	err := r.db.Collection("payouts").FindOne(ctx, bson.M{"_id": id}).Decode(&payout)
+	if err != nil {
+		return nil, err
+	}
+	return &payout, nil
+}
+
+func (r repository) FindPayoutByReference(ctx context.Context, reference string) (*models.Payout, error) {
+	var payout models.Payout
+	err := r.db.Collection("payouts").FindOne(ctx, bson.M{"reference": reference}).Decode(&payout)
+	if err != nil {
+		return nil, err
+	}
+	return &payout, nil
+}
+
+// FindOpenPayout returns the creator's payout that hasn't finished yet, if
+// any.
+func (r repository) FindOpenPayout(ctx context.Context, creatorID primitive.ObjectID) (*models.Payout, error) {
+	var payout models.Payout
+	err := r.db.Collection("payouts").FindOne(ctx, bson.M{
+		"creator_id": creatorID,
+		"status":     bson.M{"$in": bson.A{models.PayoutRequested, models.PayoutProcessing}},
+	}).Decode(&payout)
+	if err != nil {
+		return nil, err
+	}
+	return &payout, nil
+}
+
+// FindPayoutsByCreator returns the creator's payouts, newest first.
+func (r repository) FindPayoutsByCreator(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Payout, error) {
+	return r.findPayouts(ctx, bson.M{"creator_id": creatorID}, -1)
+}
+
+// FindPayoutsByStatus returns the payouts in status last updated before
+// updatedBefore, oldest first.
+func (r repository) FindPayoutsByStatus(ctx context.Context, status models.PayoutStatus, updatedBefore time.Time) ([]*models.Payout, error) {
+	return r.findPayouts(ctx, bson.M{"status": status, "updated_at": bson.M{"$lt": updatedBefore}}, 1)
+}
+
+func (r repository) findPayouts(ctx context.Context, filter bson.M, order int) ([]*models.Payout, error) {
+	cursor, err := r.db.Collection("payouts").Find(
+		ctx,
+		filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: order}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var payouts []*models.Payout
+	if err := cursor.All(ctx, &payouts); err != nil {
+		return nil, err
+	}
+	return payouts, nil
+}
+
+func (r repository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.db.Collection("payout_methods").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "creator_id", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Collection("payouts").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "reference", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "creator_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "updated_at", Value: 1}}},
+		// One open payout per creator, however many requests race.
+		{
+			Keys: bson.D{{Key: "creator_id", Value: 1}},
+			Options: options.Index().SetUnique(true).SetName("one_open_payout").SetPartialFilterExpression(bson.M{
+				"status": bson.M{"$in": bson.A{models.PayoutRequested, models.PayoutProcessing}},
+			}),
+		},
+	})
+	return err
+}
+
+func NewRepository(db *mongo.Database) Repository {
+	return &repository{db}
+}
@@ -0,0 +1,38 @@
+package payouts
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Scheduler checks on transfers in the background that the gateway hasn't
+// sent a webhook for.
+type Scheduler struct {
+	service  Service
+	interval time.Duration
+}
+
+func NewScheduler(service Service, interval time.Duration) *Scheduler {
+	return &Scheduler{service: service, interval: interval}
+}
+
+// Start runs the scheduler every interval until ctx is done.
+func (s *Scheduler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.service.Reconcile(ctx, time.Now()); err != nil {
+				slog.Error("Error reconciling payouts", slog.String("error", err.Error()))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,548 @@
+package payouts
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmj/internal/creators"
+	"fmj/internal/i18n"
+	"fmj/internal/ledger"
+	"fmj/internal/models"
+	"fmj/internal/money"
+	"fmj/internal/payments"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrMethodNotFound is returned when no payout method matches, or it
+	// belongs to another creator.
+	ErrMethodNotFound = i18n.NewError("payouts.error.method_not_found")
+	// ErrPayoutNotFound is returned when no payout matches.
+	ErrPayoutNotFound = i18n.NewError("payouts.error.not_found")
+
+	errPayoutOpen = i18n.NewError("payouts.error.open")
+)
+
+const (
+	maxMethods = 5
+
+	// bankListTTL is how long a gateway's bank list is kept before asking
+	// again.
+	bankListTTL = 24 * time.Hour
+
+	// reconcileAfter is how long a transfer can go without a webhook before
+	// its status is checked with the gateway.
+	reconcileAfter = 30 * time.Minute
+	// abandonAfter is how long a transfer the gateway has no record of is
+	// waited on before the payout is marked failed.
+	abandonAfter = 24 * time.Hour
+)
+
+// minimums is the smallest payout per currency, in minor units. Transfer
+// fees make anything smaller not worth sending.
+var minimums = map[string]int64{
+	"NGN": 5000_00,
+	"GHS": 50_00,
+	"KES": 1000_00,
+	"ZAR": 100_00,
+	"USD": 10_00,
+}
+
+// MethodForm is what a creator fills in to add a payout method.
+type MethodForm struct {
+	BankCode      string
+	AccountNumber string
+	AccountName   string // only used when the gateway can't look it up
+}
+
+// Review is a payout waiting in the admin queue, with who asked for it.
+type Review struct {
+	*models.Payout
+	Creator *models.Creator
+}
+
+type Service interface {
+	Banks(ctx context.Context, currency string) ([]payments.Bank, error)
+	Minimum(currency string) (money.Money, bool)
+	ListMethods(ctx context.Context, creatorID primitive.ObjectID) ([]*models.PayoutMethod, error)
+	AddMethod(ctx context.Context, creator *models.Creator, form MethodForm) (*models.PayoutMethod, error)
+	RemoveMethod(ctx context.Context, creator *models.Creator, methodID primitive.ObjectID) error
+	RequestPayout(ctx context.Context, creator *models.Creator, methodID primitive.ObjectID, amount string) (*models.Payout, error)
+	ListPayouts(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Payout, error)
+	Queue(ctx context.Context) ([]Review, error)
+	Approve(ctx context.Context, admin *models.User, payoutID primitive.ObjectID) error
+	Reject(ctx context.Context, admin *models.User, payoutID primitive.ObjectID, reason string) error
+	TransferUpdated(ctx context.Context, gateway string, transfer *payments.Transfer) error
+	Reconcile(ctx context.Context, now time.Time) error
+}
+
+type service struct {
+	repo     Repository
+	gateways *payments.Gateways
+	ledger   ledger.Service
+	creators creators.Service
+
+	mu    sync.Mutex
+	banks map[string]bankList
+}
+
+// bankList is a gateway's banks for one currency, as fetched at fetchedAt.
+type bankList struct {
+	banks     []payments.Bank
+	fetchedAt time.Time
+}
+
+// Banks lists the banks and mobile money providers the primary gateway can
+// pay out to in currency.
+func (s *service) Banks(ctx context.Context, currency string) ([]payments.Bank, error) {
+	gateway := s.gateways.Primary()
+	key := gateway.Name() + ":" + currency
+
+	s.mu.Lock()
+	cached, ok := s.banks[key]
+	s.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < bankListTTL {
+		return cached.banks, nil
+	}
+
+	banks, err := gateway.ListBanks(ctx, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.banks[key] = bankList{banks: banks, fetchedAt: time.Now()}
+	s.mu.Unlock()
+	return banks, nil
+}
+
+// Minimum returns the smallest payout allowed in currency, and false if
+// payouts in currency aren't supported.
+func (s *service) Minimum(currency string) (money.Money, bool) {
+	minor, ok := minimums[currency]
+	return money.New(minor, currency), ok
+}
+
+func (s *service) ListMethods(ctx context.Context, creatorID primitive.ObjectID) ([]*models.PayoutMethod, error) {
+	return s.repo.FindMethodsByCreator(ctx, creatorID)
+}
+
+// AddMethod saves a bank account or mobile money wallet for the creator,
+// checking the account name with the gateway where it can.
+func (s *service) AddMethod(ctx context.Context, creator *models.Creator, form MethodForm) (*models.PayoutMethod, error) {
+	currency := creator.UnitPrice.Currency
+	if _, ok := s.Minimum(currency); !ok {
+		return nil, i18n.NewError("payouts.error.unsupported", "currency", currency)
+	}
+
+	methods, err := s.repo.FindMethodsByCreator(ctx, creator.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(methods) >= maxMethods {
+		return nil, i18n.NewError("payouts.error.too_many_methods", "count", maxMethods)
+	}
+
+	banks, err := s.Banks(ctx, currency)
+	if err != nil {
+		return nil, err
+	}
+	var bank *payments.Bank
+	for i := range banks {
+		if banks[i].Code == form.BankCode {
+			bank = &banks[i]
+			break
+		}
+	}
+	if bank == nil {
+		return nil, i18n.NewError("payouts.error.bank")
+	}
+
+	number := normalizeNumber(form.AccountNumber)
+	if strings.Trim(number, "0123456789") != "" {
+		return nil, i18n.NewError("payouts.error.digits")
+	}
+	if bank.MobileMoney {
+		if len(number) < 9 || len(number) > 15 {
+			return nil, i18n.NewError("payouts.error.phone")
+		}
+	} else if len(number) < 6 || len(number) > 20 {
+		return nil, i18n.NewError("payouts.error.account_number")
+	}
+
+	gateway := s.gateways.Primary()
+	method := &models.PayoutMethod{
+		CreatorID:     creator.ID,
+		Gateway:       gateway.Name(),
+		Currency:      currency,
+		BankCode:      bank.Code,
+		BankName:      bank.Name,
+		AccountNumber: number,
+		MobileMoney:   bank.MobileMoney,
+	}
+
+	name, err := gateway.ResolveAccount(ctx, payments.PayoutAccount{
+		BankCode:      method.BankCode,
+		AccountNumber: method.AccountNumber,
+		Currency:      method.Currency,
+		MobileMoney:   method.MobileMoney,
+	})
+	switch {
+	case err == nil:
+		method.AccountName = name
+		method.Verified = true
+	case errors.Is(err, payments.ErrCannotResolve):
+		// The admin checks the name by hand before approving.
+		method.AccountName = strings.TrimSpace(form.AccountName)
+		if method.AccountName == "" {
+			return nil, i18n.NewError("payouts.error.account_name")
+		}
+	default:
+		slog.Warn("Payout account didn't resolve", slog.String("bank_code", method.BankCode), slog.String("error", err.Error()))
+		return nil, i18n.NewError("payouts.error.account_not_found")
+	}
+
+	if err := s.repo.CreateMethod(ctx, method); err != nil {
+		return nil, err
+	}
+	return method, nil
+}
+
+func (s *service) RemoveMethod(ctx context.Context, creator *models.Creator, methodID primitive.ObjectID) error {
+	method, err := s.getMethod(ctx, creator, methodID)
+	if err != nil {
+		return err
+	}
+	// Payouts keep their own copy of the method, so open ones still go
+	// through.
+	return s.repo.DeleteMethod(ctx, method.ID)
+}
+
+// RequestPayout asks to withdraw amount, in major units, to one of the
+// creator's payout methods. The amount is taken out of their available
+// balance straight away and held until the payout is paid or turned down.
+func (s *service) RequestPayout(ctx context.Context, creator *models.Creator, methodID primitive.ObjectID, amount string) (*models.Payout, error) {
+	method, err := s.getMethod(ctx, creator, methodID)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := money.Parse(strings.TrimSpace(amount), method.Currency)
+	if err != nil || value.Minor <= 0 {
+		return nil, i18n.NewError("payouts.error.amount")
+	}
+	minimum, ok := s.Minimum(method.Currency)
+	if !ok {
+		return nil, i18n.NewError("payouts.error.unsupported", "currency", method.Currency)
+	}
+	if value.Minor < minimum.Minor {
+		return nil, i18n.NewError("payouts.error.minimum", "amount", minimum)
+	}
+
+	_, err = s.repo.FindOpenPayout(ctx, creator.ID)
+	if err == nil {
+		return nil, errPayoutOpen
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	balances, err := s.ledger.Balances(ctx, creator.ID)
+	if err != nil {
+		return nil, err
+	}
+	var available int64
+	for _, balance := range balances {
+		if balance.Currency == method.Currency {
+			available = balance.Available.Minor
+		}
+	}
+	if value.Minor > available {
+		return nil, i18n.NewError("payouts.error.available", "amount", money.New(available, method.Currency))
+	}
+
+	reference, err := newReference()
+	if err != nil {
+		return nil, err
+	}
+	payout := &models.Payout{
+		CreatorID: creator.ID,
+		Method:    *method,
+		Amount:    value,
+		Status:    models.PayoutRequested,
+		Reference: reference,
+	}
+	// The checks above are only for friendly errors: the unique index stops
+	// a second open payout, and the ledger won't reserve more than is
+	// available when the reservation is written.
+	if err := s.repo.CreatePayout(ctx, payout); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, errPayoutOpen
+		}
+		return nil, err
+	}
+
+	if err := s.ledger.ReservePayout(ctx, creator.ID, value, "payout:"+payout.ID.Hex()); err != nil {
+		payout.Status = models.PayoutFailed
+		payout.NoteKey = "payouts.note.not_reserved"
+		if _, updateErr := s.repo.UpdatePayout(ctx, payout, models.PayoutRequested); updateErr != nil {
+			slog.Error("Error failing payout", slog.String("payout_id", payout.ID.Hex()), slog.String("error", updateErr.Error()))
+		}
+		if errors.Is(err, ledger.ErrInsufficientFunds) {
+			return nil, i18n.NewError("payouts.error.balance_changed")
+		}
+		return nil, err
+	}
+	return payout, nil
+}
+
+func (s *service) ListPayouts(ctx context.Context, creatorID primitive.ObjectID) ([]*models.Payout, error) {
+	return s.repo.FindPayoutsByCreator(ctx, creatorID)
+}
+
+// Queue returns the payouts waiting for an admin, oldest first.
+func (s *service) Queue(ctx context.Context) ([]Review, error) {
+	payouts, err := s.repo.FindPayoutsByStatus(ctx, models.PayoutRequested, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	reviews := make([]Review, 0, len(payouts))
+	for _, payout := range payouts {
+		creator, err := s.creators.GetByID(ctx, payout.CreatorID)
+		if err != nil && !errors.Is(err, creators.ErrCreatorNotFound) {
+			return nil, err
+		}
+		reviews = append(reviews, Review{Payout: payout, Creator: creator})
+	}
+	return reviews, nil
+}
+
+// Approve sends a requested payout to the gateway.
+func (s *service) Approve(ctx context.Context, admin *models.User, payoutID primitive.ObjectID) error {
+	payout, err := s.getPayout(ctx, payoutID)
+	if err != nil {
+		return err
+	}
+	if payout.Status != models.PayoutRequested {
+		return i18n.NewError("payouts.error.reviewed")
+	}
+
+	payout.Status = models.PayoutProcessing
+	payout.ReviewedBy = &admin.ID
+	payout.ReviewedAt = time.Now()
+	ok, err := s.repo.UpdatePayout(ctx, payout, models.PayoutRequested)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return i18n.NewError("payouts.error.reviewed")
+	}
+
+	gateway, err := s.gateways.Get(payout.Method.Gateway)
+	if err != nil {
+		return err
+	}
+	transfer, err := gateway.Transfer(ctx, payments.TransferRequest{
+		Reference: payout.Reference,
+		Amount:    payout.Amount,
+		Account: payments.PayoutAccount{
+			BankCode:      payout.Method.BankCode,
+			AccountNumber: payout.Method.AccountNumber,
+			AccountName:   payout.Method.AccountName,
+			Currency:      payout.Method.Currency,
+			MobileMoney:   payout.Method.MobileMoney,
+		},
+		Reason: "Payout " + payout.Reference,
+	})
+	if err != nil {
+		// The transfer may or may not have reached the gateway, so leave
+		// the payout processing for Reconcile to check.
+		slog.Error("Error starting transfer", slog.String("payout_id", payout.ID.Hex()), slog.String("error", err.Error()))
+		return i18n.NewError("payouts.error.unconfirmed")
+	}
+	return s.applyTransfer(ctx, payout, transfer)
+}
+
+// Reject turns down a requested payout and gives the amount back to the
+// creator.
+func (s *service) Reject(ctx context.Context, admin *models.User, payoutID primitive.ObjectID, reason string) error {
+	payout, err := s.getPayout(ctx, payoutID)
+	if err != nil {
+		return err
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return i18n.NewError("payouts.error.reject_reason")
+	}
+	if payout.Status != models.PayoutRequested {
+		return i18n.NewError("payouts.error.reviewed")
+	}
+
+	payout.Status = models.PayoutRejected
+	payout.Note = reason
+	payout.ReviewedBy = &admin.ID
+	payout.ReviewedAt = time.Now()
+	ok, err := s.repo.UpdatePayout(ctx, payout, models.PayoutRequested)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return i18n.NewError("payouts.error.reviewed")
+	}
+	return s.ledger.ReleasePayout(ctx, payout.CreatorID, payout.Amount, "payout_reversal:"+payout.ID.Hex())
+}
+
+// TransferUpdated settles a payout from a transfer webhook. It implements
+// payments.TransferListener.
+func (s *service) TransferUpdated(ctx context.Context, gateway string, transfer *payments.Transfer) error {
+	payout, err := s.repo.FindPayoutByReference(ctx, transfer.Reference)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Not one of ours, e.g. a transfer made from the gateway's dashboard.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if payout.Method.Gateway != gateway {
+		slog.Warn("Transfer webhook from a different gateway than the payout's",
+			slog.String("reference", payout.Reference), slog.String("gateway", gateway))
+	}
+	if payout.Status == models.PayoutPaid && transfer.Status == payments.TransactionFailed {
+		// The money left the gateway and came back. Someone has to look at
+		// the account before the creator is credited again.
+		slog.Error("Paid payout reversed by the gateway", slog.String("payout_id", payout.ID.Hex()))
+		return nil
+	}
+	if payout.Status != models.PayoutProcessing {
+		return nil
+	}
+	return s.applyTransfer(ctx, payout, transfer)
+}
+
+// Reconcile checks with the gateway on transfers that haven't had a webhook
+// for a while.
+func (s *service) Reconcile(ctx context.Context, now time.Time) error {
+	payouts, err := s.repo.FindPayoutsByStatus(ctx, models.PayoutProcessing, now.Add(-reconcileAfter))
+	if err != nil {
+		return err
+	}
+
+	for _, payout := range payouts {
+		if err := s.reconcile(ctx, payout, now); err != nil {
+			slog.Error("Error reconciling payout", slog.String("payout_id", payout.ID.Hex()), slog.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+func (s *service) reconcile(ctx context.Context, payout *models.Payout, now time.Time) error {
+	gateway, err := s.gateways.Get(payout.Method.Gateway)
+	if err != nil {
+		return err
+	}
+
+	transfer, err := gateway.VerifyTransfer(ctx, payout.Reference, payout.GatewayReference)
+	if errors.Is(err, payments.ErrTransactionNotFound) {
+		if now.Sub(payout.ReviewedAt) < abandonAfter {
+			return nil
+		}
+		transfer = &payments.Transfer{
+			Reference: payout.Reference,
+			Status:    payments.TransactionFailed,
+		}
+		payout.NoteKey = "payouts.note.no_record"
+	} else if err != nil {
+		return err
+	}
+	if transfer.Status == payments.TransactionPending && transfer.GatewayReference == payout.GatewayReference {
+		return nil
+	}
+	return s.applyTransfer(ctx, payout, transfer)
+}
+
+// applyTransfer moves a processing payout on to match transfer, posting
+// the matching ledger entries.
+func (s *service) applyTransfer(ctx context.Context, payout *models.Payout, transfer *payments.Transfer) error {
+	if transfer.GatewayReference != "" {
+		payout.GatewayReference = transfer.GatewayReference
+	}
+
+	switch transfer.Status {
+	case payments.TransactionSuccess:
+		payout.Status = models.PayoutPaid
+		payout.PaidAt = time.Now()
+	case payments.TransactionFailed:
+		payout.Status = models.PayoutFailed
+		payout.Note = transfer.Failure
+		if payout.Note == "" && payout.NoteKey == "" {
+			payout.NoteKey = "payouts.note.transfer_failed"
+		}
+	}
+
+	ok, err := s.repo.UpdatePayout(ctx, payout, models.PayoutProcessing)
+	if err != nil || !ok {
+		return err
+	}
+
+	switch payout.Status {
+	case models.PayoutPaid:
+		return s.ledger.RecordPayout(ctx, payout.CreatorID, payout.Amount, payout.Method.Gateway, "payout_sent:"+payout.ID.Hex())
+	case models.PayoutFailed:
+		return s.ledger.ReleasePayout(ctx, payout.CreatorID, payout.Amount, "payout_reversal:"+payout.ID.Hex())
+	}
+	return nil
+}
+
+func (s *service) getMethod(ctx context.Context, creator *models.Creator, id primitive.ObjectID) (*models.PayoutMethod, error) {
+	method, err := s.repo.FindMethodByID(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrMethodNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if method.CreatorID != creator.ID {
+		return nil, ErrMethodNotFound
+	}
+	return method, nil
+}
+
+func (s *service) getPayout(ctx context.Context, id primitive.ObjectID) (*models.Payout, error) {
+	payout, err := s.repo.FindPayoutByID(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrPayoutNotFound
+	}
+	return payout, err
+}
+
+// normalizeNumber drops the spaces, dashes and plus people type in account
+// and phone numbers.
+func normalizeNumber(number string) string {
+	return strings.NewReplacer(" ", "", "-", "", "+", "").Replace(strings.TrimSpace(number))
+}
+
+// newReference returns a unique transfer reference, e.g. "po_9f86d081884c7d65".
+func newReference() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "po_" + hex.EncodeToString(b), nil
+}
+
+func NewService(repo Repository, gateways *payments.Gateways, ledgerService ledger.Service, creatorService creators.Service) Service {
+	return &service{
+		repo:     repo,
+		gateways: gateways,
+		ledger:   ledgerService,
+		creators: creatorService,
+		banks:    make(map[string]bankList),
+	}
+}
@@ -0,0 +1,89 @@
+package session
+
+import (
+	"fmj/internal/i18n"
+	"fmj/internal/utils"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+)
+
+type Handler struct {
+	service Service
+}
+
+func NewHandler(service Service) *Handler {
+	return &Handler{service: service}
+}
+
+// RegisterRoutes registers the device management pages. r must already
+// require authentication.
+func (h *Handler) RegisterRoutes(r *gin.RouterGroup) {
+	r.GET("/dashboard/sessions", h.ShowSessions)
+	r.POST("/dashboard/sessions/revoke-all", h.RevokeAll)
+	r.POST("/dashboard/sessions/:id/revoke", h.Revoke)
+}
+
+func (h *Handler) ShowSessions(c *gin.Context) {
+	sessionsPage := filepath.Join("templates", "pages", "dashboard_sessions.html")
+
+	session := sessions.Default(c)
+	userID := utils.CurrentUser(c).ID.Hex()
+
+	userSessions, err := h.service.ListSessions(c, userID)
+	if err != nil {
+		slog.Error("Error listing sessions", slog.String("user_id", userID), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Sessions":  userSessions,
+		"CurrentID": session.ID(),
+	}
+	utils.RenderDashboard(c, sessionsPage, data)
+}
+
+func (h *Handler) Revoke(c *gin.Context) {
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	session := sessions.Default(c)
+	userID := utils.CurrentUser(c).ID.Hex()
+	sessionID := c.Param("id")
+
+	if err := h.service.RevokeSession(c, userID, sessionID); err != nil {
+		c.Header("HX-Retarget", "#toast")
+		utils.Render(c, toastPage, map[string]interface{}{
+			"Error": i18n.Message(c.GetString(utils.LocaleKey), err),
+		})
+		slog.Error("Error revoking session", slog.String("user_id", userID), slog.String("error", err.Error()))
+		return
+	}
+
+	// Revoking this device is the same as logging out.
+	if sessionID == session.ID() {
+		c.Header("HX-Redirect", "/auth/login")
+		return
+	}
+
+	// An empty body removes the revoked row.
+	c.Status(http.StatusOK)
+}
+
+func (h *Handler) RevokeAll(c *gin.Context) {
+	toastPage := filepath.Join("templates", "partials", "toast.html")
+
+	userID := utils.CurrentUser(c).ID.Hex()
+
+	if err := h.service.RevokeAllSessions(c, userID); err != nil {
+		utils.Render(c, toastPage, map[string]interface{}{
+			"Error": i18n.T(c.GetString(utils.LocaleKey), "toast.error"),
+		})
+		slog.Error("Error revoking all sessions", slog.String("user_id", userID), slog.String("error", err.Error()))
+		return
+	}
+
+	c.Header("HX-Redirect", "/auth/login")
+}
@@ -0,0 +1,59 @@
+package session
+
+import (
+	"context"
+	"fmj/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Repository interface {
+	FindSessionsByUser(ctx context.Context, userID string) ([]models.Session, error)
+	DeleteSession(ctx context.Context, userID, sessionID string) error
+	DeleteSessionsByUser(ctx context.Context, userID string) error
+}
+
+type repository struct {
+	db *mongo.Database
+}
+
+func (r repository) FindSessionsByUser(ctx context.Context, userID string) ([]models.Session, error) {
+	cursor, err := r.db.Collection("sessions").Find(
+		ctx,
+		bson.M{"user_id": userID, "expires_at": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "last_seen", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []models.Session
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteSession removes one session, scoped to userID so users can only
+// revoke their own devices.
+func (r repository) DeleteSession(ctx context.Context, userID, sessionID string) error {
+	res, err := r.db.Collection("sessions").DeleteOne(ctx, bson.M{"_id": sessionID, "user_id": userID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (r repository) DeleteSessionsByUser(ctx context.Context, userID string) error {
+	_, err := r.db.Collection("sessions").DeleteMany(ctx, bson.M{"user_id": userID})
+	return err
+}
+
+func NewRepository(db *mongo.Database) Repository {
+	return &repository{db}
+}
@@ -0,0 +1,36 @@
+package session
+
+import (
+	"context"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+)
+
+type Service interface {
+	ListSessions(ctx context.Context, userID string) ([]models.Session, error)
+	RevokeSession(ctx context.Context, userID, sessionID string) error
+	RevokeAllSessions(ctx context.Context, userID string) error
+}
+
+type service struct {
+	repo Repository
+}
+
+func (s *service) ListSessions(ctx context.Context, userID string) ([]models.Session, error) {
+	return s.repo.FindSessionsByUser(ctx, userID)
+}
+
+func (s *service) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	if err := s.repo.DeleteSession(ctx, userID, sessionID); err != nil {
+		return i18n.NewError("sessions.error.not_found")
+	}
+	return nil
+}
+
+func (s *service) RevokeAllSessions(ctx context.Context, userID string) error {
+	return s.repo.DeleteSessionsByUser(ctx, userID)
+}
+
+func NewService(repo Repository) Service {
+	return &service{repo: repo}
+}
@@ -0,0 +1,227 @@
+package session
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmj/internal/models"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// lastSeenInterval limits how often reading a session bumps its last_seen
+// timestamp, so busy pages don't write to Mongo on every request.
+const lastSeenInterval = time.Minute
+
+// regenerateKey marks a session for a fresh ID on its next save.
+const regenerateKey = "_regenerate"
+
+// Store is a gin-contrib/sessions store backed by the sessions collection.
+// The cookie only carries a signed session ID, which lets a session be
+// revoked by deleting its document.
+type Store struct {
+	collection *mongo.Collection
+	codecs     []securecookie.Codec
+	options    *gsessions.Options
+}
+
+// NewStore creates the store and the indexes it relies on, including the TTL
+// index that lets Mongo drop expired sessions on its own.
+func NewStore(ctx context.Context, db *mongo.Database, keyPairs ...[]byte) (*Store, error) {
+	collection := db.Collection("sessions")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		collection: collection,
+		codecs:     securecookie.CodecsFromPairs(keyPairs...),
+	}
+	s.Options(sessions.Options{
+		Path:     "/",
+		MaxAge:   60 * 60 * 24 * 30,
+		HttpOnly: true,
+	})
+	return s, nil
+}
+
+// Options sets the cookie options and keeps the codecs' max age in step.
+func (s *Store) Options(opts sessions.Options) {
+	s.options = opts.ToGorillaOptions()
+	for _, codec := range s.codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(opts.MaxAge)
+		}
+	}
+}
+
+// Get returns the session cached for this request, loading it on first use.
+func (s *Store) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request cookie. A missing, expired or
+// revoked session yields a fresh empty one.
+func (s *Store) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, cookie.Value, &session.ID, s.codecs...); err != nil {
+		session.ID = ""
+		return session, err
+	}
+
+	if err := s.load(r.Context(), session); err != nil {
+		session.ID = ""
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return session, nil
+		}
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save persists the session and writes its cookie. A negative MaxAge deletes
+// the session document along with the cookie.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if _, err := s.collection.DeleteOne(r.Context(), bson.M{"_id": session.ID}); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, gsessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if _, ok := session.Values[regenerateKey]; ok {
+		delete(session.Values, regenerateKey)
+		if session.ID != "" {
+			if _, err := s.collection.DeleteOne(r.Context(), bson.M{"_id": session.ID}); err != nil {
+				return err
+			}
+			session.ID = ""
+		}
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+
+	if err := s.save(r, session); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Regenerate makes the next Save move the session to a fresh ID, deleting
+// the old document, so an ID planted in the browser before a privilege change
+// is worthless after it. Call it whenever someone signs in or out.
+func Regenerate(session sessions.Session) {
+	session.Set(regenerateKey, true)
+}
+
+func (s *Store) load(ctx context.Context, session *gsessions.Session) error {
+	var doc models.Session
+	err := s.collection.FindOne(ctx, bson.M{
+		"_id":        session.ID,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&doc)
+	if err != nil {
+		return err
+	}
+
+	if err := securecookie.DecodeMulti(session.Name(), doc.Data, &session.Values, s.codecs...); err != nil {
+		return err
+	}
+
+	if time.Since(doc.LastSeen) > lastSeenInterval {
+		_, err = s.collection.UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{"$set": bson.M{"last_seen": time.Now()}})
+	}
+	return err
+}
+
+func (s *Store) save(r *http.Request, session *gsessions.Session) error {
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.codecs...)
+	if err != nil {
+		return err
+	}
+
+	userID, _ := session.Values["user_id"].(string)
+	now := time.Now()
+	_, err = s.collection.UpdateOne(
+		r.Context(),
+		bson.M{"_id": session.ID},
+		bson.M{
+			"$set": bson.M{
+				"user_id":    userID,
+				"data":       data,
+				"ip":         clientIP(r),
+				"user_agent": r.UserAgent(),
+				"last_seen":  now,
+				"expires_at": now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+			},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// clientIPKey is the request context key ClientIP stores the client address
+// under.
+type clientIPKey struct{}
+
+// ClientIP hands the store the client address gin resolved, which only
+// honours X-Forwarded-For from trusted proxies. The store only sees the
+// *http.Request, so this must run before sessions.Sessions.
+func ClientIP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), clientIPKey{}, c.ClientIP()))
+		c.Next()
+	}
+}
+
+// clientIP returns the address ClientIP recorded for the request, or the
+// connection's remote address without it.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
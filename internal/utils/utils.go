@@ -1,15 +1,107 @@
 package utils
 
 import (
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmj/internal/money"
 	"github.com/gin-gonic/gin"
-	gowebly "github.com/gowebly/helpers"
+	"html/template"
 	"log/slog"
 	"net/http"
+	"path/filepath"
+	"time"
 )
 
+// CurrentUserKey is the gin.Context key the auth middleware stores the
+// signed-in *models.User under.
+const CurrentUserKey = "currentUser"
+
+// LocaleKey is the gin.Context key holding the request's locale, e.g. "fr".
+const LocaleKey = "locale"
+
+// CurrentUser returns the signed-in user for this request, or nil.
+func CurrentUser(c *gin.Context) *models.User {
+	value, _ := c.Get(CurrentUserKey)
+	user, _ := value.(*models.User)
+	return user
+}
+
+// templateData adds the signed-in user to map (or nil) template data, so
+// layouts can show who is signed in. Caller keys take precedence.
+func templateData(c *gin.Context, data interface{}) interface{} {
+	values, ok := data.(map[string]interface{})
+	if data != nil && !ok {
+		return data
+	}
+
+	merged := map[string]interface{}{
+		"CurrentUser":     CurrentUser(c),
+		"isAuthenticated": c.GetBool("isAuthenticated"),
+	}
+	for key, value := range values {
+		merged[key] = value
+	}
+	return merged
+}
+
+// templateFuncs are the helpers available to every template.
+func templateFuncs(c *gin.Context) template.FuncMap {
+	locale := c.GetString(LocaleKey)
+	return template.FuncMap{
+		// t translates a message for the request's locale, e.g.
+		// {{ t "wall.replied" "name" .Creator.Name }}.
+		"t": func(key string, args ...any) string {
+			return i18n.T(locale, key, args...)
+		},
+		// locale is the request's locale, e.g. for <html lang>.
+		"locale": func() string {
+			if locale == "" {
+				return i18n.Default
+			}
+			return locale
+		},
+		// languages lists the locales people can switch to.
+		"languages": func() []i18n.Language {
+			return i18n.Languages
+		},
+		// date formats a day in the request's locale, e.g. "3 mars 2025".
+		"date": func(t time.Time) string {
+			return i18n.Date(locale, t)
+		},
+		// money formats an amount for the request's locale, e.g. "₦1,500.00".
+		"money": func(m money.Money) string {
+			return m.Format(locale)
+		},
+	}
+}
+
+// parseTemplates parses layout followed by templatePath, with templateFuncs.
+func parseTemplates(c *gin.Context, layout, templatePath string) (*template.Template, error) {
+	return template.New(filepath.Base(layout)).Funcs(templateFuncs(c)).ParseFiles(layout, templatePath)
+}
+
 // Render encapsulates template rendering logic for handlers.
 func Render(c *gin.Context, templatePath string, data interface{}) {
-	tmpl, err := gowebly.ParseTemplates(templatePath)
+	mainLayout := filepath.Join("templates", "main.html")
+	tmpl, err := parseTemplates(c, mainLayout, templatePath)
+	if err != nil {
+		// Log error and return HTTP 400 error.
+		slog.Error("Error parsing template", "path", templatePath, "error", err)
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if err := tmpl.Execute(c.Writer, templateData(c, data)); err != nil {
+		// Log error and return HTTP 500 error.
+		slog.Error("Error rendering template", "path", templatePath, "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
+
+// RenderDashboard renders a page inside the dashboard layout.
+func RenderDashboard(c *gin.Context, templatePath string, data interface{}) {
+	dashboardLayout := filepath.Join("templates", "dashboard.html")
+	tmpl, err := parseTemplates(c, dashboardLayout, templatePath)
 	if err != nil {
 		// Log error and return HTTP 400 error.
 		slog.Error("Error parsing template", "path", templatePath, "error", err)
@@ -17,9 +109,27 @@ func Render(c *gin.Context, templatePath string, data interface{}) {
 		return
 	}
 
-	if err := tmpl.Execute(c.Writer, data); err != nil {
+	if err := tmpl.Execute(c.Writer, templateData(c, data)); err != nil {
 		// Log error and return HTTP 500 error.
 		slog.Error("Error rendering template", "path", templatePath, "error", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 	}
 }
+
+// RenderPartial renders the template called name from templatePath without a
+// layout, for htmx to swap into a page that is already loaded.
+func RenderPartial(c *gin.Context, templatePath, name string, data interface{}) {
+	tmpl, err := template.New(filepath.Base(templatePath)).Funcs(templateFuncs(c)).ParseFiles(templatePath)
+	if err != nil {
+		// Log error and return HTTP 400 error.
+		slog.Error("Error parsing template", "path", templatePath, "error", err)
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if err := tmpl.ExecuteTemplate(c.Writer, name, templateData(c, data)); err != nil {
+		// Log error and return HTTP 500 error.
+		slog.Error("Error rendering template", "path", templatePath, "name", name, "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,169 @@
+package wall
+
+import (
+	"context"
+	"errors"
+	"fmj/internal/creators"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"fmj/internal/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+)
+
+type Handler struct {
+	service  Service
+	creators creators.Service
+}
+
+func NewHandler(service Service, creatorService creators.Service) *Handler {
+	return &Handler{service: service, creators: creatorService}
+}
+
+// RegisterRoutes registers the wall on a creator's page, which htmx loads a
+// page at a time as the supporter scrolls.
+func (h *Handler) RegisterRoutes(r *gin.Engine) {
+	r.GET("/:slug/supporters", h.ShowWall)
+}
+
+// RegisterDashboardRoutes registers the creator's wall moderation page. r
+// must already require authentication.
+func (h *Handler) RegisterDashboardRoutes(r *gin.RouterGroup) {
+	r.GET("/dashboard/wall", h.ShowMessages)
+	r.POST("/dashboard/wall/:id/hide", h.Hide)
+	r.POST("/dashboard/wall/:id/show", h.Show)
+	r.POST("/dashboard/wall/:id/pin", h.Pin)
+	r.POST("/dashboard/wall/:id/unpin", h.Unpin)
+	r.POST("/dashboard/wall/:id/reply", h.Reply)
+}
+
+// ShowWall renders a page of the wall, ending with the trigger that loads
+// the next one.
+func (h *Handler) ShowWall(c *gin.Context) {
+	creatorPage := filepath.Join("templates", "pages", "creator.html")
+
+	creator, err := h.creators.GetBySlug(c, c.Param("slug"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	page, err := h.service.PublicPage(c, creator.ID, c.Query("before"))
+	if errors.Is(err, ErrInvalidCursor) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("Error loading supporter wall", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Creator":  creator,
+		"Messages": append(page.Pinned, page.Messages...),
+		"Next":     page.Next,
+		"First":    c.Query("before") == "",
+	}
+	utils.RenderPartial(c, creatorPage, "supporters", data)
+}
+
+// ShowMessages renders the moderation page, or just the next page of
+// messages when htmx asks for one.
+func (h *Handler) ShowMessages(c *gin.Context) {
+	wallPage := filepath.Join("templates", "pages", "dashboard_wall.html")
+
+	creator, ok := creators.Current(c, h.creators, wallPage)
+	if !ok {
+		return
+	}
+	h.renderMessages(c, creator, "")
+}
+
+func (h *Handler) Hide(c *gin.Context) {
+	h.moderate(c, func(ctx context.Context, creator *models.Creator, id primitive.ObjectID) error {
+		return h.service.SetHidden(ctx, creator, id, true)
+	})
+}
+
+func (h *Handler) Show(c *gin.Context) {
+	h.moderate(c, func(ctx context.Context, creator *models.Creator, id primitive.ObjectID) error {
+		return h.service.SetHidden(ctx, creator, id, false)
+	})
+}
+
+func (h *Handler) Pin(c *gin.Context) {
+	h.moderate(c, func(ctx context.Context, creator *models.Creator, id primitive.ObjectID) error {
+		return h.service.SetPinned(ctx, creator, id, true)
+	})
+}
+
+func (h *Handler) Unpin(c *gin.Context) {
+	h.moderate(c, func(ctx context.Context, creator *models.Creator, id primitive.ObjectID) error {
+		return h.service.SetPinned(ctx, creator, id, false)
+	})
+}
+
+func (h *Handler) Reply(c *gin.Context) {
+	h.moderate(c, func(ctx context.Context, creator *models.Creator, id primitive.ObjectID) error {
+		return h.service.Reply(ctx, creator, id, c.PostForm("reply"))
+	})
+}
+
+// moderate applies change to the message in the URL on the signed-in
+// creator's wall.
+func (h *Handler) moderate(c *gin.Context, change func(context.Context, *models.Creator, primitive.ObjectID) error) {
+	wallPage := filepath.Join("templates", "pages", "dashboard_wall.html")
+
+	creator, ok := creators.Current(c, h.creators, wallPage)
+	if !ok {
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := change(c, creator, id); err != nil {
+		if errors.Is(err, ErrMessageNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		slog.Error("Error updating wall message", slog.String("donation_id", id.Hex()), slog.String("error", err.Error()))
+		h.renderMessages(c, creator, i18n.Message(c.GetString(utils.LocaleKey), err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/wall#message-"+id.Hex())
+}
+
+func (h *Handler) renderMessages(c *gin.Context, creator *models.Creator, errMsg string) {
+	wallPage := filepath.Join("templates", "pages", "dashboard_wall.html")
+	before := c.Query("before")
+
+	page, err := h.service.CreatorPage(c, creator.ID, before)
+	if errors.Is(err, ErrInvalidCursor) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("Error loading wall messages", slog.String("creator_id", creator.ID.Hex()), slog.String("error", err.Error()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Creator": creator,
+		"Page":    page,
+		"Error":   errMsg,
+	}
+	if before != "" {
+		utils.RenderPartial(c, wallPage, "messages", data)
+		return
+	}
+	utils.RenderDashboard(c, wallPage, data)
+}
@@ -0,0 +1,135 @@
+package wall
+
+import (
+	"context"
+	"fmj/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Repository reads the supporter wall from the donations collection, which
+// payments owns. The wall only writes its own fields: hidden, pinned and the
+// creator's reply.
+type Repository interface {
+	FindMessages(ctx context.Context, creatorID primitive.ObjectID, filter Filter, before primitive.ObjectID, limit int64) ([]*models.Donation, error)
+	FindMessage(ctx context.Context, id primitive.ObjectID) (*models.Donation, error)
+	CountPinned(ctx context.Context, creatorID primitive.ObjectID) (int64, error)
+	SetHidden(ctx context.Context, id primitive.ObjectID, hidden bool) error
+	SetPinned(ctx context.Context, id primitive.ObjectID, pinned bool) error
+	SetReply(ctx context.Context, id primitive.ObjectID, reply string) error
+	EnsureIndexes(ctx context.Context) error
+}
+
+// Filter picks which of a creator's wall messages to find.
+type Filter int
+
+const (
+	// FilterAll is every message, for the creator.
+	FilterAll Filter = iota
+	// FilterPinned is the pinned messages shown at the top of the wall.
+	FilterPinned
+	// FilterPublic is the rest of what supporters see.
+	FilterPublic
+)
+
+type repository struct {
+	db *mongo.Database
+}
+
+// wallQuery matches the donations on the creator's wall. Only paid one-off
+// donations make it onto the wall; membership renewals would crowd it out.
+func wallQuery(creatorID primitive.ObjectID) bson.M {
+	return bson.M{
+		"creator_id":      creatorID,
+		"status":          models.DonationSucceeded,
+		"subscription_id": bson.M{"$exists": false},
+	}
+}
+
+// FindMessages returns the creator's wall messages matching filter, newest
+// first, starting after before unless it is nil.
+func (r repository) FindMessages(ctx context.Context, creatorID primitive.ObjectID, filter Filter, before primitive.ObjectID, limit int64) ([]*models.Donation, error) {
+	query := wallQuery(creatorID)
+	switch filter {
+	case FilterPinned:
+		query["pinned"] = true
+	case FilterPublic:
+		query["pinned"] = bson.M{"$ne": true}
+		query["hidden"] = bson.M{"$ne": true}
+	}
+	if !before.IsZero() {
+		query["_id"] = bson.M{"$lt": before}
+	}
+
+	cursor, err := r.db.Collection("donations").Find(
+		ctx,
+		query,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var donations []*models.Donation
+	if err := cursor.All(ctx, &donations); err != nil {
+		return nil, err
+	}
+	return donations, nil
+}
+
+func (r repository) FindMessage(ctx context.Context, id primitive.ObjectID) (*models.Donation, error) {
+	var donation models.Donation
+	err := r.db.Collection("donations").FindOne(ctx, bson.M{"_id": id}).Decode(&donation)
+	if err != nil {
+		return nil, err
+	}
+	return &donation, nil
+}
+
+// CountPinned counts the pinned messages still on the creator's wall.
+func (r repository) CountPinned(ctx context.Context, creatorID primitive.ObjectID) (int64, error) {
+	query := wallQuery(creatorID)
+	query["pinned"] = true
+	return r.db.Collection("donations").CountDocuments(ctx, query)
+}
+
+// SetHidden hides or shows a message. Hiding a message also unpins it.
+func (r repository) SetHidden(ctx context.Context, id primitive.ObjectID, hidden bool) error {
+	set := bson.M{"hidden": hidden}
+	if hidden {
+		set["pinned"] = false
+	}
+	return r.update(ctx, id, set)
+}
+
+// SetPinned pins or unpins a message. Pinning a message also shows it.
+func (r repository) SetPinned(ctx context.Context, id primitive.ObjectID, pinned bool) error {
+	set := bson.M{"pinned": pinned}
+	if pinned {
+		set["hidden"] = false
+	}
+	return r.update(ctx, id, set)
+}
+
+func (r repository) SetReply(ctx context.Context, id primitive.ObjectID, reply string) error {
+	return r.update(ctx, id, bson.M{"reply": reply, "replied_at": time.Now()})
+}
+
+func (r repository) update(ctx context.Context, id primitive.ObjectID, set bson.M) error {
+	set["updated_at"] = time.Now()
+	_, err := r.db.Collection("donations").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
+
+func (r repository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.db.Collection("donations").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "creator_id", Value: 1}, {Key: "status", Value: 1}, {Key: "_id", Value: -1}},
+	})
+	return err
+}
+
+func NewRepository(db *mongo.Database) Repository {
+	return &repository{db}
+}
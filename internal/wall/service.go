@@ -0,0 +1,144 @@
+package wall
+
+import (
+	"context"
+	"errors"
+	"fmj/internal/i18n"
+	"fmj/internal/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strings"
+)
+
+// ErrMessageNotFound is returned when no wall message matches, or it is on
+// another creator's wall.
+var ErrMessageNotFound = i18n.NewError("wall.error.not_found")
+
+// ErrInvalidCursor is returned for a page cursor that isn't one of ours.
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+const (
+	// pageSize is how many messages each scroll of the wall loads.
+	pageSize = 20
+
+	maxPinned      = 3
+	maxReplyLength = 500
+)
+
+// Page is one scroll's worth of the wall. Pinned is only filled on the first
+// page, and Next is empty once there is nothing older to load.
+type Page struct {
+	Pinned   []*models.Donation
+	Messages []*models.Donation
+	Next     string
+}
+
+type Service interface {
+	PublicPage(ctx context.Context, creatorID primitive.ObjectID, before string) (*Page, error)
+	CreatorPage(ctx context.Context, creatorID primitive.ObjectID, before string) (*Page, error)
+	SetHidden(ctx context.Context, creator *models.Creator, id primitive.ObjectID, hidden bool) error
+	SetPinned(ctx context.Context, creator *models.Creator, id primitive.ObjectID, pinned bool) error
+	Reply(ctx context.Context, creator *models.Creator, id primitive.ObjectID, reply string) error
+}
+
+type service struct {
+	repo Repository
+}
+
+// PublicPage returns the wall as supporters see it, loading messages older
+// than before, a cursor from a previous page's Next.
+func (s *service) PublicPage(ctx context.Context, creatorID primitive.ObjectID, before string) (*Page, error) {
+	page, err := s.page(ctx, creatorID, FilterPublic, before)
+	if err != nil {
+		return nil, err
+	}
+	if before == "" {
+		page.Pinned, err = s.repo.FindMessages(ctx, creatorID, FilterPinned, primitive.NilObjectID, maxPinned)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// CreatorPage returns every message on the creator's wall, hidden and
+// pinned ones included.
+func (s *service) CreatorPage(ctx context.Context, creatorID primitive.ObjectID, before string) (*Page, error) {
+	return s.page(ctx, creatorID, FilterAll, before)
+}
+
+func (s *service) page(ctx context.Context, creatorID primitive.ObjectID, filter Filter, before string) (*Page, error) {
+	var cursor primitive.ObjectID
+	if before != "" {
+		var err error
+		if cursor, err = primitive.ObjectIDFromHex(before); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	// Ask for one more than a page to tell whether there is another.
+	messages, err := s.repo.FindMessages(ctx, creatorID, filter, cursor, pageSize+1)
+	if err != nil {
+		return nil, err
+	}
+	page := &Page{Messages: messages}
+	if len(messages) > pageSize {
+		page.Messages = messages[:pageSize]
+		page.Next = page.Messages[pageSize-1].ID.Hex()
+	}
+	return page, nil
+}
+
+func (s *service) SetHidden(ctx context.Context, creator *models.Creator, id primitive.ObjectID, hidden bool) error {
+	if _, err := s.getMessage(ctx, creator, id); err != nil {
+		return err
+	}
+	return s.repo.SetHidden(ctx, id, hidden)
+}
+
+func (s *service) SetPinned(ctx context.Context, creator *models.Creator, id primitive.ObjectID, pinned bool) error {
+	message, err := s.getMessage(ctx, creator, id)
+	if err != nil {
+		return err
+	}
+	if pinned && !message.Pinned {
+		count, err := s.repo.CountPinned(ctx, creator.ID)
+		if err != nil {
+			return err
+		}
+		if count >= maxPinned {
+			return i18n.NewError("wall.error.pin_limit", "count", maxPinned)
+		}
+	}
+	return s.repo.SetPinned(ctx, id, pinned)
+}
+
+// Reply sets the creator's reply to a message. An empty reply removes it.
+func (s *service) Reply(ctx context.Context, creator *models.Creator, id primitive.ObjectID, reply string) error {
+	if _, err := s.getMessage(ctx, creator, id); err != nil {
+		return err
+	}
+	reply = strings.TrimSpace(reply)
+	if len([]rune(reply)) > maxReplyLength {
+		return i18n.NewError("wall.error.reply_too_long", "count", maxReplyLength)
+	}
+	return s.repo.SetReply(ctx, id, reply)
+}
+
+func (s *service) getMessage(ctx context.Context, creator *models.Creator, id primitive.ObjectID) (*models.Donation, error) {
+	message, err := s.repo.FindMessage(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if message.CreatorID != creator.ID || message.Status != models.DonationSucceeded || message.SubscriptionID != nil {
+		return nil, ErrMessageNotFound
+	}
+	return message, nil
+}
+
+func NewService(repo Repository) Service {
+	return &service{repo: repo}
+}
@@ -1,15 +1,20 @@
 package middleware
 
 import (
+	"errors"
+	"fmj/internal/auth"
+	"fmj/internal/models"
+	"fmj/internal/utils"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log/slog"
 )
 
-func AuthRequired() gin.HandlerFunc {
+func AuthRequired(users auth.Repository) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		session := sessions.Default(c)
-		userID := session.Get("user_id")
-		if userID == nil {
+		if loadUser(c, users) == nil {
 			c.Redirect(302, "/auth/login")
 			c.Abort()
 			return
@@ -21,15 +26,55 @@ func AuthRequired() gin.HandlerFunc {
 }
 
 // CheckAuth Middleware to check authentication without redirection
-func CheckAuth() gin.HandlerFunc {
+func CheckAuth(users auth.Repository) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		session := sessions.Default(c)
-		userID := session.Get("user_id")
-		if userID == nil {
-			c.Set("isAuthenticated", false)
-		} else {
-			c.Set("isAuthenticated", true)
-		}
+		c.Set("isAuthenticated", loadUser(c, users) != nil)
 		c.Next()
 	}
 }
+
+// isSignedIn reports whether the session belongs to a fully authenticated
+// user. A session still waiting on a two-factor code doesn't count.
+func isSignedIn(session sessions.Session) bool {
+	if session.Get(auth.PendingTwoFactorSessionKey) != nil {
+		return false
+	}
+	return session.Get("user_id") != nil
+}
+
+// loadUser returns the signed-in user and stores them on the context,
+// fetching them at most once per request. It returns nil when nobody is
+// signed in, and ends the session if its user has been deleted.
+func loadUser(c *gin.Context, users auth.Repository) *models.User {
+	if user := utils.CurrentUser(c); user != nil {
+		return user
+	}
+
+	session := sessions.Default(c)
+	if !isSignedIn(session) {
+		return nil
+	}
+	userID, _ := session.Get("user_id").(string)
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil
+	}
+
+	user, err := users.FindUserByID(c, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		slog.Info("Ending session of deleted user", slog.String("user_id", userID))
+		session.Clear()
+		// A negative MaxAge makes the store delete the server-side session.
+		session.Options(sessions.Options{MaxAge: -1, Path: "/"})
+		if err := session.Save(); err != nil {
+			slog.Error("An error occurred while saving the session", "error", err)
+		}
+		return nil
+	}
+	if err != nil {
+		slog.Error("Error loading signed-in user", slog.String("user_id", userID), slog.String("error", err.Error()))
+		return nil
+	}
+	c.Set(utils.CurrentUserKey, user)
+	return user
+}
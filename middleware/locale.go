@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"fmj/internal/i18n"
+	"fmj/internal/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// Locale picks the request's language and stores it under utils.LocaleKey:
+// the signed-in user's choice, then the language cookie, then the browser's
+// Accept-Language. It must run after CheckAuth.
+func Locale() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(utils.LocaleKey, requestLocale(c))
+		c.Next()
+	}
+}
+
+func requestLocale(c *gin.Context) string {
+	if user := utils.CurrentUser(c); user != nil && i18n.Supported(user.Locale) {
+		return user.Locale
+	}
+	if locale, err := c.Cookie(i18n.Cookie); err == nil && i18n.Supported(locale) {
+		return locale
+	}
+	return i18n.Negotiate(c.GetHeader("Accept-Language"))
+}
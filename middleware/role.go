@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"fmj/internal/auth"
+	"fmj/internal/models"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// RequireRole only lets through signed-in users holding at least one of
+// roles. Everyone else who is signed in gets a 403.
+func RequireRole(users auth.Repository, roles ...models.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := loadUser(c, users)
+		if user == nil {
+			c.Redirect(http.StatusFound, "/auth/login")
+			c.Abort()
+			return
+		}
+		if !user.HasRole(roles...) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
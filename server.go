@@ -4,11 +4,20 @@ import (
 	"context"
 	"fmj/config"
 	"fmj/internal/auth"
+	"fmj/internal/campaigns"
+	"fmj/internal/creators"
 	"fmj/internal/email"
+	"fmj/internal/fx"
+	"fmj/internal/ledger"
+	"fmj/internal/memberships"
+	"fmj/internal/models"
+	"fmj/internal/payments"
+	"fmj/internal/payouts"
+	"fmj/internal/session"
+	"fmj/internal/wall"
 	"fmj/middleware"
 	"fmt"
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"go.mongodb.org/mongo-driver/mongo"
 	"log/slog"
 	"net/http"
@@ -29,30 +38,145 @@ func runServer(db *mongo.Database, cfg *config.Config) error {
 	}
 
 	// Initialize services
-	emailService := email.NewService(cfg)
 	authRepo := auth.NewRepository(db, context.Context(context.Background()))
+	if err := authRepo.EnsureIndexes(context.Background()); err != nil {
+		return err
+	}
+	if err := authRepo.MigrateLegacyIdentities(context.Background()); err != nil {
+		return err
+	}
+	if err := authRepo.MigrateDefaultRoles(context.Background()); err != nil {
+		return err
+	}
+	emailRepo := email.NewRepository(db)
+	if err := emailRepo.EnsureIndexes(context.Background()); err != nil {
+		return err
+	}
+	emailTransport, err := email.NewTransport(cfg)
+	if err != nil {
+		return err
+	}
+	slog.Info("Using email transport", "transport", emailTransport.Name())
+	emailOutbox := email.NewOutbox(emailRepo, emailTransport)
+	emailSuppressions := email.NewSuppressions(emailRepo, authRepo, cfg)
+	emailService := email.NewService(emailOutbox, emailSuppressions, authRepo, cfg)
+	emailHandler := email.NewHandler(emailOutbox, emailSuppressions)
 	authService := auth.NewService(authRepo, emailService)
-	authHandler := auth.NewHandler(authService, cfg)
+	authProviders := auth.NewProviders(cfg.OIDCProviders)
+	authHandler := auth.NewHandler(authService, authProviders, cfg)
+	creatorRepo := creators.NewRepository(db)
+	if err := creatorRepo.EnsureIndexes(context.Background()); err != nil {
+		return err
+	}
+	if err := creatorRepo.MigrateMoneyFields(context.Background()); err != nil {
+		return err
+	}
+	creatorService := creators.NewService(creatorRepo, authRepo)
+	paymentGateways, err := payments.NewGateways(cfg)
+	if err != nil {
+		return err
+	}
+	paymentRepo := payments.NewRepository(db)
+	if err := paymentRepo.EnsureIndexes(context.Background()); err != nil {
+		return err
+	}
+	if err := paymentRepo.MigrateMoneyFields(context.Background()); err != nil {
+		return err
+	}
+	rateProvider, err := fx.NewProvider(cfg)
+	if err != nil {
+		return err
+	}
+	rateService := fx.NewService(rateProvider, fx.NewRepository(db))
+	paymentService := payments.NewService(paymentRepo, paymentGateways, rateService, emailService, creatorService, authRepo, cfg)
+	paymentHandler := payments.NewHandler(paymentService, paymentGateways, creatorService)
+	ledgerRepo := ledger.NewRepository(db)
+	if err := ledgerRepo.RequireReplicaSet(context.Background()); err != nil {
+		return err
+	}
+	if err := ledgerRepo.EnsureIndexes(context.Background()); err != nil {
+		return err
+	}
+	ledgerService := ledger.NewService(ledgerRepo, cfg)
+	paymentService.OnSettled(ledgerService)
+	paymentService.OnStatusChanged(ledgerService)
+	if err := ledgerService.Reconcile(context.Background(), paymentService); err != nil {
+		return err
+	}
+	ledgerHandler := ledger.NewHandler(ledgerService, creatorService)
+	payoutRepo := payouts.NewRepository(db)
+	if err := payoutRepo.EnsureIndexes(context.Background()); err != nil {
+		return err
+	}
+	payoutService := payouts.NewService(payoutRepo, paymentGateways, ledgerService, creatorService)
+	paymentService.OnTransfer(payoutService)
+	payoutHandler := payouts.NewHandler(payoutService, ledgerService, creatorService)
+	membershipRepo := memberships.NewRepository(db)
+	if err := membershipRepo.EnsureIndexes(context.Background()); err != nil {
+		return err
+	}
+	membershipService := memberships.NewService(membershipRepo, paymentService, creatorService, authRepo)
+	paymentService.OnSettled(membershipService)
+	membershipHandler := memberships.NewHandler(membershipService, creatorService)
+	campaignRepo := campaigns.NewRepository(db)
+	if err := campaignRepo.EnsureIndexes(context.Background()); err != nil {
+		return err
+	}
+	campaignService := campaigns.NewService(campaignRepo, paymentService)
+	campaignHandler := campaigns.NewHandler(campaignService, creatorService)
+	wallRepo := wall.NewRepository(db)
+	if err := wallRepo.EnsureIndexes(context.Background()); err != nil {
+		return err
+	}
+	wallHandler := wall.NewHandler(wall.NewService(wallRepo), creatorService)
+	creatorHandler := creators.NewHandler(creatorService, membershipService, campaignService)
+	sessionRepo := session.NewRepository(db)
+	sessionService := session.NewService(sessionRepo)
+	sessionHandler := session.NewHandler(sessionService)
 
 	// Create a new gin server.
 	router := gin.Default()
+	// Only believe X-Forwarded-For from our own proxies, so clients can't
+	// pick the IP that login throttling and sessions see
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return err
+	}
 
 	// Handle static files.
 	router.Static("/static", "./static")
 
 	// Setup sessions
-	store := cookie.NewStore([]byte(cfg.SessionSecret))
+	store, err := session.NewStore(context.Background(), db, []byte(cfg.SessionSecret))
+	if err != nil {
+		return err
+	}
 	store.Options(sessions.Options{
-		MaxAge: 60 * 60 * 24 * 10, // 10 days
-		Path:   "/",
+		MaxAge:   60 * 60 * 24 * 10, // 10 days
+		Path:     "/",
+		HttpOnly: true,
 	})
+	router.Use(session.ClientIP())
 	router.Use(sessions.Sessions("auth_session", store))
 	// Apply CheckAuth to public routes
-	router.Use(middleware.CheckAuth())
+	router.Use(middleware.CheckAuth(authRepo))
+	// Pick the language for pages and the emails they trigger
+	router.Use(middleware.Locale())
+
+	// Preview emails with sample data while developing
+	if gin.Mode() == gin.DebugMode {
+		email.NewPreviewHandler(cfg).RegisterRoutes(router)
+	}
 
 	// Register auth routes
 	authHandler.RegisterRoutes(router)
 
+	// Register checkout, gateway callback and webhook routes
+	paymentHandler.RegisterRoutes(router)
+	membershipHandler.RegisterRoutes(router)
+	campaignHandler.RegisterRoutes(router)
+	wallHandler.RegisterRoutes(router)
+	emailHandler.RegisterRoutes(router)
+
 	// Handle index page view.
 	router.GET("/", indexViewHandler)
 
@@ -61,10 +185,32 @@ func runServer(db *mongo.Database, cfg *config.Config) error {
 
 	// protected ungrouped routes
 	protected := router.Group("/")
-	protected.Use(middleware.AuthRequired())
+	protected.Use(middleware.AuthRequired(authRepo))
 	{
 		protected.GET("/dashboard", showDashboardHandler)
 	}
+	authHandler.RegisterDashboardRoutes(protected)
+	sessionHandler.RegisterRoutes(protected)
+	creatorHandler.RegisterDashboardRoutes(protected)
+	paymentHandler.RegisterDashboardRoutes(protected)
+	membershipHandler.RegisterDashboardRoutes(protected)
+	campaignHandler.RegisterDashboardRoutes(protected)
+	wallHandler.RegisterDashboardRoutes(protected)
+	emailHandler.RegisterDashboardRoutes(protected)
+	ledgerHandler.RegisterDashboardRoutes(protected)
+	payoutHandler.RegisterDashboardRoutes(protected)
+
+	// admin routes
+	admin := router.Group("/")
+	admin.Use(middleware.RequireRole(authRepo, models.RoleAdmin))
+	ledgerHandler.RegisterAdminRoutes(admin)
+	paymentHandler.RegisterAdminRoutes(admin)
+	emailHandler.RegisterAdminRoutes(admin)
+	payoutHandler.RegisterAdminRoutes(admin)
+
+	// Creator pages live at the top level, after every other route.
+	creators.ReserveRoutes(router.Routes())
+	creatorHandler.RegisterRoutes(router)
 	// Create a new server instance with options from environment variables.
 	// For more information, see https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
 	server := &http.Server{
@@ -74,6 +220,17 @@ func runServer(db *mongo.Database, cfg *config.Config) error {
 		Handler:      router,
 	}
 
+	// Charge membership renewals in the background.
+	memberships.NewScheduler(membershipService, 10*time.Minute).Start(context.Background())
+	// Close campaigns once their deadline passes.
+	campaigns.NewScheduler(campaignService, time.Minute).Start(context.Background())
+	// Catch the ledger up with donations and check it still balances.
+	ledger.NewScheduler(ledgerService, paymentService, time.Hour).Start(context.Background())
+	// Check on transfers the gateway hasn't sent a webhook for.
+	payouts.NewScheduler(payoutService, 10*time.Minute).Start(context.Background())
+	// Send queued emails, retrying failures with backoff.
+	email.NewWorker(emailOutbox, 4, 5*time.Second).Start(context.Background())
+
 	// Send log message.
 	slog.Info("Starting server...", "port", port)
 